@@ -0,0 +1,356 @@
+package certmagic_azblob
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// provisioned holds the storages of the running Caddy config so they can be
+// reached from the admin API.
+var provisioned = struct {
+	sync.Mutex
+	storages map[*Storage]struct{}
+}{storages: make(map[*Storage]struct{})}
+
+func registerStorage(s *Storage) {
+	provisioned.Lock()
+	provisioned.storages[s] = struct{}{}
+	provisioned.Unlock()
+}
+
+func unregisterStorage(s *Storage) {
+	provisioned.Lock()
+	delete(provisioned.storages, s)
+	provisioned.Unlock()
+}
+
+// provisionedInstance reports whether id is the instance ID of one of the
+// storages of the running Caddy config.
+func provisionedInstance(id string) bool {
+	if id == "" {
+		return false
+	}
+	provisioned.Lock()
+	defer provisioned.Unlock()
+
+	for s := range provisioned.storages {
+		if s.uuid == id {
+			return true
+		}
+	}
+	return false
+}
+
+func provisionedStorages() []*Storage {
+	provisioned.Lock()
+	defer provisioned.Unlock()
+
+	storages := make([]*Storage, 0, len(provisioned.storages))
+	for s := range provisioned.storages {
+		storages = append(storages, s)
+	}
+	return storages
+}
+
+// adminAPI serves the azblob endpoints of the admin API:
+//
+//	GET  /azblob/health        health of storages with health_check, re-checked
+//	                           on every request, 503 if any is unhealthy
+//	GET  /azblob/status        configuration, key counts and sizes, last
+//	                           successful operations and held locks
+//	GET  /azblob/usage         key counts and sizes per top level directory
+//	GET  /azblob/versions?key= versions of a key
+//	POST /azblob/restore       restore {"key": ..., "version_id": ...}
+//	POST /azblob/delete        delete all keys starting with {"prefix": ...}
+//	POST /azblob/rewrap        re-encrypt keys starting with {"prefix": ...}
+//	                           with the current client encryption key
+//
+// The usage, versions, restore, delete and rewrap endpoints take a
+// container (and prefix) query parameter to pick the storage when several
+// are configured.
+type adminAPI struct{}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.azblob",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+func (adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/azblob/health",
+			Handler: caddy.AdminHandlerFunc(serveHealth),
+		},
+		{
+			Pattern: "/azblob/status",
+			Handler: caddy.AdminHandlerFunc(serveStatus),
+		},
+		{
+			Pattern: "/azblob/usage",
+			Handler: caddy.AdminHandlerFunc(serveUsage),
+		},
+		{
+			Pattern: "/azblob/versions",
+			Handler: caddy.AdminHandlerFunc(serveVersions),
+		},
+		{
+			Pattern: "/azblob/restore",
+			Handler: caddy.AdminHandlerFunc(serveRestore),
+		},
+		{
+			Pattern: "/azblob/delete",
+			Handler: caddy.AdminHandlerFunc(serveDelete),
+		},
+		{
+			Pattern: "/azblob/rewrap",
+			Handler: caddy.AdminHandlerFunc(serveRewrap),
+		},
+	}
+}
+
+func serveHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	code := http.StatusOK
+	statuses := make([]HealthStatus, 0)
+	for _, s := range provisionedStorages() {
+		if !s.HealthCheck {
+			continue
+		}
+		if s.CheckHealth(r.Context()) != nil {
+			code = http.StatusServiceUnavailable
+		}
+		statuses = append(statuses, s.Health())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(statuses)
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	statuses := make([]StorageStatus, 0)
+	for _, s := range provisionedStorages() {
+		status, err := s.Status(r.Context())
+		if err != nil {
+			return adminError(err)
+		}
+		statuses = append(statuses, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(statuses)
+}
+
+func serveUsage(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	s, err := adminStorage(r)
+	if err != nil {
+		return err
+	}
+
+	usage, err := s.Usage(r.Context())
+	if err != nil {
+		return adminError(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(usage)
+}
+
+func serveVersions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	s, err := adminStorage(r)
+	if err != nil {
+		return err
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("missing key"),
+		}
+	}
+
+	versions, err := s.ListVersions(r.Context(), key)
+	if err != nil {
+		return adminError(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(versions)
+}
+
+func serveRestore(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	s, err := adminStorage(r)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Key       string `json:"key"`
+		VersionID string `json:"version_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" || req.VersionID == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("expected a JSON body with key and version_id"),
+		}
+	}
+
+	if err := s.RestoreVersion(r.Context(), req.Key, req.VersionID); err != nil {
+		return adminError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func serveDelete(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	s, err := adminStorage(r)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Prefix string `json:"prefix"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Prefix == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("expected a JSON body with a non-empty prefix"),
+		}
+	}
+
+	deleted, err := s.DeleteAll(r.Context(), req.Prefix)
+	if err != nil {
+		return adminError(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
+}
+
+func serveRewrap(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	s, err := adminStorage(r)
+	if err != nil {
+		return err
+	}
+
+	// The body is optional, without it every key is rewrapped.
+	var req struct {
+		Prefix string `json:"prefix"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("expected a JSON body with an optional prefix"),
+		}
+	}
+
+	rewrapped, err := s.Rewrap(r.Context(), req.Prefix)
+	if err != nil {
+		return adminError(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]int{"rewrapped": rewrapped})
+}
+
+// adminStorage picks the storage addressed by the container and prefix
+// query parameters, which may be left out if only one matches.
+func adminStorage(r *http.Request) (*Storage, error) {
+	container := r.URL.Query().Get("container")
+	prefix, filterPrefix := r.URL.Query()["prefix"]
+
+	var found []*Storage
+	for _, s := range provisionedStorages() {
+		if container != "" && s.ContainerName != container {
+			continue
+		}
+		if filterPrefix && s.Prefix != prefix[0] {
+			continue
+		}
+		found = append(found, s)
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no azblob storage matches"),
+		}
+	case 1:
+		return found[0], nil
+	}
+	return nil, caddy.APIError{
+		HTTPStatus: http.StatusBadRequest,
+		Err:        fmt.Errorf("several azblob storages match, select one with the container and prefix parameters"),
+	}
+}
+
+func adminError(err error) error {
+	code := http.StatusInternalServerError
+	if errors.Is(err, fs.ErrNotExist) {
+		code = http.StatusNotFound
+	}
+	return caddy.APIError{HTTPStatus: code, Err: err}
+}
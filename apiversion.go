@@ -0,0 +1,80 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// Service versions that introduced the features not every deployment has,
+// e.g. Azure Stack Hub, which lags behind the public cloud.
+const (
+	apiVersionCPK             = "2018-12-11"
+	apiVersionEncryptionScope = "2019-02-02"
+	apiVersionVersioning      = "2019-12-12"
+	apiVersionTags            = "2019-12-12"
+	apiVersionRehydrate       = "2019-12-12"
+	apiVersionImmutability    = "2020-06-12"
+)
+
+// apiFeatures are the options that need a newer service version than
+// APIVersion may be.
+var apiFeatures = []struct {
+	option  string
+	version string
+	enabled func(*Storage) bool
+}{
+	{"encryption_key", apiVersionCPK, func(s *Storage) bool { return s.EncryptionKey != "" }},
+	{"encryption_scope", apiVersionEncryptionScope, func(s *Storage) bool { return s.EncryptionScope != "" }},
+	{"index_tags", apiVersionTags, func(s *Storage) bool { return s.IndexTags }},
+	{"lifecycle_tags", apiVersionTags, func(s *Storage) bool { return s.LifecycleTags }},
+	{"rehydrate_priority", apiVersionRehydrate, func(s *Storage) bool { return s.RehydratePriority != "" }},
+	{"immutability_period", apiVersionImmutability, func(s *Storage) bool { return s.ImmutabilityPeriod > 0 }},
+	{"legal_hold", apiVersionImmutability, func(s *Storage) bool { return s.LegalHold }},
+}
+
+// validateAPIVersion checks that the configured features are available in
+// APIVersion.
+func (s *Storage) validateAPIVersion() error {
+	if s.APIVersion == "" {
+		return nil
+	}
+	if _, err := time.Parse("2006-01-02", s.APIVersion); err != nil {
+		return fmt.Errorf("api_version must be a service version like 2019-02-02, got %q", s.APIVersion)
+	}
+
+	for _, f := range apiFeatures {
+		if f.enabled(s) && !s.supports(f.version) {
+			return fmt.Errorf("%s requires api_version %s or later, got %s", f.option, f.version, s.APIVersion)
+		}
+	}
+	return nil
+}
+
+// apiVersion returns the service version requests are sent with.
+func (s *Storage) apiVersion() string {
+	if s.APIVersion != "" {
+		return s.APIVersion
+	}
+	return azblob.ServiceVersion
+}
+
+// supports reports whether the service version in use is at least version.
+// Versions compare as strings since they are dates.
+func (s *Storage) supports(version string) bool {
+	return s.APIVersion == "" || s.APIVersion >= version
+}
+
+// apiVersionPolicy sends APIVersion instead of the SDK's service version.
+// It has to run before requests are signed, which covers x-ms-version.
+func (s *Storage) apiVersionPolicy() pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			request.Header.Set("x-ms-version", s.APIVersion)
+			return next.Do(ctx, request)
+		}
+	})
+}
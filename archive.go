@@ -0,0 +1,65 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+)
+
+// isArchived reports whether err is caused by reading a blob that a
+// lifecycle policy moved to the archive tier.
+func isArchived(err error) bool {
+	switch serviceCode(err) {
+	case azblob.ServiceCodeBlobArchived, azblob.ServiceCodeBlobBeingRehydrated:
+		return true
+	}
+	return false
+}
+
+func parseRehydratePriority(priority string) (azblob.RehydratePriorityType, error) {
+	switch strings.ToLower(priority) {
+	case "":
+		return azblob.RehydratePriorityNone, nil
+	case "standard":
+		return azblob.RehydratePriorityStandard, nil
+	case "high":
+		return azblob.RehydratePriorityHigh, nil
+	}
+	return azblob.RehydratePriorityNone, fmt.Errorf("unsupported rehydrate_priority %q, expected Standard or High", priority)
+}
+
+// rehydrationTier is the tier archived blobs are brought back to, the one
+// new blobs are written with or Hot if that is the account default.
+func (s *Storage) rehydrationTier() azblob.AccessTierType {
+	if s.accessTier != azblob.DefaultAccessTier {
+		return s.accessTier
+	}
+	return azblob.AccessTierHot
+}
+
+// archivedError starts rehydrating the archived blob of key if
+// RehydratePriority is set, and returns ErrRehydrating if it is on its way
+// back or ErrArchived otherwise.
+func (s *Storage) archivedError(ctx context.Context, blobURL azblob.BlobURL, key string, err error) error {
+	if serviceCode(err) == azblob.ServiceCodeBlobBeingRehydrated {
+		return fmt.Errorf("%w: %s", ErrRehydrating, key)
+	}
+	if s.rehydrate == azblob.RehydratePriorityNone {
+		s.logger.Error("Load Error", zap.String("key", key), zap.String("err", ErrArchived.Error()))
+		return fmt.Errorf("%w: %s", ErrArchived, key)
+	}
+
+	_, err = blobURL.SetTier(ctx, s.rehydrationTier(), azblob.LeaseAccessConditions{}, s.rehydrate)
+	if err != nil && serviceCode(err) != azblob.ServiceCodeBlobBeingRehydrated {
+		s.logger.Error("Rehydrate Error", zap.String("key", key), s.errField(err))
+		return fmt.Errorf("%w: %s", ErrArchived, key)
+	}
+	s.logger.Warn("Rehydrating archived blob",
+		zap.String("key", key),
+		zap.String("tier", string(s.rehydrationTier())),
+		zap.String("priority", string(s.rehydrate)))
+	return fmt.Errorf("%w: %s", ErrRehydrating, key)
+}
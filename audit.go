@@ -0,0 +1,107 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+)
+
+// auditTimeout bounds the append of a single audit record.
+const auditTimeout = 10 * time.Second
+
+// AuditRecord is a line of the audit log.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"`
+	Key      string    `json:"key"`
+	Instance string    `json:"instance"`
+	Result   string    `json:"result"`
+
+	// Prev is the SHA-256 of the previous record this instance wrote, so a
+	// removed or altered record breaks the chain.
+	Prev string `json:"prev,omitempty"`
+}
+
+// auditKey is the append blob records written at t go to, one per day so
+// no blob reaches the block limit of append blobs.
+func (s *Storage) auditKey(t time.Time) string {
+	return path.Join(s.AuditLog, t.Format("2006-01-02")+".jsonl")
+}
+
+// isAuditKey reports whether key is a blob of the audit log.
+func (s *Storage) isAuditKey(key string) bool {
+	return s.AuditLog != "" && strings.HasPrefix(key, s.AuditLog+"/")
+}
+
+// audit appends a record of op on key to the audit log. A failure is logged
+// but doesn't fail op, which already happened.
+func (s *Storage) audit(op, key string, err error) {
+	record := AuditRecord{
+		Time:     time.Now().UTC(),
+		Op:       op,
+		Key:      key,
+		Instance: s.uuid,
+		Result:   "ok",
+	}
+	if err != nil {
+		record.Result = err.Error()
+	}
+
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	record.Prev = s.auditPrev
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	// The write is audited even if it was canceled.
+	ctx, cancel := context.WithTimeout(s.ctx, auditTimeout)
+	defer cancel()
+
+	auditKey := s.auditKey(record.Time)
+	blobURL := s.container(auditKey).NewAppendBlobURL(s.blobName(auditKey))
+	err = s.appendAudit(ctx, blobURL, line)
+	if isNotFound(err) {
+		err = s.createAudit(ctx, blobURL)
+		if err == nil {
+			err = s.appendAudit(ctx, blobURL, line)
+		}
+	}
+	if err != nil {
+		s.logger.Error("Audit Error", zap.String("op", op), zap.String("key", key), s.errField(err))
+		return
+	}
+
+	sum := sha256.Sum256(line)
+	s.auditPrev = hex.EncodeToString(sum[:])
+}
+
+func (s *Storage) appendAudit(ctx context.Context, blobURL azblob.AppendBlobURL, line []byte) error {
+	_, err := blobURL.AppendBlock(ctx, bytes.NewReader(line), azblob.AppendBlobAccessConditions{}, nil, s.cpk)
+	return err
+}
+
+// createAudit creates the append blob of a day unless another instance did
+// already.
+func (s *Storage) createAudit(ctx context.Context, blobURL azblob.AppendBlobURL) error {
+	ac := azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny},
+	}
+	headers := azblob.BlobHTTPHeaders{ContentType: "application/x-ndjson"}
+	_, err := blobURL.Create(ctx, headers, azblob.Metadata{}, ac, nil, s.cpk, azblob.ImmutabilityPolicyOptions{})
+	if isAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// Supported values for auth_mode.
+const (
+	AuthModeSharedKey = "shared_key"
+	AuthModeSAS       = "sas"
+	AuthModeDefault   = "default"
+	AuthModeWorkload  = "workload_identity"
+	AuthModeCert      = "client_certificate"
+	AuthModeSecret    = "client_secret"
+	AuthModeManaged   = "managed_identity"
+)
+
+const storageScope = "https://storage.azure.com/.default"
+
+// authMode returns the configured auth mode, inferring it from the
+// configured credentials when it was left empty.
+func (s *Storage) authMode() string {
+	if s.AuthMode != "" {
+		return s.AuthMode
+	}
+	if s.SASURL != "" || s.SASToken != "" || s.SASTokenFile != "" {
+		return AuthModeSAS
+	}
+	return AuthModeSharedKey
+}
+
+// newAzureADCredential returns the azidentity credential for token based
+// auth modes.
+func (s *Storage) newAzureADCredential(mode string) (azcore.TokenCredential, error) {
+	switch mode {
+	case AuthModeDefault:
+		return azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+			ClientOptions: s.clientOptions(),
+		})
+	case AuthModeWorkload:
+		// Empty values fall back to AZURE_TENANT_ID, AZURE_CLIENT_ID and
+		// AZURE_FEDERATED_TOKEN_FILE as injected by the AKS webhook.
+		return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			ClientOptions: s.clientOptions(),
+			TenantID:      s.TenantID,
+			ClientID:      s.ClientID,
+			TokenFilePath: s.FederatedTokenFile,
+		})
+	case AuthModeCert:
+		return s.newClientCertificateCredential()
+	case AuthModeSecret:
+		return s.newClientSecretCredential()
+	case AuthModeManaged:
+		// Without a client ID, the system assigned identity is used.
+		opts := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: s.clientOptions()}
+		if s.ClientID != "" {
+			opts.ID = azidentity.ClientID(s.ClientID)
+		}
+		return azidentity.NewManagedIdentityCredential(opts)
+	}
+	return nil, fmt.Errorf("unsupported auth_mode %q", mode)
+}
+
+func (s *Storage) newClientCertificateCredential() (azcore.TokenCredential, error) {
+	data := []byte(s.Certificate)
+	if s.CertificatePath != "" {
+		var err error
+		data, err = os.ReadFile(s.CertificatePath)
+		if err != nil {
+			return nil, fmt.Errorf("reading certificate_path: %v", err)
+		}
+	}
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("auth_mode %s requires certificate or certificate_path", AuthModeCert)
+	}
+
+	password := []byte(s.CertificatePassword)
+	if s.CertificatePasswordFile != "" {
+		file, err := os.ReadFile(s.CertificatePasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading certificate_password_file: %v", err)
+		}
+		password = bytes.TrimRight(file, "\r\n")
+	}
+
+	certs, key, err := azidentity.ParseCertificates(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("parsing client certificate: %v", err)
+	}
+
+	return azidentity.NewClientCertificateCredential(s.TenantID, s.ClientID, certs, key, &azidentity.ClientCertificateCredentialOptions{
+		ClientOptions: s.clientOptions(),
+	})
+}
+
+func (s *Storage) newClientSecretCredential() (azcore.TokenCredential, error) {
+	secret := s.ClientSecret
+	if s.ClientSecretFile != "" {
+		file, err := os.ReadFile(s.ClientSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client_secret_file: %v", err)
+		}
+		secret = string(bytes.TrimRight(file, "\r\n"))
+	}
+
+	return azidentity.NewClientSecretCredential(s.TenantID, s.ClientID, secret, &azidentity.ClientSecretCredentialOptions{
+		ClientOptions: s.clientOptions(),
+	})
+}
+
+// newTokenCredential adapts an azidentity credential to the token credential
+// used by the azblob pipeline, refreshing the token before it expires until
+// ctx is done.
+func (s *Storage) newTokenCredential(ctx context.Context, cred azcore.TokenCredential) (azblob.TokenCredential, error) {
+	opts := policy.TokenRequestOptions{Scopes: []string{storageScope}}
+
+	token, err := cred.GetToken(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("acquiring storage token: %v", err)
+	}
+
+	refresh := func(tc azblob.TokenCredential) time.Duration {
+		// A zero interval stops the refresher of a released client.
+		if ctx.Err() != nil {
+			return 0
+		}
+		token, err := cred.GetToken(ctx, opts)
+		if ctx.Err() != nil {
+			return 0
+		}
+		if err != nil {
+			s.logger.Error("Token Refresh Error", s.errField(err))
+			return 30 * time.Second
+		}
+
+		tc.SetToken(token.Token)
+		return refreshInterval(token.ExpiresOn)
+	}
+
+	tc := azblob.NewTokenCredential(token.Token, refresh)
+	return tc, nil
+}
+
+// refreshInterval renews tokens a few minutes ahead of their expiry.
+func refreshInterval(expiresOn time.Time) time.Duration {
+	d := time.Until(expiresOn) - 5*time.Minute
+	if d < 30*time.Second {
+		return 30 * time.Second
+	}
+	return d
+}
@@ -1,93 +1,713 @@
 package certmagic_azblob
 
 import (
-	"bytes"
-	"context"
+	"encoding/json"
 	"fmt"
-	"io/fs"
-	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/certmagic"
-	"github.com/google/uuid"
-	"go.uber.org/zap"
 )
 
+// CaddyAzblob is the caddy.storage.azblob module, a thin wrapper that
+// configures a Storage from the Caddy config.
 type CaddyAzblob struct {
-	logger        *zap.Logger
-	AccountName   string `json:"account_name"`
-	AccountKey    string `json:"account_key"`
-	ContainerName string `json:"container_name"`
-	UUID          string
-	ContainerURL  azblob.ContainerURL
+	Options
+
+	// ReplicaRaw is the storage module Store and Delete are mirrored to,
+	// MigrateFromRaw the one keys are migrated from on first load.
+	ReplicaRaw     json.RawMessage `json:"replica,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	MigrateFromRaw json.RawMessage `json:"migrate_from,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+
+	// HooksRaw are the hook modules called around Store and Delete.
+	HooksRaw []json.RawMessage `json:"hooks,omitempty" caddy:"namespace=caddy.storage.azblob.hooks inline_key=hook"`
+
+	storage *Storage
 }
 
 func init() {
 	caddy.RegisterModule(CaddyAzblob{})
 }
 
+// UnmarshalCaddyfile sets up the storage from Caddyfile tokens:
+//
+//	storage azblob {
+//		account_name <name>
+//		auth <type> {
+//			...
+//		}
+//		...
+//	}
+//
+// Unknown directives and extra arguments are rejected.
 func (blob *CaddyAzblob) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
-		var value string
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if err := blob.unmarshalBlock(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalBlock parses the directives of the block that follows the
+// current token, the storage block itself or a failover or tenant block.
+func (blob *CaddyAzblob) unmarshalBlock(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if err := blob.unmarshalDirective(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalDirective parses the directive at the current token.
+func (blob *CaddyAzblob) unmarshalDirective(d *caddyfile.Dispenser) error {
+	var value string
+
+	key := d.Val()
+
+	if key == "auth" {
+		return blob.unmarshalAuth(d)
+	}
+
+	if key == "failover" {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
 
-		key := d.Val()
+		var failover CaddyAzblob
+		if err := failover.unmarshalBlock(d); err != nil {
+			return err
+		}
+		blob.Failover = &failover.Options
+		return nil
+	}
+
+	if key == "tenant" {
+		// Arguments with a slash are key prefixes, the others domains.
+		var t Tenant
+		for d.NextArg() {
+			if strings.Contains(d.Val(), "/") {
+				t.Prefixes = append(t.Prefixes, d.Val())
+			} else {
+				t.Domains = append(t.Domains, d.Val())
+			}
+		}
+		if len(t.Domains) == 0 && len(t.Prefixes) == 0 {
+			return d.ArgErr()
+		}
+
+		var tenant CaddyAzblob
+		if err := tenant.unmarshalBlock(d); err != nil {
+			return err
+		}
+		t.Options = tenant.Options
+		blob.Tenants = append(blob.Tenants, t)
+		return nil
+	}
+
+	if key == "replica" || key == "migrate_from" {
+		raw, err := unmarshalStorageModule(d)
+		if err != nil {
+			return err
+		}
+		if key == "replica" {
+			blob.ReplicaRaw = raw
+		} else {
+			blob.MigrateFromRaw = raw
+		}
+		return nil
+	}
+
+	if key == "hook" {
+		raw, err := unmarshalHookModule(d)
+		if err != nil {
+			return err
+		}
+		blob.HooksRaw = append(blob.HooksRaw, raw)
+		return nil
+	}
+
+	if key == "emulator" || key == "use_development_storage" {
+		// Given without a value, the flag turns it on.
+		emulator := true
+		if d.Args(&value) {
+			var err error
+			if emulator, err = strconv.ParseBool(value); err != nil {
+				return d.Errf("parsing %s: %v", key, err)
+			}
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		blob.Emulator = emulator
+		return nil
+	}
 
-		if !d.Args(&value) {
-			continue
+	if !d.Args(&value) {
+		if !isDirective(key) {
+			return d.Errf("unrecognized azblob directive '%s'%s", key, suggestDirective(key, directiveNames()))
 		}
+		return d.ArgErr()
+	}
 
+	switch key {
+	case "account_name":
+		blob.AccountName = value
+	case "account_key":
+		blob.AccountKey = value
+	case "container_name", "share_name":
+		blob.ContainerName = value
+	case "certificates_container":
+		blob.CertificatesContainer = value
+	case "accounts_container":
+		blob.AccountsContainer = value
+	case "ocsp_container":
+		blob.OCSPContainer = value
+	case "locks_container":
+		blob.LocksContainer = value
+	case "lock_cleanup":
+		cleanup, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing lock_cleanup: %v", err)
+		}
+		blob.LockCleanup = cleanup
+	case "instance_file":
+		blob.InstanceFile = value
+	case "locks_prefix":
+		blob.LocksPrefix = value
+	case "sas_token":
+		blob.SASToken = value
+	case "sas_url":
+		blob.SASURL = value
+	case "container_sas_url":
+		blob.ContainerSASURL = value
+	case "connection_string":
+		blob.ConnectionString = value
+	case "auth_mode":
+		if alias, ok := authModeAliases[value]; ok {
+			value = alias
+		}
+		blob.AuthMode = value
+	case "endpoint":
+		blob.Endpoint = value
+	case "blob_host":
+		blob.BlobHost = value
+	case "tls_server_name":
+		blob.TLSServerName = value
+	case "create_container":
+		create, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing create_container: %v", err)
+		}
+		blob.CreateContainer = create
+	case "access_tier":
+		blob.AccessTier = value
+	case "tier":
+		rule := TierRule{Prefix: value}
+		if !d.Args(&rule.Tier) {
+			return d.ArgErr()
+		}
+		if d.NextArg() {
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing tier after: %v", err)
+			}
+			rule.After = caddy.Duration(dur)
+		}
+		blob.TierRules = append(blob.TierRules, rule)
+	case "tier_sweep_interval":
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing tier_sweep_interval: %v", err)
+		}
+		blob.TierSweepInterval = caddy.Duration(dur)
+	case "rehydrate_priority":
+		blob.RehydratePriority = value
+	case "metadata":
+		var v string
+		if !d.Args(&v) {
+			return d.ArgErr()
+		}
+		if blob.Metadata == nil {
+			blob.Metadata = make(map[string]string)
+		}
+		blob.Metadata[value] = v
+	case "encryption_key":
+		blob.EncryptionKey = value
+	case "encryption_key_sha256":
+		blob.EncryptionKeySHA256 = value
+	case "encryption_scope":
+		blob.EncryptionScope = value
+	case "client_encryption_key":
+		blob.ClientEncryptionKey = value
+	case "client_encryption_key_id":
+		blob.ClientEncryptionKeyID = value
+	case "client_encryption_key_vault_uri":
+		blob.ClientEncryptionKeyVaultURI = value
+	case "client_encryption_key_secret_name":
+		blob.ClientEncryptionKeySecretName = value
+	case "client_encryption_previous_key":
+		blob.ClientEncryptionPreviousKeys = append(blob.ClientEncryptionPreviousKeys, value)
+	case "prefix":
+		blob.Prefix = value
+	case "endpoint_suffix":
+		blob.EndpointSuffix = value
+	case "api_version":
+		blob.APIVersion = value
+	case "insecure_allow_http":
+		allow, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing insecure_allow_http: %v", err)
+		}
+		blob.InsecureAllowHTTP = allow
+	case "tenant_id":
+		blob.TenantID = value
+	case "client_id":
+		blob.ClientID = value
+	case "federated_token_file":
+		blob.FederatedTokenFile = value
+	case "certificate":
+		blob.Certificate = value
+	case "certificate_path":
+		blob.CertificatePath = value
+	case "certificate_password":
+		blob.CertificatePassword = value
+	case "account_key_vault_uri":
+		blob.AccountKeyVaultURI = value
+	case "account_key_secret_name":
+		blob.AccountKeySecretName = value
+	case "account_key_file":
+		blob.AccountKeyFile = value
+	case "certificate_password_file":
+		blob.CertificatePasswordFile = value
+	case "client_secret":
+		blob.ClientSecret = value
+	case "client_secret_file":
+		blob.ClientSecretFile = value
+	case "sas_token_file":
+		blob.SASTokenFile = value
+	case "account_key_refresh":
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing account_key_refresh: %v", err)
+		}
+		blob.AccountKeyRefresh = caddy.Duration(dur)
+	case "max_retries":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return d.Errf("parsing max_retries: %v", err)
+		}
+		blob.MaxRetries = n
+	case "download_retries":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return d.Errf("parsing download_retries: %v", err)
+		}
+		blob.DownloadRetries = n
+	case "download_early_close_error":
+		early, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing download_early_close_error: %v", err)
+		}
+		blob.DownloadEarlyCloseError = early
+	case "retry_delay":
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing retry_delay: %v", err)
+		}
+		blob.RetryDelay = caddy.Duration(dur)
+	case "max_retry_delay":
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing max_retry_delay: %v", err)
+		}
+		blob.MaxRetryDelay = caddy.Duration(dur)
+	case "try_timeout":
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing try_timeout: %v", err)
+		}
+		blob.TryTimeout = caddy.Duration(dur)
+	case "block_size":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return d.Errf("parsing block_size: %v", err)
+		}
+		blob.BlockSize = n
+	case "parallelism":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return d.Errf("parsing parallelism: %v", err)
+		}
+		blob.Parallelism = n
+	case "max_value_size":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return d.Errf("parsing max_value_size: %v", err)
+		}
+		blob.MaxValueSize = n
+	case "proxy":
+		blob.Proxy = value
+	case "ca_cert_file":
+		blob.CACertFile = value
+	case "max_idle_conns", "max_idle_conns_per_host", "max_conns_per_host":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return d.Errf("parsing %s: %v", key, err)
+		}
 		switch key {
-		case "account_name":
-			blob.AccountName = value
-		case "account_key":
-			blob.AccountKey = value
-		case "container_name":
-			blob.ContainerName = value
+		case "max_idle_conns":
+			blob.MaxIdleConns = n
+		case "max_idle_conns_per_host":
+			blob.MaxIdleConnsPerHost = n
+		default:
+			blob.MaxConnsPerHost = n
+		}
+	case "idle_conn_timeout", "keep_alive":
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing %s: %v", key, err)
+		}
+		if key == "idle_conn_timeout" {
+			blob.IdleConnTimeout = caddy.Duration(dur)
+		} else {
+			blob.KeepAlive = caddy.Duration(dur)
+		}
+	case "disable_http2":
+		disable, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing disable_http2: %v", err)
+		}
+		blob.DisableHTTP2 = disable
+	case "tls_insecure_skip_verify":
+		skip, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing tls_insecure_skip_verify: %v", err)
+		}
+		blob.TLSInsecureSkipVerify = skip
+	case "store_timeout", "load_timeout", "list_timeout", "lock_request_timeout", "lock_timeout",
+		"lock_poll_interval", "lock_wait_timeout", "shutdown_timeout":
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing %s: %v", key, err)
+		}
+		blob.setTimeout(key, caddy.Duration(dur))
+	case "lock_lease_duration":
+		dur := time.Duration(infiniteLockLease)
+		if value != "infinite" {
+			var err error
+			if dur, err = caddy.ParseDuration(value); err != nil {
+				return d.Errf("parsing lock_lease_duration: %v", err)
+			}
+		}
+		blob.LockLeaseDuration = caddy.Duration(dur)
+	case "validate_connection":
+		validate, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing validate_connection: %v", err)
+		}
+		blob.ValidateConnection = validate
+	case "hns":
+		hns, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing hns: %v", err)
+		}
+		blob.HNS = hns
+	case "no_list":
+		noList, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing no_list: %v", err)
+		}
+		blob.NoList = noList
+	case "strict_writes":
+		strict, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing strict_writes: %v", err)
+		}
+		blob.StrictWrites = strict
+	case "content_type":
+		blob.ContentType = value
+	case "cache_control":
+		blob.CacheControl = value
+	case "compress":
+		compressed, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing compress: %v", err)
+		}
+		blob.Compress = compressed
+	case "index_tags":
+		tags, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing index_tags: %v", err)
+		}
+		blob.IndexTags = tags
+	case "lifecycle_tags":
+		tags, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing lifecycle_tags: %v", err)
+		}
+		blob.LifecycleTags = tags
+	case "undelete_on_load":
+		undelete, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing undelete_on_load: %v", err)
+		}
+		blob.UndeleteOnLoad = undelete
+	case "snapshot_on_write":
+		snapshot, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing snapshot_on_write: %v", err)
+		}
+		blob.SnapshotOnWrite = snapshot
+	case "immutability_period":
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing immutability_period: %v", err)
+		}
+		blob.ImmutabilityPeriod = caddy.Duration(dur)
+	case "immutability_mode":
+		blob.ImmutabilityMode = value
+	case "legal_hold":
+		hold, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing legal_hold: %v", err)
 		}
+		blob.LegalHold = hold
+	case "read_secondary":
+		secondary, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing read_secondary: %v", err)
+		}
+		blob.ReadSecondary = secondary
+	case "secondary_endpoint":
+		blob.SecondaryEndpoint = value
+	case "cache_ttl":
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing cache_ttl: %v", err)
+		}
+		blob.CacheTTL = caddy.Duration(dur)
+	case "cache_size":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return d.Errf("parsing cache_size: %v", err)
+		}
+		blob.CacheSize = n
+	case "list_cache_ttl":
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing list_cache_ttl: %v", err)
+		}
+		blob.ListCacheTTL = caddy.Duration(dur)
+	case "cache_dir":
+		blob.CacheDir = value
+	case "usage_report_interval":
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing usage_report_interval: %v", err)
+		}
+		blob.UsageReportInterval = caddy.Duration(dur)
+	case "gc_interval", "gc_retention":
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return d.Errf("parsing %s: %v", key, err)
+		}
+		if key == "gc_interval" {
+			blob.GCInterval = caddy.Duration(dur)
+		} else {
+			blob.GCRetention = caddy.Duration(dur)
+		}
+	case "gc_archive", "gc_dry_run":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing %s: %v", key, err)
+		}
+		if key == "gc_archive" {
+			blob.GCArchive = enabled
+		} else {
+			blob.GCDryRun = enabled
+		}
+	case "audit_log":
+		blob.AuditLog = value
+	case "notify_url":
+		blob.NotifyURL = value
+	case "notify_event_grid":
+		eventGrid, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing notify_event_grid: %v", err)
+		}
+		blob.NotifyEventGrid = eventGrid
+	case "notify_key":
+		blob.NotifyKey = value
+	case "health_check":
+		check, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing health_check: %v", err)
+		}
+		blob.HealthCheck = check
+	case "log_level":
+		blob.LogLevel = value
+	case "debug_http":
+		debug, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing debug_http: %v", err)
+		}
+		blob.DebugHTTP = debug
+	case "tracing":
+		tracing, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing tracing: %v", err)
+		}
+		blob.Tracing = tracing
+	case "throttle_retries":
+		retries, err := strconv.Atoi(value)
+		if err != nil {
+			return d.Errf("parsing throttle_retries: %v", err)
+		}
+		blob.ThrottleRetries = retries
+	case "user_agent":
+		blob.UserAgent = value
+	case "disable_telemetry":
+		disable, err := strconv.ParseBool(value)
+		if err != nil {
+			return d.Errf("parsing disable_telemetry: %v", err)
+		}
+		blob.DisableTelemetry = disable
+	default:
+		return d.Errf("unrecognized azblob directive '%s'%s", key, suggestDirective(key, directiveNames()))
 	}
 
+	if d.NextArg() {
+		return d.ArgErr()
+	}
 	return nil
 }
 
 func (blob *CaddyAzblob) Provision(ctx caddy.Context) error {
-	blob.logger = ctx.Logger(blob)
+	blob.Logger = ctx.Logger(blob)
+
+	blob.expandPlaceholders()
 
-	//Used for lock ownership, each caddy process must have its own uuid
-	blob.UUID = uuid.NewString()
+	blob.loadEnvironment()
+
+	if blob.ReplicaRaw != nil {
+		replica, err := loadStorageModule(ctx, blob, "ReplicaRaw")
+		if err != nil {
+			return fmt.Errorf("replica: %v", err)
+		}
+		blob.Replica = replica
+	}
+	if blob.MigrateFromRaw != nil {
+		old, err := loadStorageModule(ctx, blob, "MigrateFromRaw")
+		if err != nil {
+			return fmt.Errorf("migrate_from: %v", err)
+		}
+		blob.MigrateFrom = old
+	}
+	if blob.HooksRaw != nil {
+		mods, err := ctx.LoadModule(blob, "HooksRaw")
+		if err != nil {
+			return fmt.Errorf("hooks: %v", err)
+		}
+		for _, mod := range mods.([]interface{}) {
+			hook, ok := mod.(Hook)
+			if !ok {
+				return fmt.Errorf("hooks: module %T is not a Hook", mod)
+			}
+			blob.Hooks = append(blob.Hooks, hook)
+		}
+	}
 
-	// Load Environment
-	if blob.AccountName == "" {
-		blob.AccountName = os.Getenv("AZBLOB_ACCOUNT_NAME")
+	storage, err := New(blob.Options)
+	if err != nil {
+		return err
 	}
 
-	if blob.AccountKey == "" {
-		blob.AccountKey = os.Getenv("AZBLOB_ACCOUNT_KEY")
+	if blob.HealthCheck {
+		if err := storage.CheckHealth(ctx); err != nil {
+			storage.Close()
+			return err
+		}
+	}
+	if blob.LockCleanup {
+		if _, err := storage.CleanupLocks(ctx); err != nil {
+			storage.logger.Warn("Lock Cleanup Error", storage.errField(err))
+		}
 	}
 
-	if blob.ContainerName == "" {
-		blob.ContainerName = os.Getenv("AZBLOB_ACCOUNT_CONTAINER_NAME")
+	registerStorage(storage)
+	blob.storage = storage
+	return nil
+}
+
+// Cleanup shuts the storage down gracefully when its config is unloaded.
+func (blob *CaddyAzblob) Cleanup() error {
+	if blob.storage == nil {
+		return nil
 	}
+	unregisterStorage(blob.storage)
+	return blob.storage.Close()
+}
 
-	creds, err := azblob.NewSharedKeyCredential(blob.AccountName, blob.AccountKey)
+// unmarshalStorageModule parses the storage module named by the next
+// argument of d, e.g. "replica file_system /srv/standby", into its JSON.
+func unmarshalStorageModule(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, "caddy.storage."+name)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	if _, ok := unm.(caddy.StorageConverter); !ok {
+		return nil, d.Errf("module %s is not a caddy.StorageConverter", name)
+	}
+	return caddyconfig.JSONModuleObject(unm, "module", name, nil), nil
+}
 
-	p := azblob.NewPipeline(creds, azblob.PipelineOptions{})
-	u, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", blob.AccountName))
+// unmarshalHookModule parses the hook module named by the next argument of
+// d, e.g. "hook protect certificates/", into its JSON.
+func unmarshalHookModule(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, "caddy.storage.azblob.hooks."+name)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if _, ok := unm.(Hook); !ok {
+		return nil, d.Errf("module %s is not a Hook", name)
+	}
+	return caddyconfig.JSONModuleObject(unm, "hook", name, nil), nil
+}
 
-	serviceURL := azblob.NewServiceURL(*u, p)
-	containerURL := serviceURL.NewContainerURL(blob.ContainerName)
+// loadStorageModule provisions the storage module in the given field.
+func loadStorageModule(ctx caddy.Context, blob *CaddyAzblob, field string) (certmagic.Storage, error) {
+	mod, err := ctx.LoadModule(blob, field)
+	if err != nil {
+		return nil, err
+	}
+	return mod.(caddy.StorageConverter).CertMagicStorage()
+}
 
-	blob.ContainerURL = containerURL
-	return nil
+// Validate checks, if enabled, that the container is reachable with the
+// configured credentials.
+func (blob *CaddyAzblob) Validate() error {
+	if !blob.ValidateConnection {
+		return nil
+	}
+	return blob.storage.checkConnection(blob.storage.ctx)
 }
 
 func (CaddyAzblob) CaddyModule() caddy.ModuleInfo {
@@ -100,130 +720,159 @@ func (CaddyAzblob) CaddyModule() caddy.ModuleInfo {
 }
 
 func (blob CaddyAzblob) CertMagicStorage() (certmagic.Storage, error) {
-	return blob, nil
+	return blob.storage, nil
 }
 
-func (blob CaddyAzblob) Lock(ctx context.Context, key string) error {
-	blob.logger.Info("Lock", zap.String("key", key))
-	_, err := blob.ContainerURL.AcquireLease(context.TODO(), blob.UUID, 60, azblob.ModifiedAccessConditions{})
-	if err != nil {
-		blob.logger.Error("Lock Error", zap.String("err", err.Error()))
+// expandPlaceholders resolves global placeholders such as
+// {env.AZBLOB_ACCOUNT_KEY} in credentials and connection settings.
+func (o *Options) expandPlaceholders() {
+	repl := caddy.NewReplacer()
+	for _, field := range []*string{
+		&o.AccountName,
+		&o.AccountKey,
+		&o.ContainerName,
+		&o.CertificatesContainer,
+		&o.AccountsContainer,
+		&o.OCSPContainer,
+		&o.LocksContainer,
+		&o.SASToken,
+		&o.SASURL,
+		&o.ContainerSASURL,
+		&o.ConnectionString,
+		&o.AuthMode,
+		&o.Endpoint,
+		&o.BlobHost,
+		&o.EndpointSuffix,
+		&o.APIVersion,
+		&o.SecondaryEndpoint,
+		&o.Prefix,
+		&o.LocksPrefix,
+		&o.NotifyURL,
+		&o.NotifyKey,
+		&o.TenantID,
+		&o.ClientID,
+		&o.FederatedTokenFile,
+		&o.Certificate,
+		&o.CertificatePath,
+		&o.CertificatePassword,
+		&o.AccountKeyVaultURI,
+		&o.AccountKeySecretName,
+		&o.AccountKeyFile,
+		&o.SASTokenFile,
+		&o.CertificatePasswordFile,
+		&o.ClientSecret,
+		&o.ClientSecretFile,
+		&o.EncryptionKey,
+		&o.EncryptionKeySHA256,
+		&o.EncryptionScope,
+		&o.ClientEncryptionKey,
+		&o.ClientEncryptionKeyVaultURI,
+		&o.ClientEncryptionKeySecretName,
+		&o.Proxy,
+		&o.CACertFile,
+		&o.CacheDir,
+		&o.InstanceFile,
+		&o.UserAgent,
+	} {
+		*field = repl.ReplaceAll(*field, "")
 	}
-	return err
-}
-
-func (blob CaddyAzblob) Unlock(ctx context.Context, key string) error {
-	blob.logger.Info("Unlock", zap.String("key", key))
-	_, err := blob.ContainerURL.ReleaseLease(ctx, blob.UUID, azblob.ModifiedAccessConditions{})
-	if err != nil {
-		blob.logger.Error("Unlock Error", zap.String("err", err.Error()))
+	for name, value := range o.Metadata {
+		o.Metadata[name] = repl.ReplaceAll(value, "")
+	}
+	for i, key := range o.ClientEncryptionPreviousKeys {
+		o.ClientEncryptionPreviousKeys[i] = repl.ReplaceAll(key, "")
+	}
+	if o.Failover != nil {
+		o.Failover.expandPlaceholders()
+	}
+	for i := range o.Tenants {
+		o.Tenants[i].expandPlaceholders()
 	}
-	return err
 }
 
-func (blob CaddyAzblob) Store(ctx context.Context, key string, value []byte) error {
-	blobURL := blob.ContainerURL.NewBlockBlobURL(key)
-	_, err := blobURL.Upload(ctx, bytes.NewReader(value), azblob.BlobHTTPHeaders{ContentType: "text/plain"}, azblob.Metadata{}, azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{}, azblob.ImmutabilityPolicyOptions{})
-	if err != nil {
-		blob.logger.Error("Store Error", zap.String("err", err.Error()))
+// loadEnvironment fills the settings left empty from the AZBLOB_*
+// environment variables.
+func (o *Options) loadEnvironment() {
+	if o.AccountName == "" {
+		o.AccountName = os.Getenv("AZBLOB_ACCOUNT_NAME")
 	}
-	return err
-}
 
-func (blob CaddyAzblob) Load(ctx context.Context, key string) ([]byte, error) {
-	blobURL := blob.ContainerURL.NewBlockBlobURL(key)
-	get, err := blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
-	if !DoesBlobExists(err) {
-		blob.logger.Error("Load Error", zap.String("err", err.Error()))
-		return nil, fs.ErrNotExist
+	if o.AccountKey == "" {
+		o.AccountKey = os.Getenv("AZBLOB_ACCOUNT_KEY")
 	}
 
-	if err != nil {
-		blob.logger.Error("Load Error", zap.String("err", err.Error()))
-		return nil, fs.ErrNotExist
+	if o.ContainerName == "" {
+		o.ContainerName = os.Getenv("AZBLOB_ACCOUNT_CONTAINER_NAME")
 	}
-	downloadedData := &bytes.Buffer{}
-	reader := get.Body(azblob.RetryReaderOptions{})
-	_, err = downloadedData.ReadFrom(reader)
-	if err != nil {
-		blob.logger.Error("Load Error", zap.String("err", err.Error()))
-		return nil, err
+
+	if o.SASToken == "" {
+		o.SASToken = os.Getenv("AZBLOB_SAS_TOKEN")
 	}
-	return downloadedData.Bytes(), err
-}
 
-func (blob CaddyAzblob) Delete(ctx context.Context, key string) error {
-	blobURL := blob.ContainerURL.NewBlockBlobURL(key)
-	_, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
-	if err != nil {
-		blob.logger.Error("Delete Error", zap.String("err", err.Error()))
+	if o.SASURL == "" {
+		o.SASURL = os.Getenv("AZBLOB_SAS_URL")
 	}
 
-	return err
-}
+	if o.ContainerSASURL == "" {
+		o.ContainerSASURL = os.Getenv("AZBLOB_CONTAINER_SAS_URL")
+	}
 
-func (blob CaddyAzblob) Exists(ctx context.Context, key string) bool {
-	items, err := blob.List(ctx, key, true)
-	if err != nil {
-		blob.logger.Error("Exists", zap.String("err", err.Error()))
-		return false
+	if o.AuthMode == "" {
+		o.AuthMode = os.Getenv("AZBLOB_AUTH_MODE")
 	}
 
-	for _, v := range items {
-		if strings.Contains(v, key) {
-			blob.logger.Error("Exists", zap.Bool("exists", true), zap.String("key", key))
-			return true
-		}
+	if o.Endpoint == "" {
+		o.Endpoint = os.Getenv("AZBLOB_ENDPOINT")
 	}
 
-	return false
-}
+	if o.EndpointSuffix == "" {
+		o.EndpointSuffix = os.Getenv("AZBLOB_ENDPOINT_SUFFIX")
+	}
 
-func (blob CaddyAzblob) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
-	blob.logger.Info("List", zap.String("prefix", prefix))
-	ls, err := blob.ContainerURL.ListBlobsFlatSegment(context.TODO(), azblob.Marker{}, azblob.ListBlobsSegmentOptions{})
-	if err != nil {
-		blob.logger.Error("List Error", zap.String("err", err.Error()))
-		return nil, err
+	if o.APIVersion == "" {
+		o.APIVersion = os.Getenv("AZBLOB_API_VERSION")
 	}
 
-	keys := make([]string, 0)
-	for _, v := range ls.Segment.BlobItems {
-		keys = append(keys, v.Name)
+	if o.Prefix == "" {
+		o.Prefix = os.Getenv("AZBLOB_PREFIX")
 	}
 
-	blob.logger.Error("List Keys", zap.String("list", strings.Join(keys, ",")))
-	return keys, nil
-}
+	if o.EncryptionKey == "" {
+		o.EncryptionKey = os.Getenv("AZBLOB_ENCRYPTION_KEY")
+	}
 
-func (blob CaddyAzblob) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
-	blob.logger.Info("Stat", zap.String("key", key))
-	blobURL := blob.ContainerURL.NewBlockBlobURL(key)
-	resp, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
-	if err != nil && !DoesBlobExists(err) {
-		blob.logger.Error("Stat", zap.String("err", err.Error()))
-		return certmagic.KeyInfo{}, err
+	if o.ConnectionString == "" {
+		o.ConnectionString = os.Getenv("AZBLOB_CONNECTION_STRING")
 	}
 
-	data, err := blob.Load(ctx, key)
-	if err != nil {
-		blob.logger.Error("Stat 2", zap.String("err", err.Error()))
-		return certmagic.KeyInfo{}, err
+	if o.ClientEncryptionKey == "" {
+		o.ClientEncryptionKey = os.Getenv("AZBLOB_CLIENT_ENCRYPTION_KEY")
 	}
 
-	return certmagic.KeyInfo{
-		Key:        key,
-		Modified:   resp.LastModified(),
-		Size:       int64(len(data)), //TODO: Not sure how to get size from azblob.BlobGetPropertiesResponse
-		IsTerminal: true,
-	}, err
+	if !o.Emulator {
+		o.Emulator, _ = strconv.ParseBool(os.Getenv("AZBLOB_USE_DEVELOPMENT_STORAGE"))
+	}
 }
 
-func DoesBlobExists(err error) bool {
-	if err == nil {
-		return true
+func (blob *CaddyAzblob) setTimeout(name string, d caddy.Duration) {
+	switch name {
+	case "store_timeout":
+		blob.StoreTimeout = d
+	case "load_timeout":
+		blob.LoadTimeout = d
+	case "list_timeout":
+		blob.ListTimeout = d
+	case "lock_request_timeout":
+		blob.LockRequestTimeout = d
+	case "lock_timeout":
+		blob.LockTimeout = d
+	case "lock_poll_interval":
+		blob.LockPollInterval = d
+	case "lock_wait_timeout":
+		blob.LockWaitTimeout = d
+	case "shutdown_timeout":
+		blob.ShutdownTimeout = d
 	}
-	return !strings.Contains(err.Error(), "404 The specified blob does not exist")
 }
 
 func (blob CaddyAzblob) String() string {
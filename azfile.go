@@ -0,0 +1,65 @@
+package certmagic_azblob
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+)
+
+// CaddyAzfile is the caddy.storage.azfile module, which configures a
+// FileStorage with the options of caddy.storage.azblob.
+type CaddyAzfile struct {
+	Options
+
+	storage *FileStorage
+}
+
+func init() {
+	caddy.RegisterModule(CaddyAzfile{})
+}
+
+// UnmarshalCaddyfile accepts the same directives as caddy.storage.azblob,
+// with share_name as an alias of container_name.
+func (f *CaddyAzfile) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	var blob CaddyAzblob
+	if err := blob.UnmarshalCaddyfile(d); err != nil {
+		return err
+	}
+	f.Options = blob.Options
+	return nil
+}
+
+func (f *CaddyAzfile) Provision(ctx caddy.Context) error {
+	f.Logger = ctx.Logger(f)
+
+	f.expandPlaceholders()
+	f.loadEnvironment()
+
+	storage, err := NewFileStorage(f.Options)
+	if err != nil {
+		return err
+	}
+	f.storage = storage
+	return nil
+}
+
+// Cleanup releases the held locks when the config is unloaded.
+func (f *CaddyAzfile) Cleanup() error {
+	if f.storage == nil {
+		return nil
+	}
+	return f.storage.Close()
+}
+
+func (CaddyAzfile) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.storage.azfile",
+		New: func() caddy.Module {
+			return new(CaddyAzfile)
+		},
+	}
+}
+
+func (f CaddyAzfile) CertMagicStorage() (certmagic.Storage, error) {
+	return f.storage, nil
+}
@@ -0,0 +1,202 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// benchOps are the operations a benchmark mix can weigh, in report order.
+var benchOps = []string{"store", "load", "list", "lock"}
+
+// benchLockKeys is the number of lock keys, few enough for workers to
+// contend on them.
+const benchLockKeys = 4
+
+// benchConfig is what a benchmark runs.
+type benchConfig struct {
+	duration    time.Duration
+	concurrency int
+	keys        int
+	size        int
+	mix         map[string]int
+}
+
+// parseBenchMix parses weights like "store=20,load=60,list=10,lock=10".
+func parseBenchMix(s string) (map[string]int, error) {
+	mix := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("mix entry %q is not <op>=<weight>", part)
+		}
+		op := fields[0]
+		w, err := strconv.Atoi(fields[1])
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("mix weight of %s must be a non-negative number", op)
+		}
+		known := false
+		for _, name := range benchOps {
+			known = known || name == op
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown mix operation %q, expected one of %s", op, strings.Join(benchOps, ", "))
+		}
+		mix[op] = w
+	}
+
+	var total int
+	for _, w := range mix {
+		total += w
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("mix has no operation with a weight")
+	}
+	return mix, nil
+}
+
+// benchStats are the latencies and errors of one operation.
+type benchStats struct {
+	latencies []time.Duration
+	errors    int
+	throttled int
+}
+
+// percentile returns the p-th percentile of the sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+// bench runs a mix of operations against s below a random directory for
+// the configured duration and prints their rate, error rate and latency
+// percentiles. The keys are removed afterwards. It returns the number of
+// failed operations.
+func bench(ctx context.Context, s *Storage, cfg benchConfig) (int, error) {
+	dir := "bench/" + uuid.NewString()
+	defer func() {
+		s.DeleteAll(context.Background(), dir+"/")
+		s.DeleteAll(context.Background(), path.Join("locks", dir)+"/")
+	}()
+
+	value := make([]byte, cfg.size)
+	if _, err := rand.Read(value); err != nil {
+		return 0, err
+	}
+	key := func(i int) string { return path.Join(dir, "keys", strconv.Itoa(i)) }
+
+	// Loads and lists need keys to find.
+	for i := 0; i < cfg.keys; i++ {
+		if err := s.Store(ctx, key(i), value); err != nil {
+			return 0, fmt.Errorf("preparing keys: %v", err)
+		}
+	}
+
+	var weighted []string
+	for _, op := range benchOps {
+		for i := 0; i < cfg.mix[op]; i++ {
+			weighted = append(weighted, op)
+		}
+	}
+	run := map[string]func(context.Context, *mathrand.Rand) error{
+		"store": func(ctx context.Context, r *mathrand.Rand) error {
+			return s.Store(ctx, key(r.Intn(cfg.keys)), value)
+		},
+		"load": func(ctx context.Context, r *mathrand.Rand) error {
+			_, err := s.Load(ctx, key(r.Intn(cfg.keys)))
+			return err
+		},
+		"list": func(ctx context.Context, r *mathrand.Rand) error {
+			_, err := s.List(ctx, path.Join(dir, "keys"), true)
+			return err
+		},
+		"lock": func(ctx context.Context, r *mathrand.Rand) error {
+			lockKey := path.Join(dir, "lock"+strconv.Itoa(r.Intn(benchLockKeys)))
+			if err := s.Lock(ctx, lockKey); err != nil {
+				return err
+			}
+			return s.Unlock(ctx, lockKey)
+		},
+	}
+
+	fmt.Printf("Running %s with %d workers against %s\n", cfg.duration, cfg.concurrency, s)
+	runCtx, cancel := context.WithTimeout(ctx, cfg.duration)
+	defer cancel()
+
+	var mu sync.Mutex
+	stats := make(map[string]*benchStats)
+	for _, op := range benchOps {
+		stats[op] = new(benchStats)
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := mathrand.New(mathrand.NewSource(seed))
+			for runCtx.Err() == nil {
+				op := weighted[r.Intn(len(weighted))]
+				opStart := time.Now()
+				err := run[op](runCtx, r)
+				took := time.Since(opStart)
+				if runCtx.Err() != nil {
+					// Cut short by the end of the run.
+					return
+				}
+
+				mu.Lock()
+				st := stats[op]
+				st.latencies = append(st.latencies, took)
+				if err != nil {
+					st.errors++
+					if errors.Is(err, ErrThrottled) {
+						st.throttled++
+					}
+				}
+				mu.Unlock()
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var failed int
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "op\tcount\tops/s\terrors\tthrottled\tp50\tp90\tp99\tmax\t")
+	for _, op := range benchOps {
+		st := stats[op]
+		if cfg.mix[op] == 0 {
+			continue
+		}
+		sort.Slice(st.latencies, func(i, j int) bool { return st.latencies[i] < st.latencies[j] })
+		count := len(st.latencies)
+		var errRate float64
+		if count > 0 {
+			errRate = float64(st.errors) / float64(count) * 100
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%d (%.1f%%)\t%d\t%s\t%s\t%s\t%s\t\n",
+			op, count, float64(count)/elapsed.Seconds(), st.errors, errRate, st.throttled,
+			percentile(st.latencies, 0.5).Round(time.Millisecond),
+			percentile(st.latencies, 0.9).Round(time.Millisecond),
+			percentile(st.latencies, 0.99).Round(time.Millisecond),
+			percentile(st.latencies, 1).Round(time.Millisecond))
+		failed += st.errors
+	}
+	return failed, w.Flush()
+}
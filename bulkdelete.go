@@ -0,0 +1,109 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+)
+
+// deleteConcurrency is how many blobs are deleted in parallel by DeleteAll
+// and directory deletes.
+const deleteConcurrency = 16
+
+// DeleteAll deletes every key starting with prefix in parallel, e.g. all
+// certificates of a decommissioned site, and returns how many were deleted.
+// Blobs protected by an immutability policy are skipped. An empty prefix is
+// rejected so the whole storage can't be wiped by accident.
+func (s *Storage) DeleteAll(ctx context.Context, prefix string) (int, error) {
+	if prefix == "" {
+		return 0, errors.New("DeleteAll requires a prefix")
+	}
+	if s.NoList {
+		return 0, ErrListUnsupported
+	}
+
+	// Each page is deleted before the next is listed, so deleting millions
+	// of keys doesn't hold them all in memory.
+	var deleted int
+	err := s.walkShards(ctx, prefix, false, func(keys []string) error {
+		n, err := s.deleteKeys(ctx, keys)
+		deleted += n
+		return err
+	})
+	if err != nil {
+		s.logger.Error("Delete Error", zap.String("prefix", prefix), s.errField(err))
+	}
+	s.logger.Info("Deleted keys", zap.String("prefix", prefix), zap.Int("count", deleted))
+	return deleted, err
+}
+
+// deleteKeys deletes keys in parallel, returning how many were deleted and
+// the first error. Keys that are already gone count as deleted.
+func (s *Storage) deleteKeys(ctx context.Context, keys []string) (int, error) {
+	var (
+		mu       sync.Mutex
+		deleted  int
+		firstErr error
+	)
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < deleteConcurrency && i < len(keys); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				err := s.deleteBlob(ctx, key)
+
+				mu.Lock()
+				if err == nil {
+					deleted++
+				} else if firstErr == nil && !isImmutable(err) {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		work <- key
+	}
+	close(work)
+	wg.Wait()
+
+	return deleted, firstErr
+}
+
+// deleteBlob deletes the blob of a single key and drops it from the caches.
+func (s *Storage) deleteBlob(ctx context.Context, key string) (err error) {
+	if s.AuditLog != "" {
+		defer func() { s.audit("delete", key, err) }()
+	}
+
+	blobURL := s.container(key).NewBlockBlobURL(s.blobName(key))
+	_, err = blobURL.Delete(ctx, s.deleteSnapshots(), azblob.BlobAccessConditions{})
+	if isImmutable(err) {
+		s.logger.Warn("Delete skipped, blob is immutable", zap.String("key", key))
+		return err
+	}
+	if err != nil && !isNotFound(err) {
+		s.logger.Error("Delete Error", zap.String("key", key), s.errField(err))
+		return err
+	}
+
+	s.setETag(key, azblob.ETagNone)
+	if s.cache != nil {
+		s.cache.invalidate(key)
+	}
+	if s.listCache != nil {
+		s.listCache.invalidate(key)
+	}
+	if s.diskCache != nil {
+		s.diskCache.remove(key)
+	}
+	return nil
+}
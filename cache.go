@@ -0,0 +1,221 @@
+package certmagic_azblob
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const defaultCacheSize = 1000
+
+// loadCache is an LRU cache of loaded values whose entries expire after a
+// TTL. Writes by other instances are not seen until then. Expired entries
+// with an ETag are kept to revalidate them with a conditional download.
+type loadCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	gen     uint64
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	value   []byte
+	etag    azblob.ETag
+	expires time.Time
+}
+
+func newLoadCache(ttl time.Duration, size int) *loadCache {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	return &loadCache{
+		ttl:     ttl,
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *loadCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		if entry.etag == azblob.ETagNone {
+			c.remove(el)
+		}
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return append([]byte(nil), entry.value...), true
+}
+
+// stale returns the value and ETag of an expired entry of key.
+func (c *loadCache) stale(key string) ([]byte, azblob.ETag, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, azblob.ETagNone, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if entry.etag == azblob.ETagNone || !time.Now().After(entry.expires) {
+		return nil, azblob.ETagNone, false
+	}
+	return append([]byte(nil), entry.value...), entry.etag, true
+}
+
+// generation changes with every invalidation. A loaded value is only
+// cached if nothing was invalidated since the load started, as it may
+// predate a concurrent store or delete.
+func (c *loadCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// put caches value for the TTL, along with the ETag of its blob if known,
+// unless the cache was invalidated since gen.
+func (c *loadCache) put(key string, value []byte, etag azblob.ETag, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	entry := &cacheEntry{
+		key:     key,
+		value:   append([]byte(nil), value...),
+		etag:    etag,
+		expires: time.Now().Add(c.ttl),
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate drops key and, since deleting a "directory" removes
+// everything below it, all keys under key + "/".
+func (c *loadCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	dir := strings.TrimSuffix(key, "/") + "/"
+	for k, el := range c.entries {
+		if strings.HasPrefix(k, dir) {
+			c.remove(el)
+		}
+	}
+}
+
+func (c *loadCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// maxListCacheEntries bounds the listings kept by listCache, which only
+// needs to cover the few prefixes certmagic's maintenance walks.
+const maxListCacheEntries = 64
+
+// listCache keeps List results for a short TTL. Every write or delete
+// through this instance drops the listings it may have changed, others are
+// not seen until the TTL expires.
+type listCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	gen     uint64
+	entries map[listCacheKey]listCacheEntry
+}
+
+type listCacheKey struct {
+	prefix    string
+	recursive bool
+}
+
+type listCacheEntry struct {
+	keys    []string
+	expires time.Time
+}
+
+func newListCache(ttl time.Duration) *listCache {
+	return &listCache{ttl: ttl, entries: make(map[listCacheKey]listCacheEntry)}
+}
+
+// generation changes with every invalidation. A listing is only cached if
+// nothing was invalidated since it started.
+func (c *listCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+func (c *listCache) get(prefix string, recursive bool) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := listCacheKey{prefix, recursive}
+	entry, ok := c.entries[k]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, k)
+		return nil, false
+	}
+	return append([]string(nil), entry.keys...), true
+}
+
+func (c *listCache) put(prefix string, recursive bool, keys []string, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	if len(c.entries) >= maxListCacheEntries {
+		c.entries = make(map[listCacheKey]listCacheEntry)
+	}
+	c.entries[listCacheKey{prefix, recursive}] = listCacheEntry{
+		keys:    append([]string(nil), keys...),
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+// invalidate drops the listings key appears in, and those below it since
+// deleting a "directory" removes everything below it.
+func (c *listCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	key = strings.Trim(key, "/")
+	for k := range c.entries {
+		prefix := strings.Trim(k.prefix, "/")
+		if prefix == "" || strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key) {
+			delete(c.entries, k)
+		}
+	}
+}
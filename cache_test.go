@@ -0,0 +1,63 @@
+package certmagic_azblob
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+func TestLoadCachePutAfterInvalidate(t *testing.T) {
+	c := newLoadCache(time.Minute, 0)
+
+	// A load that started before a store must not cache the old value
+	// after the store invalidated it.
+	gen := c.generation()
+	c.invalidate("key")
+	c.put("key", []byte("old"), "\"0x1\"", gen)
+	if value, ok := c.get("key"); ok {
+		t.Fatalf("value of a load older than the invalidation was cached: %q", value)
+	}
+
+	c.put("key", []byte("new"), "\"0x2\"", c.generation())
+	if value, ok := c.get("key"); !ok || string(value) != "new" {
+		t.Fatalf("get = %q, %v, expected the value loaded after the invalidation", value, ok)
+	}
+}
+
+func TestLoadCacheInvalidateDirectory(t *testing.T) {
+	c := newLoadCache(time.Minute, 0)
+	for _, key := range []string{"dir", "dir/a", "dir/sub/b", "dir-other/c"} {
+		c.put(key, []byte(key), azblob.ETagNone, c.generation())
+	}
+	c.invalidate("dir")
+	for key, cached := range map[string]bool{"dir": false, "dir/a": false, "dir/sub/b": false, "dir-other/c": true} {
+		if _, ok := c.get(key); ok != cached {
+			t.Errorf("%s cached: %v, expected %v", key, ok, cached)
+		}
+	}
+}
+
+func TestLoadCacheStale(t *testing.T) {
+	c := newLoadCache(time.Millisecond, 2)
+	c.put("tagged", []byte("tagged"), "\"0x1\"", c.generation())
+	c.put("untagged", []byte("untagged"), azblob.ETagNone, c.generation())
+	time.Sleep(5 * time.Millisecond)
+
+	// Expired entries with an ETag are kept for revalidation.
+	if _, ok := c.get("tagged"); ok {
+		t.Fatal("expired entry was returned")
+	}
+	if value, etag, ok := c.stale("tagged"); !ok || string(value) != "tagged" || etag != "\"0x1\"" {
+		t.Fatalf("stale = %q, %q, %v", value, etag, ok)
+	}
+	if _, _, ok := c.stale("untagged"); ok {
+		t.Fatal("expired entry without an ETag is kept")
+	}
+
+	// The least recently used entry is evicted beyond the size.
+	c.put("third", nil, azblob.ETagNone, c.generation())
+	if _, _, ok := c.stale("tagged"); ok {
+		t.Fatal("least recently used entry was not evicted")
+	}
+}
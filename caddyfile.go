@@ -0,0 +1,213 @@
+package certmagic_azblob
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// authDirectives are the directives of an auth block by the auth type that
+// uses them. Those of other types are rejected, as their credentials would
+// be ignored.
+var authDirectives = map[string][]string{
+	AuthModeSharedKey: {"account_key", "account_key_file", "account_key_vault_uri", "account_key_secret_name", "account_key_refresh", "connection_string"},
+	AuthModeSAS:       {"sas_token", "sas_token_file", "sas_url", "container_sas_url", "account_key_refresh", "connection_string"},
+	AuthModeDefault:   {},
+	AuthModeManaged:   {"client_id"},
+	AuthModeWorkload:  {"tenant_id", "client_id", "federated_token_file"},
+	AuthModeCert:      {"tenant_id", "client_id", "certificate", "certificate_path", "certificate_password", "certificate_password_file"},
+	AuthModeSecret:    {"tenant_id", "client_id", "client_secret", "client_secret_file"},
+}
+
+// authModeAliases are the other names the auth type may be given as.
+var authModeAliases = map[string]string{
+	"msi": AuthModeManaged,
+}
+
+// unmarshalAuth parses an auth block, which groups the credentials:
+//
+//	auth [<type>] {
+//		type <type>
+//		client_id <id>
+//		...
+//	}
+//
+// The type sets auth_mode and, when given, only its directives are
+// accepted. Without it, the mode is inferred as for the flat directives,
+// which keep working outside of the block.
+func (blob *CaddyAzblob) unmarshalAuth(d *caddyfile.Dispenser) error {
+	var mode string
+	typeTok := d.Token()
+	if d.NextArg() {
+		mode = d.Val()
+		typeTok = d.Token()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	var used []caddyfile.Token
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		if key == "type" {
+			if mode != "" {
+				return d.Errf("auth type given twice")
+			}
+			if !d.Args(&mode) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			typeTok = d.Token()
+			continue
+		}
+
+		if !isAuthDirective(key) {
+			return d.Errf("unrecognized auth directive '%s'%s", key, suggestDirective(key, append(authDirectiveNames(), "type")))
+		}
+		used = append(used, d.Token())
+		if err := blob.unmarshalDirective(d); err != nil {
+			return err
+		}
+	}
+
+	if mode == "" {
+		return nil
+	}
+	if alias, ok := authModeAliases[mode]; ok {
+		mode = alias
+	}
+	allowed, ok := authDirectives[mode]
+	if !ok {
+		return errAt(typeTok, "unsupported auth type '%s'%s, expected one of %s", mode,
+			suggestDirective(mode, authModes()), strings.Join(authModes(), ", "))
+	}
+	for _, tok := range used {
+		if !contains(allowed, tok.Text) {
+			return errAt(tok, "%s is not used by auth type %s", tok.Text, mode)
+		}
+	}
+	if blob.AuthMode != "" && blob.AuthMode != mode {
+		return errAt(typeTok, "auth type %s conflicts with auth_mode %s", mode, blob.AuthMode)
+	}
+	blob.AuthMode = mode
+	return nil
+}
+
+// authModes returns the auth types, sorted.
+func authModes() []string {
+	modes := make([]string, 0, len(authDirectives))
+	for mode := range authDirectives {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	return modes
+}
+
+func isAuthDirective(key string) bool {
+	return contains(authDirectiveNames(), key)
+}
+
+// authDirectiveNames returns the directives of every auth type.
+func authDirectiveNames() []string {
+	var names []string
+	for _, mode := range authModes() {
+		for _, name := range authDirectives[mode] {
+			if !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// caddyfileOnlyDirectives are the Caddyfile directives without a JSON
+// field of the same name, mostly singular forms of a list.
+var caddyfileOnlyDirectives = []string{
+	"auth", "tenant", "tier", "hook", "replica", "migrate_from",
+	"share_name", "use_development_storage", "client_encryption_previous_key",
+}
+
+// directiveNames returns the names of the Caddyfile directives, which are
+// those of the JSON fields of Options and caddyfileOnlyDirectives.
+func directiveNames() []string {
+	names := append([]string(nil), caddyfileOnlyDirectives...)
+	t := reflect.TypeOf(Options{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func isDirective(key string) bool {
+	return contains(directiveNames(), key)
+}
+
+// suggestDirective returns a hint naming the closest of names to a
+// misspelled key, or nothing if none is close.
+func suggestDirective(key string, names []string) string {
+	best, bestDistance := "", 3
+	for _, name := range names {
+		if d := editDistance(key, name); d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return ", did you mean '" + best + "'?"
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// errAt returns a parse error at the position of tok, for checks that can
+// only be made once the tokens after it were read.
+func errAt(tok caddyfile.Token, format string, args ...interface{}) error {
+	d := caddyfile.NewDispenser([]caddyfile.Token{tok})
+	d.Next()
+	return d.Errf(format, args...)
+}
@@ -0,0 +1,524 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "azblob",
+		Func:  cmdAzblob,
+		Usage: "import|export|list|cat|rewrap|selftest|copy|bench|lifecycle [--config <path> [--adapter <name>]] [--to <path>] [--overwrite] [--prefix <prefix>] [--concurrency <n>] [--duration <d>] [--mix <weights>] [<dir>|<key>]",
+		Short: "Inspects certmagic storage in Azure Blob Storage or copies it from and to a directory",
+		Long: `
+Works on the azblob storage configured in the given config file, or in the
+Caddyfile in the current directory. Without a config, the storage is
+configured from the AZBLOB_* environment variables.
+
+The import subcommand uploads every key of a certmagic file system storage,
+e.g. ~/.local/share/caddy, to the container. Keys that already exist in the
+container are skipped unless --overwrite is given. Locks are not imported.
+
+The export subcommand downloads every key, or only those below --prefix, to
+dir in the layout of certmagic's file system storage, e.g. for an offline
+backup. Files get the modification time of their blob, so an interrupted
+export can be resumed by running it again: files whose time matches are not
+downloaded again.
+
+The list subcommand prints every key, or only those below --prefix, with its
+size and modification time. The cat subcommand writes the value of a single
+key to stdout, decrypted and decompressed like certmagic reads it.
+
+The rewrap subcommand re-encrypts every key, or only those below --prefix,
+that isn't encrypted with the current client_encryption_key, e.g. after the
+key was rotated and the old one moved to client_encryption_previous_key.
+
+The selftest subcommand runs the certmagic storage contract (store, load,
+stat, list, lock contention, delete) against the container below a random
+selftest/ directory and removes it again. Combined with the emulator option
+it checks changes to the storage against Azurite before they meet Azure.
+
+The copy subcommand copies every key, or only those below --prefix, to the
+azblob storage configured in the config file given by --to, e.g. another
+account in a new region. Azure copies the blobs server-side, so values are
+not downloaded to this host, and every copy is checked against the size and
+MD5 hash of its source. Keys that already exist in the destination are
+skipped unless --overwrite is given. Locks are not copied.
+
+The bench subcommand runs a mix of stores, loads, lists and lock/unlock
+cycles with --concurrency workers for --duration against keys below a
+random bench/ directory, and reports the rate, errors, throttled requests
+and latency percentiles of each operation. --mix weighs the operations,
+e.g. store=20,load=60,list=10,lock=10. The keys are removed afterwards.
+
+The lifecycle subcommand prints a lifecycle management policy for the
+storage account that deletes expired certificates and OCSP staples written
+with lifecycle_tags, and abandoned locks, from the configured containers
+and prefixes, ready for az storage account management-policy create.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("azblob", flag.ExitOnError)
+			fs.String("config", "", "Configuration file with the azblob storage")
+			fs.String("adapter", "", "Name of config adapter to apply")
+			fs.String("to", "", "Configuration file with the azblob storage to copy to")
+			fs.String("to-adapter", "", "Name of config adapter to apply to the --to config")
+			fs.Bool("overwrite", false, "Overwrite keys that already exist in the container")
+			fs.String("prefix", "", "Only export, list, rewrap or copy keys below this prefix")
+			fs.Int("concurrency", 8, "Number of keys to export or copy, or bench workers, in parallel")
+			fs.Duration("duration", 30*time.Second, "How long bench runs")
+			fs.String("mix", "store=20,load=60,list=10,lock=10", "Weights of the bench operations")
+			fs.Int("keys", 100, "Number of keys bench stores and loads")
+			fs.Int("size", 4096, "Size of the values bench stores in bytes")
+			return fs
+		}(),
+	})
+}
+
+func cmdAzblob(fl caddycmd.Flags) (int, error) {
+	args := fl.Args()
+	if len(args) == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("missing subcommand, expected import, export, list, cat, rewrap, selftest, copy, bench or lifecycle")
+	}
+
+	// Flags may also follow the subcommand.
+	if err := fl.Parse(args[1:]); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	switch args[0] {
+	case "import":
+		if fl.NArg() != 1 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("usage: caddy azblob import <dir>")
+		}
+		return runWithStorage(fl, func(ctx context.Context, s *Storage) error {
+			return importDir(ctx, s, fl.Arg(0), fl.Bool("overwrite"))
+		})
+	case "export":
+		if fl.NArg() != 1 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("usage: caddy azblob export <dir>")
+		}
+		if fl.Int("concurrency") < 1 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("concurrency must be at least 1")
+		}
+		return runWithStorage(fl, func(ctx context.Context, s *Storage) error {
+			return exportDir(ctx, s, fl.Arg(0), fl.String("prefix"), fl.Int("concurrency"))
+		})
+	case "list":
+		if fl.NArg() != 0 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("usage: caddy azblob list [--prefix <prefix>]")
+		}
+		return runWithStorage(fl, func(ctx context.Context, s *Storage) error {
+			return listKeys(ctx, s, fl.String("prefix"))
+		})
+	case "cat":
+		if fl.NArg() != 1 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("usage: caddy azblob cat <key>")
+		}
+		return runWithStorage(fl, func(ctx context.Context, s *Storage) error {
+			value, err := s.Load(ctx, fl.Arg(0))
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(value)
+			return err
+		})
+	case "rewrap":
+		if fl.NArg() != 0 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("usage: caddy azblob rewrap [--prefix <prefix>]")
+		}
+		return runWithStorage(fl, func(ctx context.Context, s *Storage) error {
+			rewrapped, err := s.Rewrap(ctx, fl.String("prefix"))
+			fmt.Printf("Rewrapped %d keys\n", rewrapped)
+			return err
+		})
+	case "selftest":
+		return runWithStorage(fl, func(ctx context.Context, s *Storage) error {
+			if failed := selfTest(ctx, s); failed > 0 {
+				return fmt.Errorf("%d of %d checks failed", failed, len(selfTestChecks))
+			}
+			return nil
+		})
+	case "bench":
+		mix, err := parseBenchMix(fl.String("mix"))
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		cfg := benchConfig{
+			duration:    fl.Duration("duration"),
+			concurrency: fl.Int("concurrency"),
+			keys:        fl.Int("keys"),
+			size:        fl.Int("size"),
+			mix:         mix,
+		}
+		if cfg.duration <= 0 || cfg.concurrency < 1 || cfg.keys < 1 || cfg.size < 0 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("duration, concurrency and keys must be positive")
+		}
+		return runWithStorage(fl, func(ctx context.Context, s *Storage) error {
+			failed, err := bench(ctx, s, cfg)
+			if err == nil && failed > 0 {
+				err = fmt.Errorf("%d operations failed", failed)
+			}
+			return err
+		})
+	case "lifecycle":
+		return runWithStorage(fl, func(ctx context.Context, s *Storage) error {
+			policy, err := s.LifecyclePolicy()
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Printf("%s\n", policy)
+			return err
+		})
+	case "copy":
+		if fl.NArg() != 0 || fl.String("to") == "" {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("usage: caddy azblob copy --to <path> [--prefix <prefix>]")
+		}
+		if fl.Int("concurrency") < 1 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("concurrency must be at least 1")
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+
+		src, err := loadStorage(ctx, fl.String("config"), fl.String("adapter"))
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer src.Close()
+		dst, err := loadStorage(ctx, fl.String("to"), fl.String("to-adapter"))
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("--to: %v", err)
+		}
+		defer dst.Close()
+		if err := copyKeys(ctx, src, dst, fl.String("prefix"), fl.Bool("overwrite"), fl.Int("concurrency")); err != nil {
+			return caddy.ExitCodeFailedQuit, err
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+	return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown subcommand %q, expected import, export, list, cat, rewrap, selftest, copy, bench or lifecycle", args[0])
+}
+
+// runWithStorage provisions the azblob storage of the config given by the
+// flags and runs f with it.
+func runWithStorage(fl caddycmd.Flags, f func(context.Context, *Storage) error) (int, error) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	s, err := loadStorage(ctx, fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Close()
+
+	if err := f(ctx, s); err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// loadStorage provisions the azblob storage of the given config file, or
+// of the AZBLOB_* environment variables without one.
+func loadStorage(ctx caddy.Context, config, adapter string) (*Storage, error) {
+	blob := new(CaddyAzblob)
+
+	cfgJSON, _, err := caddycmd.LoadConfig(config, adapter)
+	if err != nil {
+		return nil, err
+	}
+	if cfgJSON != nil {
+		var cfg struct {
+			Storage json.RawMessage `json:"storage"`
+		}
+		if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+			return nil, fmt.Errorf("decoding config: %v", err)
+		}
+		if len(cfg.Storage) > 0 {
+			var module struct {
+				Module string `json:"module"`
+			}
+			if err := json.Unmarshal(cfg.Storage, &module); err != nil {
+				return nil, fmt.Errorf("decoding storage config: %v", err)
+			}
+			if module.Module != "azblob" {
+				return nil, fmt.Errorf("the config uses the %q storage, not azblob", module.Module)
+			}
+			if err := json.Unmarshal(cfg.Storage, blob); err != nil {
+				return nil, fmt.Errorf("decoding storage config: %v", err)
+			}
+		}
+	}
+
+	// The commands may run next to the server of the config, whose locks
+	// and instance file are its own.
+	blob.LockCleanup = false
+	blob.InstanceFile = ""
+	if err := blob.Provision(ctx); err != nil {
+		return nil, err
+	}
+	return blob.storage, nil
+}
+
+// importDir uploads the keys of the certmagic file system storage at dir.
+func importDir(ctx context.Context, s *Storage, dir string, overwrite bool) error {
+	var imported, skipped int
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == filepath.Join(dir, "locks") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if !overwrite && s.Exists(ctx, key) {
+			skipped++
+			return nil
+		}
+
+		value, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = s.Store(ctx, key, value)
+		if overwrite && errors.Is(err, fs.ErrExist) {
+			// Store only creates ACME accounts, replace them explicitly.
+			err = s.store(ctx, key, value, false)
+		}
+		if err != nil {
+			return fmt.Errorf("importing %s: %v", key, err)
+		}
+		imported++
+		return nil
+	})
+
+	fmt.Printf("Imported %d keys, skipped %d existing keys\n", imported, skipped)
+	return err
+}
+
+// listKeys prints the keys below prefix with their size and modification
+// time.
+func listKeys(ctx context.Context, s *Storage, prefix string) error {
+	// Keys are printed a page at a time as they are listed, each page
+	// sorted, rather than after listing them all.
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	err := s.walkKeys(ctx, prefix, func(keys []string) error {
+		sort.Strings(keys)
+		for _, key := range keys {
+			info, err := s.Stat(ctx, key)
+			if errors.Is(err, fs.ErrNotExist) {
+				// Deleted since it was listed.
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("stat %s: %v", key, err)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", info.Size, info.Modified.Local().Format(time.RFC3339), key)
+		}
+		return w.Flush()
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// exportDir downloads the keys below prefix to dir, skipping files that are
+// already up to date from a previous export.
+func exportDir(ctx context.Context, s *Storage, dir, prefix string, concurrency int) error {
+	var (
+		mu                        sync.Mutex
+		exported, current, failed int
+		firstErr                  error
+	)
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				written, err := exportKey(ctx, s, dir, key)
+
+				mu.Lock()
+				switch {
+				case err != nil:
+					fmt.Fprintf(os.Stderr, "exporting %s: %v\n", key, err)
+					failed++
+					if firstErr == nil {
+						firstErr = err
+					}
+				case written:
+					exported++
+				default:
+					current++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Keys are exported while the rest are still being listed.
+	err := s.walkKeys(ctx, prefix, func(keys []string) error {
+		for _, key := range keys {
+			// Locks and health check probes belong to running instances.
+			if strings.HasPrefix(key, "locks/") || strings.HasPrefix(key, "healthcheck/") {
+				continue
+			}
+			work <- key
+		}
+		return nil
+	})
+	close(work)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d keys, %d already up to date, %d failed\n", exported, current, failed)
+	if firstErr != nil {
+		return fmt.Errorf("%d keys failed to export, first error: %v", failed, firstErr)
+	}
+	return nil
+}
+
+// exportKey writes key below dir unless the file there already has the
+// modification time of the blob, reporting whether it was written.
+func exportKey(ctx context.Context, s *Storage, dir, key string) (bool, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	path := filepath.Join(dir, filepath.FromSlash(key))
+	if fi, err := os.Stat(path); err == nil && fi.ModTime().Equal(info.Modified) {
+		return false, nil
+	}
+
+	value, err := s.Load(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, err
+	}
+
+	// Write to a temporary file first so an interrupted export never leaves
+	// a truncated file that looks up to date.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, value, 0600); err != nil {
+		return false, err
+	}
+	if err := os.Chtimes(tmp, info.Modified, info.Modified); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// copyKeys copies the keys below prefix from src to dst server-side,
+// printing the progress while it goes.
+func copyKeys(ctx context.Context, src, dst *Storage, prefix string, overwrite bool, concurrency int) error {
+	if err := src.checkServerCopy(dst); err != nil {
+		return err
+	}
+
+	var (
+		mu                      sync.Mutex
+		listed                  int
+		copied, skipped, failed int
+		firstErr                error
+	)
+	progress := time.NewTicker(5 * time.Second)
+	defer progress.Stop()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-progress.C:
+			}
+			mu.Lock()
+			fmt.Fprintf(os.Stderr, "%d of %d keys listed so far done\n", copied+skipped+failed, listed)
+			mu.Unlock()
+		}
+	}()
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				written, err := src.copyKey(ctx, dst, key, overwrite)
+
+				mu.Lock()
+				switch {
+				case err != nil:
+					fmt.Fprintf(os.Stderr, "copying %s: %v\n", key, err)
+					failed++
+					if firstErr == nil {
+						firstErr = err
+					}
+				case written:
+					copied++
+				default:
+					skipped++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Keys are copied while the rest are still being listed.
+	err := src.walkKeys(ctx, prefix, func(keys []string) error {
+		for _, key := range keys {
+			if src.skipCopy(key) {
+				continue
+			}
+			mu.Lock()
+			listed++
+			mu.Unlock()
+			work <- key
+		}
+		return nil
+	})
+	close(work)
+	wg.Wait()
+	close(done)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Copied %d keys, skipped %d existing keys, %d failed\n", copied, skipped, failed)
+	if firstErr != nil {
+		return fmt.Errorf("%d keys failed to copy, first error: %v", failed, firstErr)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// contentEncodingGzip is the Content-Encoding of blobs written with
+// Compress. The value is compressed before it is client side encrypted.
+const contentEncodingGzip = "gzip"
+
+func compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress returns the value of a downloaded blob with the given
+// Content-Encoding. Blobs stored before compression was enabled have none
+// and are returned as-is. Values decompressing to more than limit bytes
+// fail with ErrTooLarge, 0 means no limit.
+func decompress(data []byte, encoding string, limit int64) ([]byte, error) {
+	switch encoding {
+	case "", "identity":
+		return data, nil
+	case contentEncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if limit <= 0 {
+			return io.ReadAll(r)
+		}
+		value, err := io.ReadAll(io.LimitReader(r, limit+1))
+		if err == nil && int64(len(value)) > limit {
+			return nil, fmt.Errorf("%w: more than %d bytes decompressed", ErrTooLarge, limit)
+		}
+		return value, err
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
@@ -0,0 +1,43 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDecompress(t *testing.T) {
+	value := bytes.Repeat([]byte("certificate "), 100)
+	compressed, err := compress(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		data     []byte
+		encoding string
+		limit    int64
+	}{
+		{value, "", 0},
+		{value, "identity", 10},
+		{compressed, contentEncodingGzip, 0},
+		{compressed, contentEncodingGzip, int64(len(value))},
+	} {
+		got, err := decompress(tt.data, tt.encoding, tt.limit)
+		if err != nil {
+			t.Errorf("decompress(%q, %d): %v", tt.encoding, tt.limit, err)
+		} else if !bytes.Equal(got, value) {
+			t.Errorf("decompress(%q, %d) returned %d bytes, want %d", tt.encoding, tt.limit, len(got), len(value))
+		}
+	}
+
+	if _, err := decompress(compressed, contentEncodingGzip, int64(len(value))-1); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("decompressing past the limit: expected ErrTooLarge, got %v", err)
+	}
+	if _, err := decompress(value, contentEncodingGzip, 0); err == nil {
+		t.Error("decompressing an uncompressed value succeeded")
+	}
+	if _, err := decompress(compressed, "br", 0); err == nil {
+		t.Error("decompressing an unsupported encoding succeeded")
+	}
+}
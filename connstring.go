@@ -0,0 +1,132 @@
+package certmagic_azblob
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Well known Azurite / storage emulator account.
+const (
+	devStoreAccountName = "devstoreaccount1"
+	devStoreAccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	devStoreEndpoint    = "http://127.0.0.1:10000"
+	devStoreBlobURL     = devStoreEndpoint + "/" + devStoreAccountName
+
+	// devStoreContainerName is used with the emulator unless a container
+	// is configured.
+	devStoreContainerName = "caddy"
+)
+
+type connectionString struct {
+	AccountName  string
+	AccountKey   string
+	SASToken     string
+	BlobEndpoint string
+	FileEndpoint string
+
+	DevelopmentStorage bool
+}
+
+// parseConnectionString parses the Azure Storage connection string format,
+// e.g. "DefaultEndpointsProtocol=https;AccountName=...;AccountKey=...;EndpointSuffix=core.windows.net".
+func parseConnectionString(s string) (connectionString, error) {
+	values := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return connectionString{}, fmt.Errorf("invalid connection string segment %q", part)
+		}
+		values[strings.ToLower(kv[0])] = kv[1]
+	}
+
+	if strings.EqualFold(values["usedevelopmentstorage"], "true") {
+		cs := connectionString{
+			AccountName:  devStoreAccountName,
+			AccountKey:   devStoreAccountKey,
+			BlobEndpoint: devStoreBlobURL,
+
+			DevelopmentStorage: true,
+		}
+		if proxy := values["developmentstorageproxyuri"]; proxy != "" {
+			cs.BlobEndpoint = strings.TrimSuffix(proxy, "/") + "/" + devStoreAccountName
+		}
+		return cs, nil
+	}
+
+	cs := connectionString{
+		AccountName:  values["accountname"],
+		AccountKey:   values["accountkey"],
+		SASToken:     values["sharedaccesssignature"],
+		BlobEndpoint: strings.TrimSuffix(values["blobendpoint"], "/"),
+		FileEndpoint: strings.TrimSuffix(values["fileendpoint"], "/"),
+	}
+
+	protocol := values["defaultendpointsprotocol"]
+	if protocol == "" {
+		protocol = "https"
+	}
+	suffix := values["endpointsuffix"]
+	if suffix == "" {
+		suffix = "core.windows.net"
+	}
+
+	if cs.BlobEndpoint == "" {
+		if cs.AccountName == "" {
+			return connectionString{}, fmt.Errorf("connection string must contain AccountName or BlobEndpoint")
+		}
+		cs.BlobEndpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, cs.AccountName, suffix)
+	}
+	if cs.FileEndpoint == "" && cs.AccountName != "" {
+		cs.FileEndpoint = fmt.Sprintf("%s://%s.file.%s", protocol, cs.AccountName, suffix)
+	}
+
+	return cs, nil
+}
+
+// containerSASURL is what a container SAS URL says about the account.
+type containerSASURL struct {
+	AccountName   string
+	ContainerName string
+	Endpoint      string
+	SASToken      string
+}
+
+// parseContainerSASURL splits a container SAS URL, e.g.
+// "https://account.blob.core.windows.net/container?sv=...&sig=...", into
+// its endpoint, container and token. Path style URLs of Azurite and IP
+// endpoints name the account in the first path segment instead.
+func parseContainerSASURL(raw string) (containerSASURL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return containerSASURL{}, fmt.Errorf("parsing container_sas_url: %v", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return containerSASURL{}, fmt.Errorf("container_sas_url must be an absolute URL")
+	}
+	if u.Query().Get("sig") == "" {
+		return containerSASURL{}, fmt.Errorf("container_sas_url has no SAS signature")
+	}
+
+	sas := containerSASURL{SASToken: u.RawQuery}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch len(segments) {
+	case 1:
+		sas.AccountName = strings.SplitN(u.Hostname(), ".", 2)[0]
+		sas.ContainerName = segments[0]
+		sas.Endpoint = u.Scheme + "://" + u.Host
+	case 2:
+		sas.AccountName = segments[0]
+		sas.ContainerName = segments[1]
+		sas.Endpoint = u.Scheme + "://" + u.Host + "/" + segments[0]
+	}
+	if sas.ContainerName == "" {
+		return containerSASURL{}, fmt.Errorf("container_sas_url must point to a container")
+	}
+	return sas, nil
+}
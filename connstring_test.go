@@ -0,0 +1,116 @@
+package certmagic_azblob
+
+import "testing"
+
+func TestParseConnectionString(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want connectionString
+	}{
+		{
+			s: "DefaultEndpointsProtocol=https;AccountName=acct;AccountKey=a2V5==;EndpointSuffix=core.chinacloudapi.cn",
+			want: connectionString{
+				AccountName:  "acct",
+				AccountKey:   "a2V5==",
+				BlobEndpoint: "https://acct.blob.core.chinacloudapi.cn",
+				FileEndpoint: "https://acct.file.core.chinacloudapi.cn",
+			},
+		},
+		{
+			s: " accountname=acct ; accountkey=a2V5 ;",
+			want: connectionString{
+				AccountName:  "acct",
+				AccountKey:   "a2V5",
+				BlobEndpoint: "https://acct.blob.core.windows.net",
+				FileEndpoint: "https://acct.file.core.windows.net",
+			},
+		},
+		{
+			s: "BlobEndpoint=https://certs.example.com/;SharedAccessSignature=sv=2020-08-04&sig=abc",
+			want: connectionString{
+				SASToken:     "sv=2020-08-04&sig=abc",
+				BlobEndpoint: "https://certs.example.com",
+			},
+		},
+		{
+			s: "UseDevelopmentStorage=true",
+			want: connectionString{
+				AccountName:        devStoreAccountName,
+				AccountKey:         devStoreAccountKey,
+				BlobEndpoint:       devStoreBlobURL,
+				DevelopmentStorage: true,
+			},
+		},
+		{
+			s: "UseDevelopmentStorage=true;DevelopmentStorageProxyUri=http://azurite:10000/",
+			want: connectionString{
+				AccountName:        devStoreAccountName,
+				AccountKey:         devStoreAccountKey,
+				BlobEndpoint:       "http://azurite:10000/" + devStoreAccountName,
+				DevelopmentStorage: true,
+			},
+		},
+	} {
+		got, err := parseConnectionString(tt.s)
+		if err != nil {
+			t.Errorf("parseConnectionString(%q): %v", tt.s, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseConnectionString(%q) = %+v, want %+v", tt.s, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"AccountKey=a2V5", "AccountName;AccountKey=a2V5"} {
+		if _, err := parseConnectionString(s); err == nil {
+			t.Errorf("parseConnectionString(%q) succeeded", s)
+		}
+	}
+}
+
+func TestParseContainerSASURL(t *testing.T) {
+	for _, tt := range []struct {
+		raw  string
+		want containerSASURL
+	}{
+		{
+			raw: "https://acct.blob.core.windows.net/certs?sv=2020-08-04&sig=abc",
+			want: containerSASURL{
+				AccountName:   "acct",
+				ContainerName: "certs",
+				Endpoint:      "https://acct.blob.core.windows.net",
+				SASToken:      "sv=2020-08-04&sig=abc",
+			},
+		},
+		{
+			raw: "http://127.0.0.1:10000/devstoreaccount1/certs/?sv=2020-08-04&sig=abc",
+			want: containerSASURL{
+				AccountName:   "devstoreaccount1",
+				ContainerName: "certs",
+				Endpoint:      "http://127.0.0.1:10000/devstoreaccount1",
+				SASToken:      "sv=2020-08-04&sig=abc",
+			},
+		},
+	} {
+		got, err := parseContainerSASURL(tt.raw)
+		if err != nil {
+			t.Errorf("parseContainerSASURL(%q): %v", tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseContainerSASURL(%q) = %+v, want %+v", tt.raw, got, tt.want)
+		}
+	}
+
+	for _, raw := range []string{
+		"%zz",
+		"/certs?sig=abc",
+		"https://acct.blob.core.windows.net/certs?sv=2020-08-04",
+		"https://acct.blob.core.windows.net/?sig=abc",
+		"https://acct.blob.core.windows.net/a/b/c?sig=abc",
+	} {
+		if _, err := parseContainerSASURL(raw); err == nil {
+			t.Errorf("parseContainerSASURL(%q) succeeded", raw)
+		}
+	}
+}
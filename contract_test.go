@@ -0,0 +1,167 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testContract runs the certmagic.Storage contract against s and other,
+// two storages of the same container, below a random directory that is
+// removed afterwards.
+func testContract(t *testing.T, s, other *Storage) {
+	ctx := context.Background()
+	dir := "contract/" + uuid.NewString()
+	t.Cleanup(func() {
+		s.DeleteAll(context.Background(), dir+"/")
+		s.DeleteAll(context.Background(), path.Join("locks", dir)+"/")
+	})
+
+	for _, key := range []string{"one", "sub/two", "sub/three"} {
+		if err := s.Store(ctx, path.Join(dir, key), []byte(key)); err != nil {
+			t.Fatalf("Store(%s): %v", key, err)
+		}
+	}
+
+	t.Run("load", func(t *testing.T) {
+		value, err := other.Load(ctx, path.Join(dir, "sub/two"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, []byte("sub/two")) {
+			t.Fatalf("loaded %q, stored %q", value, "sub/two")
+		}
+		if _, err := s.Load(ctx, path.Join(dir, "missing")); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Load of a missing key: expected fs.ErrNotExist, got %v", err)
+		}
+	})
+
+	t.Run("exists", func(t *testing.T) {
+		if !s.Exists(ctx, path.Join(dir, "one")) {
+			t.Fatal("stored key does not exist")
+		}
+		if s.Exists(ctx, path.Join(dir, "missing")) {
+			t.Fatal("missing key exists")
+		}
+	})
+
+	t.Run("stat", func(t *testing.T) {
+		info, err := s.Stat(ctx, path.Join(dir, "one"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.IsTerminal || info.Modified.IsZero() || info.Key != path.Join(dir, "one") {
+			t.Fatalf("key stats as %+v", info)
+		}
+		// Sizes are those of the stored blobs, which only match the value
+		// if it is stored as it is.
+		if !s.Compress && s.ClientEncryptionKey == "" && info.Size != 3 {
+			t.Fatalf("key of 3 bytes stats with size %d", info.Size)
+		}
+
+		info, err = s.Stat(ctx, path.Join(dir, "sub"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.IsTerminal {
+			t.Fatal("directory stats as a terminal key")
+		}
+
+		if _, err := s.Stat(ctx, path.Join(dir, "missing")); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Stat of a missing key: expected fs.ErrNotExist, got %v", err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		keys, err := s.List(ctx, dir, false)
+		expectListed(t, dir, keys, err, "one", "sub")
+	})
+
+	t.Run("list recursive", func(t *testing.T) {
+		keys, err := s.List(ctx, dir, true)
+		expectListed(t, dir, keys, err, "one", "sub/three", "sub/two")
+	})
+
+	t.Run("lock contention", func(t *testing.T) {
+		key := path.Join(dir, "lock")
+		if err := s.Lock(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+		err := other.Lock(waitCtx, key)
+		cancel()
+		if err == nil {
+			other.Unlock(ctx, key)
+			t.Fatal("lock held by one storage was acquired by the other")
+		}
+
+		// The waiting storage gets the lock once it is released.
+		acquired := make(chan error, 1)
+		go func() { acquired <- other.Lock(ctx, key) }()
+		time.Sleep(200 * time.Millisecond)
+		if err := s.Unlock(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-acquired:
+			if err != nil {
+				t.Fatalf("Lock after Unlock: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("lock was not acquired after it was released")
+		}
+		if err := other.Unlock(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		key := path.Join(dir, "one")
+		if err := s.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Load(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("deleted key still loads: %v", err)
+		}
+		if err := s.Delete(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Delete of a missing key: expected fs.ErrNotExist, got %v", err)
+		}
+	})
+
+	t.Run("delete directory", func(t *testing.T) {
+		if err := s.Delete(ctx, path.Join(dir, "sub")); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := s.List(ctx, dir, true)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.Fatal(err)
+		}
+		if len(keys) > 0 {
+			t.Fatalf("keys left after deleting their directory: %v", keys)
+		}
+	})
+}
+
+// expectListed checks a List result against the expected keys below dir.
+func expectListed(t *testing.T, dir string, keys []string, err error, want ...string) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		want[i] = path.Join(dir, want[i])
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Fatalf("listed %v, expected %v", keys, want)
+	}
+}
@@ -0,0 +1,123 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const (
+	// maxServerCopySize is the largest blob Azure copies synchronously.
+	maxServerCopySize = 256 << 20
+
+	// copySourceSASValidity bounds the SAS signed for a source blob.
+	copySourceSASValidity = time.Hour
+)
+
+// checkServerCopy reports why keys can't be copied from s to dst on the
+// server, if they can't.
+func (s *Storage) checkServerCopy(dst *Storage) error {
+	for _, st := range []*Storage{s, dst} {
+		if st.EncryptionKey != "" || st.EncryptionScope != "" {
+			return fmt.Errorf("server-side copies don't support encryption_key or encryption_scope of %s, use export and import instead", st)
+		}
+	}
+	// Copies keep the client encrypted bytes, which dst can only open with
+	// every key the values of s may be encrypted with.
+	if s.cipher != nil {
+		for keyID := range s.cipher.keys {
+			if dst.cipher == nil || dst.cipher.keys[keyID] == nil {
+				return fmt.Errorf("%s doesn't know client encryption key %s of %s, use export and import instead", dst, keyID, s)
+			}
+		}
+	}
+	return nil
+}
+
+// copySource returns the URL the destination account reads key from,
+// signed with a short SAS for shared key and SAS auth, and otherwise the
+// token the destination passes along to authorize the read.
+func (s *Storage) copySource(key string) (url.URL, azblob.TokenCredential, error) {
+	blobURL := s.container(key).NewBlobURL(s.blobName(key))
+	u := blobURL.URL()
+
+	switch s.authMode() {
+	case AuthModeSAS:
+		if token := s.sasToken.token.Load().(string); token != "" {
+			u.RawQuery = token
+		}
+		return u, nil, nil
+	case AuthModeSharedKey:
+		parts := azblob.NewBlobURLParts(u)
+		sas, err := azblob.BlobSASSignatureValues{
+			Protocol:      azblob.SASProtocolHTTPSandHTTP,
+			ExpiryTime:    time.Now().UTC().Add(copySourceSASValidity),
+			ContainerName: parts.ContainerName,
+			BlobName:      parts.BlobName,
+			Permissions:   azblob.BlobSASPermissions{Read: true}.String(),
+		}.NewSASQueryParameters(s.sharedKey.cred.Load().(*azblob.SharedKeyCredential))
+		if err != nil {
+			return url.URL{}, nil, err
+		}
+		u.RawQuery = sas.Encode()
+		return u, nil, nil
+	}
+
+	token, err := s.sharedToken(s.authMode())
+	return u, token, err
+}
+
+// copyKey copies key from s to dst without the value passing through this
+// host, unless dst already has it and overwrite is false. The copy is
+// verified against the size and MD5 hash of the source. It reports whether
+// key was copied.
+func (s *Storage) copyKey(ctx context.Context, dst *Storage, key string, overwrite bool) (bool, error) {
+	ctx, cancel := dst.withTimeout(ctx, dst.StoreTimeout)
+	defer cancel()
+
+	props, err := s.container(key).NewBlobURL(s.blobName(key)).GetProperties(ctx, azblob.BlobAccessConditions{}, s.cpk)
+	if err != nil {
+		return false, err
+	}
+	if props.ContentLength() > maxServerCopySize {
+		return false, fmt.Errorf("%d bytes are too large for a server-side copy", props.ContentLength())
+	}
+
+	source, token, err := s.copySource(key)
+	if err != nil {
+		return false, err
+	}
+
+	var ac azblob.BlobAccessConditions
+	if !overwrite {
+		ac.ModifiedAccessConditions.IfNoneMatch = azblob.ETagAny
+	}
+	target := dst.container(key).NewBlockBlobURL(dst.blobName(key))
+	_, err = target.CopyFromURL(ctx, source, nil, azblob.ModifiedAccessConditions{IfMatch: props.ETag()}, ac, props.ContentMD5(), dst.tierFor(key, 0), nil, azblob.ImmutabilityPolicyOptions{}, token)
+	if !overwrite && isAlreadyExists(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	copied, err := target.GetProperties(ctx, azblob.BlobAccessConditions{}, dst.cpk)
+	if err != nil {
+		return false, err
+	}
+	if copied.ContentLength() != props.ContentLength() || !bytes.Equal(copied.ContentMD5(), props.ContentMD5()) {
+		return false, ErrChecksumMismatch
+	}
+	return true, nil
+}
+
+// skipCopy reports whether key belongs to the running instances or the
+// audit trail of s rather than the certificate material.
+func (s *Storage) skipCopy(key string) bool {
+	return strings.HasPrefix(key, "locks/") || strings.HasPrefix(key, "healthcheck/") || s.isAuditKey(key)
+}
@@ -0,0 +1,41 @@
+package certmagic_azblob
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestCheckServerCopyClientEncryption(t *testing.T) {
+	key := func(b byte) string {
+		k := make([]byte, 32)
+		k[0] = b
+		return base64.StdEncoding.EncodeToString(k)
+	}
+	encrypted := func(current string, previous ...string) func(*Options) {
+		return func(o *Options) {
+			o.ClientEncryptionKey = current
+			o.ClientEncryptionPreviousKeys = previous
+		}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		src, dst func(*Options)
+		ok       bool
+	}{
+		{"unencrypted", func(*Options) {}, func(*Options) {}, true},
+		{"to encrypted", func(*Options) {}, encrypted(key(1)), true},
+		{"same key", encrypted(key(1)), encrypted(key(1)), true},
+		{"to unencrypted", encrypted(key(1)), func(*Options) {}, false},
+		{"other key", encrypted(key(1)), encrypted(key(2)), false},
+		{"rotated destination", encrypted(key(1)), encrypted(key(2), key(1)), true},
+		{"previous key unknown", encrypted(key(2), key(1)), encrypted(key(2)), false},
+		{"previous key known", encrypted(key(2), key(1)), encrypted(key(3), key(1), key(2)), true},
+	} {
+		src := newMemoryStorage(t, tt.src)
+		dst := newMemoryStorage(t, tt.dst)
+		if err := src.checkServerCopy(dst); (err == nil) != tt.ok {
+			t.Errorf("%s: checkServerCopy = %v, expected ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
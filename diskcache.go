@@ -0,0 +1,156 @@
+package certmagic_azblob
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+)
+
+// reconcileInterval limits how often a key served from the disk cache is
+// compared with its blob.
+const reconcileInterval = time.Minute
+
+// diskCache mirrors stored values below a local directory in the layout of
+// certmagic's file system storage. Files carry the modification time of
+// their blob so they can be compared with it.
+type diskCache struct {
+	dir string
+
+	mu      sync.Mutex
+	checked map[string]time.Time
+}
+
+func newDiskCache(dir string) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &diskCache{dir: dir, checked: make(map[string]time.Time)}, nil
+}
+
+// path returns the file of key below dir. Keys that aren't a plain
+// relative path, like ones with ".." segments, could reach files outside
+// dir and are refused.
+func (c *diskCache) path(key string) (string, error) {
+	if !fs.ValidPath(key) || key == "." {
+		return "", fmt.Errorf("key %q can't be cached on disk", key)
+	}
+	path := filepath.Join(c.dir, filepath.FromSlash(key))
+	if rel, err := filepath.Rel(c.dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("key %q can't be cached on disk", key)
+	}
+	return path, nil
+}
+
+func (c *diskCache) read(key string) ([]byte, time.Time, bool) {
+	path, err := c.path(key)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, time.Time{}, false
+	}
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	return value, fi.ModTime(), true
+}
+
+// write replaces the cached copy of key through a temporary file, so
+// readers never see a partial value.
+func (c *diskCache) write(key string, value []byte, modified time.Time) error {
+	path, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), modified, modified); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// remove drops key, and everything below it if it is a directory.
+func (c *diskCache) remove(key string) error {
+	path, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+// due reports whether key wasn't reconciled within reconcileInterval and
+// marks it as reconciled now.
+func (c *diskCache) due(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked[key]) < reconcileInterval {
+		return false
+	}
+	c.checked[key] = time.Now()
+	return true
+}
+
+// reconcile brings the cached copy of key up to date with its blob, which
+// may have been changed or deleted by another instance.
+func (s *Storage) reconcile(key string, modified time.Time) {
+	if !s.diskCache.due(key) {
+		return
+	}
+
+	ctx, cancel := withTimeout(s.ctx, s.LoadTimeout)
+	defer cancel()
+
+	blobURL := s.container(key).NewBlockBlobURL(s.blobName(key))
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, s.cpk)
+	if isNotFound(err) {
+		s.diskCache.remove(key)
+		return
+	}
+	if err != nil {
+		// Keep serving the cached copy while Azure is unreachable.
+		s.logger.Debug("Reconcile Error", zap.String("key", key), s.errField(err))
+		return
+	}
+	if props.LastModified().Equal(modified) {
+		return
+	}
+
+	value, modified, err := s.download(s.ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.diskCache.remove(key)
+		return
+	}
+	if err != nil {
+		return
+	}
+	if err := s.diskCache.write(key, value, modified); err != nil {
+		s.logger.Error("Disk Cache Error", zap.String("key", key), s.errField(err))
+	}
+}
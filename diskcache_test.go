@@ -0,0 +1,108 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newDiskCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modified := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	if err := c.write("dir/sub/key", []byte("value"), modified); err != nil {
+		t.Fatal(err)
+	}
+	value, mtime, ok := c.read("dir/sub/key")
+	if !ok || string(value) != "value" || !mtime.Equal(modified) {
+		t.Fatalf("read = %q, %v, %v, expected the written value and time", value, mtime, ok)
+	}
+	if _, _, ok := c.read("dir/sub"); ok {
+		t.Fatal("a directory was read as a value")
+	}
+
+	if err := c.remove("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.read("dir/sub/key"); ok {
+		t.Fatal("a value below a removed directory is still cached")
+	}
+}
+
+func TestDiskCacheRejectsEscapingKeys(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newDiskCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(dir, "outside")
+	if err := os.WriteFile(outside, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../outside", "dir/../../outside", "/outside", "", ".", "dir//key", "dir/./key"} {
+		if err := c.write(key, []byte("value"), time.Now()); err == nil {
+			t.Errorf("write(%q) succeeded", key)
+		}
+		if _, _, ok := c.read(key); ok {
+			t.Errorf("read(%q) succeeded", key)
+		}
+		if err := c.remove(key); err == nil {
+			t.Errorf("remove(%q) succeeded", key)
+		}
+	}
+	if value, err := os.ReadFile(outside); err != nil || string(value) != "secret" {
+		t.Fatalf("file outside the cache changed: %q, %v", value, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cache")); err != nil {
+		t.Fatalf("cache directory removed: %v", err)
+	}
+}
+
+func TestStorageDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	s := newMemoryStorage(t, func(o *Options) { o.CacheDir = dir })
+	ctx := context.Background()
+
+	if err := s.Store(ctx, "certificates/example.com.crt", []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+	value, err := os.ReadFile(filepath.Join(dir, "certificates", "example.com.crt"))
+	if err != nil || string(value) != "cert" {
+		t.Fatalf("cached copy = %q, %v, expected the stored value", value, err)
+	}
+
+	// A key that would leave the cache directory is still stored in the
+	// container, just not cached.
+	if err := s.Store(ctx, "../escaped", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped")); !os.IsNotExist(err) {
+		t.Fatalf("value written outside the cache directory: %v", err)
+	}
+
+	if err := s.Delete(ctx, "certificates"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "certificates")); !os.IsNotExist(err) {
+		t.Fatalf("cached copy of a deleted directory remains: %v", err)
+	}
+}
+
+func TestDiskCacheWithClientEncryption(t *testing.T) {
+	_, err := New(Options{
+		ContainerName:       memoryScheme + "test",
+		CacheDir:            t.TempDir(),
+		ClientEncryptionKey: base64.StdEncoding.EncodeToString(make([]byte, 32)),
+	})
+	if err == nil {
+		t.Fatal("cache_dir was accepted together with client_encryption_key")
+	}
+}
@@ -0,0 +1,200 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+)
+
+// Blob metadata describing how a value was encrypted client side.
+const (
+	metadataEncryption      = "caddyencryption"
+	metadataEncryptionKeyID = "caddyencryptionkeyid"
+
+	encryptionAES256GCM = "AES256-GCM"
+)
+
+var errUnknownEncryptionKey = errors.New("blob is encrypted with an unknown client encryption key")
+
+// valueCipher encrypts stored values with AES-256-GCM. The certmagic key is
+// used as additional data so a blob can't be swapped in under another name.
+// Values are sealed with the current key and opened with whichever key
+// their metadata names.
+type valueCipher struct {
+	keyID string
+	aead  cipher.AEAD
+	keys  map[string]cipher.AEAD
+}
+
+// newValueCipher returns a cipher for the current key. Previous keys are
+// base64 encoded, optionally prefixed with their key ID and a colon, and are
+// only used to decrypt.
+func newValueCipher(encodedKey, keyID string, previous []string) (*valueCipher, error) {
+	aead, keyID, err := newKeyAEAD(encodedKey, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("client_encryption_key: %v", err)
+	}
+
+	c := &valueCipher{keyID: keyID, aead: aead, keys: map[string]cipher.AEAD{keyID: aead}}
+	for i, old := range previous {
+		var oldID string
+		if i := strings.LastIndex(old, ":"); i >= 0 {
+			oldID, old = old[:i], old[i+1:]
+		}
+		aead, oldID, err := newKeyAEAD(old, oldID)
+		if err != nil {
+			return nil, fmt.Errorf("client_encryption_previous_key %d: %v", i, err)
+		}
+		if _, ok := c.keys[oldID]; !ok {
+			c.keys[oldID] = aead
+		}
+	}
+	return c, nil
+}
+
+// newKeyAEAD decodes a base64 AES-256 key, deriving its ID from the key
+// when keyID is empty.
+func newKeyAEAD(encodedKey, keyID string) (cipher.AEAD, string, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, "", fmt.Errorf("must be a 256 bit key, got %d bits", len(key)*8)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if keyID == "" {
+		sum := sha256.Sum256(key)
+		keyID = hex.EncodeToString(sum[:8])
+	}
+	return aead, keyID, nil
+}
+
+// decrypt returns the plaintext of a downloaded blob.
+func (s *Storage) decrypt(key string, data []byte, metadata azblob.Metadata) ([]byte, error) {
+	if s.cipher == nil {
+		if metadata[metadataEncryption] != "" {
+			return nil, fmt.Errorf("blob is client side encrypted but no client_encryption_key is configured")
+		}
+		return data, nil
+	}
+	return s.cipher.open(key, data, metadata)
+}
+
+// seal returns nonce || ciphertext and the metadata to store next to it.
+func (c *valueCipher) seal(key string, value []byte) ([]byte, azblob.Metadata, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+
+	sealed := c.aead.Seal(nonce, nonce, value, []byte(key))
+	metadata := azblob.Metadata{
+		metadataEncryption:      encryptionAES256GCM,
+		metadataEncryptionKeyID: c.keyID,
+	}
+	return sealed, metadata, nil
+}
+
+// open decrypts a value written by seal. Blobs without encryption metadata
+// were stored before encryption was enabled and are returned as-is.
+func (c *valueCipher) open(key string, data []byte, metadata azblob.Metadata) ([]byte, error) {
+	if metadata[metadataEncryption] == "" {
+		return data, nil
+	}
+
+	if metadata[metadataEncryption] != encryptionAES256GCM {
+		return nil, fmt.Errorf("unsupported client encryption %q", metadata[metadataEncryption])
+	}
+
+	aead, ok := c.keys[metadata[metadataEncryptionKeyID]]
+	if !ok {
+		return nil, errUnknownEncryptionKey
+	}
+
+	size := aead.NonceSize()
+	if len(data) < size {
+		return nil, fmt.Errorf("encrypted value is truncated")
+	}
+
+	return aead.Open(nil, data[:size], data[size:], []byte(key))
+}
+
+// needsRewrap reports whether a blob with the given metadata isn't
+// encrypted with the current key.
+func (c *valueCipher) needsRewrap(metadata azblob.Metadata) bool {
+	return metadata[metadataEncryption] != encryptionAES256GCM || metadata[metadataEncryptionKeyID] != c.keyID
+}
+
+// Rewrap re-encrypts every value below prefix that isn't encrypted with
+// the current client encryption key, including values stored before
+// encryption was enabled. It returns how many values were rewritten.
+func (s *Storage) Rewrap(ctx context.Context, prefix string) (int, error) {
+	if s.cipher == nil {
+		return 0, fmt.Errorf("rewrap requires a client_encryption_key")
+	}
+
+	keys, err := s.List(ctx, prefix, true)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var rewrapped int
+	for _, key := range keys {
+		// Lock blobs and health check probes hold no values, and the
+		// audit log must stay an append blob.
+		if strings.HasPrefix(key, "locks/") || strings.HasPrefix(key, "healthcheck/") || s.isAuditKey(key) {
+			continue
+		}
+
+		blobURL := s.container(key).NewBlockBlobURL(s.blobName(key))
+		props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, s.cpk)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return rewrapped, fmt.Errorf("reading %s: %v", key, err)
+		}
+		if !s.cipher.needsRewrap(props.NewMetadata()) {
+			continue
+		}
+
+		// Loading records the ETag, so a concurrent change is noticed
+		// like on any other store.
+		value, _, err := s.download(ctx, key)
+		if err != nil {
+			return rewrapped, fmt.Errorf("decrypting %s: %v", key, err)
+		}
+		if err := s.store(ctx, key, value, false); err != nil {
+			return rewrapped, fmt.Errorf("encrypting %s: %v", key, err)
+		}
+		s.logger.Info("Rewrapped key", zap.String("key", key), zap.String("key_id", s.cipher.keyID))
+		rewrapped++
+	}
+	return rewrapped, nil
+}
@@ -0,0 +1,136 @@
+package certmagic_azblob
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// ErrLockTimeout is returned by Lock when the lock could not be acquired
+// within lock_wait_timeout.
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+// ErrLockStolen is returned by Unlock when the lease of the lock was lost
+// while it was held, e.g. because another instance broke it as stale. The
+// work done under the lock may have raced with the new holder.
+var ErrLockStolen = errors.New("lock was lost while it was held")
+
+// ErrThrottled is matched by errors of requests that Azure kept rejecting
+// with 429 or 503 after all retries. The storage error stays available
+// through errors.As.
+var ErrThrottled = errors.New("throttled by Azure Storage")
+
+// ErrNotFound is fs.ErrNotExist, which Load, Stat, Delete and List return
+// for missing keys as certmagic expects.
+var ErrNotFound = fs.ErrNotExist
+
+// ErrConflict is returned by Store with strict_writes when the key was
+// changed by someone else since this instance last loaded or stored it.
+var ErrConflict = errors.New("key was changed concurrently")
+
+// ErrChecksumMismatch is returned by Load when a downloaded value does not
+// match the MD5 hash stored with its blob.
+var ErrChecksumMismatch = errors.New("blob content does not match its MD5 hash")
+
+// ErrArchived is returned by Load when the blob of a key was moved to the
+// archive tier and rehydrate_priority is not set.
+var ErrArchived = errors.New("blob is in the archive tier")
+
+// ErrRehydrating is returned by Load while the blob of a key is being
+// rehydrated from the archive tier, which takes up to hours. Loading it
+// again once rehydration finished succeeds.
+var ErrRehydrating = errors.New("blob is being rehydrated from the archive tier, retry later")
+
+// ErrTooLarge is returned by Load when a value is larger than
+// max_value_size.
+var ErrTooLarge = errors.New("value exceeds max_value_size")
+
+// ErrListUnsupported is returned by List and everything built on it when
+// no_list is set because the credential lacks the List permission.
+var ErrListUnsupported = errors.New("listing the container is disabled by no_list")
+
+// ErrClosed is returned by operations started after Close.
+var ErrClosed = errors.New("storage is closed")
+
+// throttledError is a storage error of a request that stayed throttled.
+type throttledError struct {
+	err error
+}
+
+func (e *throttledError) Error() string        { return ErrThrottled.Error() + ": " + e.err.Error() }
+func (e *throttledError) Unwrap() error        { return e.err }
+func (e *throttledError) Is(target error) bool { return target == ErrThrottled }
+
+// isLeaseLost reports whether err is caused by a lease that this instance
+// no longer holds.
+func isLeaseLost(err error) bool {
+	switch serviceCode(err) {
+	case azblob.ServiceCodeLeaseLost,
+		azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation,
+		azblob.ServiceCodeLeaseNotPresentWithLeaseOperation,
+		azblob.ServiceCodeLeaseIDMismatchWithBlobOperation,
+		azblob.ServiceCodeLeaseNotPresentWithBlobOperation,
+		azblob.ServiceCodeLeaseIsBrokenAndCannotBeRenewed:
+		return true
+	}
+	return false
+}
+
+// isNotFound reports whether err is a storage error for a missing blob or
+// container.
+func isNotFound(err error) bool {
+	var serr azblob.StorageError
+	if !errors.As(err, &serr) {
+		return false
+	}
+
+	switch serr.ServiceCode() {
+	case azblob.ServiceCodeBlobNotFound, azblob.ServiceCodeContainerNotFound, azblob.ServiceCodeResourceNotFound:
+		return true
+	}
+
+	// HEAD requests carry no body, fall back to the status code.
+	resp := serr.Response()
+	return resp != nil && resp.StatusCode == http.StatusNotFound
+}
+
+// isAlreadyExists reports whether err is caused by a create-only write
+// (If-None-Match: *) to a blob that exists.
+func isAlreadyExists(err error) bool {
+	switch serviceCode(err) {
+	case azblob.ServiceCodeBlobAlreadyExists, azblob.ServiceCodeConditionNotMet:
+		return true
+	}
+	return false
+}
+
+// isImmutable reports whether err is caused by an immutability policy or
+// legal hold protecting a blob.
+func isImmutable(err error) bool {
+	switch serviceCode(err) {
+	case "BlobImmutableDueToPolicy", "BlobImmutableDueToLegalHold":
+		return true
+	}
+	return false
+}
+
+// errorResponse returns the response a storage error of the blob or file
+// service was caused by, if any.
+func errorResponse(err error) *http.Response {
+	var rerr interface{ Response() *http.Response }
+	if !errors.As(err, &rerr) {
+		return nil
+	}
+	return rerr.Response()
+}
+
+// serviceCode returns the storage service error code of err, if any.
+func serviceCode(err error) azblob.ServiceCodeType {
+	var serr azblob.StorageError
+	if errors.As(err, &serr) {
+		return serr.ServiceCode()
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// checkNotExist checks that every operation on a missing key reports
+// fs.ErrNotExist.
+func checkNotExist(t *testing.T, s *Storage) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, err := s.Load(ctx, "missing/key"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load: expected fs.ErrNotExist, got %v", err)
+	}
+	if err := s.Delete(ctx, "missing/key"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Delete: expected fs.ErrNotExist, got %v", err)
+	}
+	if _, err := s.Stat(ctx, "missing/key"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat: expected fs.ErrNotExist, got %v", err)
+	}
+	if _, err := s.List(ctx, "missing", true); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("recursive List: expected fs.ErrNotExist, got %v", err)
+	}
+	if _, err := s.List(ctx, "missing", false); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("List: expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestNotExistMissingKey(t *testing.T) {
+	s := newMemoryStorage(t)
+	if err := s.Store(context.Background(), "other/key", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	checkNotExist(t, s)
+}
+
+func TestNotExistMissingContainer(t *testing.T) {
+	s := newMemoryStorage(t)
+	if _, err := s.containerURL.Delete(context.Background(), azblob.ContainerAccessConditions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkNotExist(t, s)
+}
@@ -0,0 +1,52 @@
+package certmagic_azblob
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// errNotModified is returned by downloadIfChanged when the blob still has
+// the ETag the caller already has the value of.
+var errNotModified = errors.New("blob not modified")
+
+// etag returns the ETag key had when this instance last loaded, stored or
+// got the properties of it, or azblob.ETagNone if it is unknown.
+func (s *Storage) etag(key string) azblob.ETag {
+	s.etagsMu.Lock()
+	defer s.etagsMu.Unlock()
+	return s.etags[key]
+}
+
+// setETag records the ETag of key, azblob.ETagNone forgets it.
+func (s *Storage) setETag(key string, etag azblob.ETag) {
+	s.etagsMu.Lock()
+	defer s.etagsMu.Unlock()
+	if etag == azblob.ETagNone {
+		delete(s.etags, key)
+		return
+	}
+	s.etags[key] = etag
+}
+
+// writeConditions makes a write of key fail if the blob changed since this
+// instance last saw it.
+func (s *Storage) writeConditions(key string) azblob.BlobAccessConditions {
+	return azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: s.etag(key)},
+	}
+}
+
+// isConditionNotMet reports whether err is caused by an access condition
+// that didn't hold, like an outdated If-Match ETag.
+func isConditionNotMet(err error) bool {
+	return serviceCode(err) == azblob.ServiceCodeConditionNotMet
+}
+
+// isNotModified reports whether err is the 304 response to a download
+// with an If-None-Match ETag that still matches.
+func isNotModified(err error) bool {
+	resp := errorResponse(err)
+	return resp != nil && resp.StatusCode == http.StatusNotModified
+}
@@ -0,0 +1,184 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+)
+
+// failoverReconcileInterval is how often keys written to the failover
+// storage are copied back to the primary.
+const failoverReconcileInterval = time.Minute
+
+// newFailover returns the storage writes fail over to.
+func (s *Storage) newFailover() (*Storage, error) {
+	o := *s.Failover
+	if o.Failover != nil {
+		return nil, fmt.Errorf("failover storage can not have a failover itself")
+	}
+	if o.Logger == nil {
+		o.Logger = s.logger.Named("failover")
+	}
+
+	failover, err := New(o)
+	if err != nil {
+		return nil, fmt.Errorf("failover: %v", err)
+	}
+	return failover, nil
+}
+
+// useFailover reports whether a failed request should be retried on the
+// failover storage, which is the case when the primary account is down or
+// rejects the credentials, e.g. after a key rotation.
+func (s *Storage) useFailover(ctx context.Context, err error) bool {
+	if s.failover == nil || err == nil || ctx.Err() != nil {
+		return false
+	}
+
+	var serr azblob.StorageError
+	if errors.As(err, &serr) {
+		resp := serr.Response()
+		return resp != nil && (resp.StatusCode >= 500 || resp.StatusCode == http.StatusForbidden)
+	}
+
+	// No response at all, e.g. a DNS or connection failure.
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
+
+// storeFailover writes key to the failover storage after the primary
+// failed with err, and remembers that the failover copy is current.
+func (s *Storage) storeFailover(ctx context.Context, key string, value []byte, err error) error {
+	s.logger.Warn("Store failing over", zap.String("key", key), s.errField(err))
+	if err := s.failover.Store(ctx, key, value); err != nil {
+		return err
+	}
+
+	s.failoverMu.Lock()
+	s.failoverKeys[key] = true
+	s.failoverMu.Unlock()
+	return nil
+}
+
+// inFailover reports whether the current value of key was written to the
+// failover storage by this instance.
+func (s *Storage) inFailover(key string) bool {
+	s.failoverMu.Lock()
+	defer s.failoverMu.Unlock()
+	return s.failoverKeys[key]
+}
+
+// dropFailover deletes the failover copy of key once the primary holds a
+// newer value.
+func (s *Storage) dropFailover(ctx context.Context, key string) {
+	if !s.inFailover(key) {
+		return
+	}
+
+	s.failoverMu.Lock()
+	delete(s.failoverKeys, key)
+	s.failoverMu.Unlock()
+
+	if err := s.failover.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		s.logger.Warn("Failover Delete Error", zap.String("key", key), s.errField(err))
+	}
+}
+
+// mergeKeys appends the keys of b missing from a.
+func mergeKeys(a, b []string) []string {
+	seen := make(map[string]bool, len(a))
+	for _, key := range a {
+		seen[key] = true
+	}
+	for _, key := range b {
+		if !seen[key] {
+			a = append(a, key)
+		}
+	}
+	return a
+}
+
+// reconcileFailover copies keys written to the failover storage back to the
+// primary once it accepts writes again.
+func (s *Storage) reconcileFailover() {
+	ticker := time.NewTicker(failoverReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		s.copyBack(s.ctx)
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// copyBack moves every key of the failover storage to the primary, unless
+// the primary was written to more recently. It stops at the first error,
+// the primary is most likely still unavailable.
+func (s *Storage) copyBack(ctx context.Context) {
+	keys, err := s.failover.List(ctx, "", true)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failover Reconcile Error", s.errField(err))
+		return
+	}
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, "locks/") || strings.HasPrefix(key, "healthcheck/") {
+			continue
+		}
+
+		if err := s.copyBackKey(ctx, key); err != nil {
+			s.logger.Warn("Failover Reconcile Error", zap.String("key", key), s.errField(err))
+			return
+		}
+		s.logger.Info("Copied failover key back to primary", zap.String("key", key))
+	}
+}
+
+func (s *Storage) copyBackKey(ctx context.Context, key string) error {
+	value, modified, err := s.failover.download(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	statCtx, cancel := s.withTimeout(ctx, s.LoadTimeout)
+	blobURL := s.container(key).NewBlockBlobURL(s.blobName(key))
+	props, err := blobURL.GetProperties(statCtx, azblob.BlobAccessConditions{}, s.cpk)
+	cancel()
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	if err != nil || props.LastModified().Before(modified) {
+		if err := s.store(ctx, key, value, false); err != nil {
+			return err
+		}
+	}
+
+	s.failoverMu.Lock()
+	delete(s.failoverKeys, key)
+	s.failoverMu.Unlock()
+
+	err = s.failover.Delete(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
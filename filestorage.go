@@ -0,0 +1,619 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
+	"github.com/caddyserver/certmagic"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// FileStorage is a certmagic.Storage on an Azure Files share, for setups
+// that need the certificates reachable over SMB. It is configured with the
+// same Options as Storage, ContainerName naming the share, and shares its
+// credentials, credential rotation, transport, retries, logging and
+// metrics. Options that only make sense for blobs are ignored.
+type FileStorage struct {
+	// s holds the configuration and the pipeline, its container is never
+	// used.
+	s        *Storage
+	shareURL azfile.ShareURL
+
+	locksMu sync.Mutex
+	locks   map[string]*fileLock
+}
+
+// fileLock is a lock directory held by this instance, refreshed until
+// Unlock.
+type fileLock struct {
+	dirURL azfile.DirectoryURL
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewFileStorage returns a storage on the share ContainerName. Azure Files
+// only accepts shared key and SAS authentication from this SDK.
+func NewFileStorage(o Options) (_ *FileStorage, err error) {
+	s := &Storage{
+		Options:     o,
+		uuid:        uuid.NewString(),
+		lastSuccess: make(map[string]time.Time),
+		closing:     make(chan struct{}),
+	}
+	s.logger, err = s.newLogger()
+	if err != nil {
+		return nil, err
+	}
+	s.Prefix = strings.Trim(s.Prefix, "/")
+	if strings.HasPrefix(s.ContainerName, memoryScheme) {
+		return nil, fmt.Errorf("%s containers are only supported by caddy.storage.azblob", memoryScheme)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	if s.ConnectionString != "" {
+		cs, err := parseConnectionString(s.ConnectionString)
+		if err != nil {
+			return nil, err
+		}
+		if s.AccountName == "" {
+			s.AccountName = cs.AccountName
+		}
+		if s.AccountKey == "" {
+			s.AccountKey = cs.AccountKey
+		}
+		if s.SASToken == "" {
+			s.SASToken = cs.SASToken
+		}
+		if s.Endpoint == "" {
+			s.Endpoint = cs.FileEndpoint
+		}
+	}
+
+	mode := s.authMode()
+	if mode != AuthModeSharedKey && mode != AuthModeSAS {
+		return nil, fmt.Errorf("azfile supports auth_mode %s and %s, not %s", AuthModeSharedKey, AuthModeSAS, mode)
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := s.acquireClient(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			s.releaseClient()
+		}
+	}()
+
+	if s.rotatesCredential() {
+		s.credential, err = s.readCredential(s.ctx)
+		if err != nil {
+			return nil, err
+		}
+		if mode == AuthModeSAS {
+			s.SASToken = s.credential
+		} else {
+			s.AccountKey = s.credential
+		}
+	}
+
+	u, err := url.Parse(s.fileEndpoint())
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint: %v", err)
+	}
+	if u.Scheme != "https" && !s.InsecureAllowHTTP {
+		return nil, fmt.Errorf("endpoint %s is not https, set insecure_allow_http to allow it", u)
+	}
+
+	creds, err := s.newCredential(mode)
+	if err != nil {
+		return nil, err
+	}
+	s.pipeline = s.newPipeline(creds)
+
+	f := &FileStorage{
+		s:        s,
+		shareURL: azfile.NewServiceURL(*u, s.pipeline).NewShareURL(s.ContainerName),
+		locks:    make(map[string]*fileLock),
+	}
+
+	if s.CreateContainer {
+		_, err := f.shareURL.Create(s.ctx, azfile.Metadata{}, 0)
+		if err != nil && fileServiceCode(err) != azfile.ServiceCodeShareAlreadyExists {
+			return nil, fmt.Errorf("creating share %s: %v", s.ContainerName, err)
+		}
+	}
+	if s.rotatesCredential() {
+		go s.refreshCredentials()
+	}
+	return f, nil
+}
+
+// fileEndpoint is the file service endpoint of the account.
+func (s *Storage) fileEndpoint() string {
+	if s.Endpoint != "" {
+		return strings.TrimSuffix(s.Endpoint, "/")
+	}
+	suffix := strings.TrimPrefix(strings.Trim(s.EndpointSuffix, "."), "blob.")
+	if suffix == "" {
+		suffix = strings.TrimPrefix(defaultEndpointSuffix, "blob.")
+	}
+	return fmt.Sprintf("https://%s.file.%s", s.AccountName, suffix)
+}
+
+// Close releases the locks held by this instance and stops the background
+// work of the storage.
+func (f *FileStorage) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), f.s.shutdownTimeout())
+	defer cancel()
+
+	f.locksMu.Lock()
+	keys := make([]string, 0, len(f.locks))
+	for key := range f.locks {
+		keys = append(keys, key)
+	}
+	f.locksMu.Unlock()
+
+	// Unlock logs its failures.
+	for _, key := range keys {
+		f.Unlock(ctx, key)
+	}
+	return f.s.Close()
+}
+
+func (f *FileStorage) String() string {
+	return fmt.Sprintf("AZFile Account Name: %s, Share Name: %s", f.s.AccountName, f.s.ContainerName)
+}
+
+// fileServiceCode is the service code of an Azure Files error, if any.
+func fileServiceCode(err error) azfile.ServiceCodeType {
+	var serr azfile.StorageError
+	if errors.As(err, &serr) {
+		return serr.ServiceCode()
+	}
+	return ""
+}
+
+// isFileNotFound reports whether err is caused by a missing file,
+// directory or parent directory.
+func isFileNotFound(err error) bool {
+	switch fileServiceCode(err) {
+	case azfile.ServiceCodeResourceNotFound, azfile.ServiceCodeParentNotFound, azfile.ServiceCodeShareNotFound:
+		return true
+	}
+	resp := errorResponse(err)
+	return resp != nil && resp.StatusCode == 404
+}
+
+// filePath is the path of key in the share.
+func (f *FileStorage) filePath(key string) string {
+	return path.Join(f.s.Prefix, escapeKey(strings.Trim(key, "/")))
+}
+
+func (f *FileStorage) fileURL(key string) azfile.FileURL {
+	return f.shareURL.NewRootDirectoryURL().NewFileURL(f.filePath(key))
+}
+
+func (f *FileStorage) dirURL(key string) azfile.DirectoryURL {
+	if p := f.filePath(key); p != "" {
+		return f.shareURL.NewDirectoryURL(p)
+	}
+	return f.shareURL.NewRootDirectoryURL()
+}
+
+// createDirs creates the directory at p and its parents.
+func (f *FileStorage) createDirs(ctx context.Context, p string) error {
+	var dir string
+	for _, segment := range strings.Split(p, "/") {
+		dir = path.Join(dir, segment)
+		_, err := f.shareURL.NewDirectoryURL(dir).Create(ctx, azfile.Metadata{}, azfile.SMBProperties{})
+		if err != nil && fileServiceCode(err) != azfile.ServiceCodeResourceAlreadyExists {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FileStorage) Store(ctx context.Context, key string, value []byte) (err error) {
+	defer f.s.observe("store", time.Now(), &err)
+
+	ctx, cancel := f.s.withTimeout(ctx, f.s.StoreTimeout)
+	defer cancel()
+
+	// The MD5 lets Load detect a file that is still being written, as a
+	// file is created at its full size before its ranges are uploaded.
+	sum := md5.Sum(value)
+	o := azfile.UploadToAzureFileOptions{
+		FileHTTPHeaders: azfile.FileHTTPHeaders{ContentType: f.s.contentType(key), ContentMD5: sum[:]},
+	}
+	fileURL := f.fileURL(key)
+	err = azfile.UploadBufferToAzureFile(ctx, value, fileURL, o)
+	if fileServiceCode(err) == azfile.ServiceCodeParentNotFound {
+		if err = f.createDirs(ctx, path.Dir(f.filePath(key))); err == nil {
+			err = azfile.UploadBufferToAzureFile(ctx, value, fileURL, o)
+		}
+	}
+	if err != nil {
+		f.s.logger.Error("Store Error", zap.String("key", key), f.s.errField(err))
+	}
+	return err
+}
+
+func (f *FileStorage) Load(ctx context.Context, key string) (value []byte, err error) {
+	defer f.s.observe("load", time.Now(), &err)
+
+	ctx, cancel := f.s.withTimeout(ctx, f.s.LoadTimeout)
+	defer cancel()
+
+	get, err := f.fileURL(key).Download(ctx, 0, azfile.CountToEnd, false)
+	if isFileNotFound(err) {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		f.s.logger.Error("Load Error", zap.String("key", key), f.s.errField(err))
+		return nil, err
+	}
+	if limit := f.s.maxValueSize(); limit > 0 && get.ContentLength() > limit {
+		return nil, fmt.Errorf("%w: %s is %d bytes", ErrTooLarge, key, get.ContentLength())
+	}
+
+	body := get.Body(azfile.RetryReaderOptions{
+		MaxRetryRequests:       f.s.downloadRetries(),
+		TreatEarlyCloseAsError: f.s.DownloadEarlyCloseError,
+		NotifyFailedRead:       f.s.failedRead,
+	})
+	defer body.Close()
+	value, err = io.ReadAll(body)
+	if err != nil {
+		f.s.logger.Error("Load Error", zap.String("key", key), f.s.errField(err))
+		return nil, err
+	}
+
+	if want := get.ContentMD5(); len(want) > 0 {
+		if sum := md5.Sum(value); !bytes.Equal(sum[:], want) {
+			return nil, fmt.Errorf("%s does not match its MD5, it may be being written", key)
+		}
+	}
+	return value, nil
+}
+
+// Delete deletes the file of key or, if key is a directory, everything
+// below it.
+func (f *FileStorage) Delete(ctx context.Context, key string) (err error) {
+	defer f.s.observe("delete", time.Now(), &err)
+
+	ctx, cancel := f.s.withTimeout(ctx, f.s.StoreTimeout)
+	defer cancel()
+
+	_, err = f.fileURL(key).Delete(ctx)
+	if isFileNotFound(err) {
+		err = f.deleteDir(ctx, f.dirURL(key))
+	}
+	if isFileNotFound(err) {
+		return fs.ErrNotExist
+	}
+	if err != nil {
+		f.s.logger.Error("Delete Error", zap.String("key", key), f.s.errField(err))
+	}
+	return err
+}
+
+// deleteDir deletes dirURL with its files and subdirectories.
+func (f *FileStorage) deleteDir(ctx context.Context, dirURL azfile.DirectoryURL) error {
+	for marker := (azfile.Marker{}); marker.NotDone(); {
+		ls, err := dirURL.ListFilesAndDirectoriesSegment(ctx, marker, azfile.ListFilesAndDirectoriesOptions{})
+		if err != nil {
+			return err
+		}
+		for _, v := range ls.FileItems {
+			if _, err := dirURL.NewFileURL(v.Name).Delete(ctx); err != nil && !isFileNotFound(err) {
+				return err
+			}
+		}
+		for _, v := range ls.DirectoryItems {
+			if err := f.deleteDir(ctx, dirURL.NewDirectoryURL(v.Name)); err != nil && !isFileNotFound(err) {
+				return err
+			}
+		}
+		marker = ls.NextMarker
+	}
+
+	_, err := dirURL.Delete(ctx)
+	return err
+}
+
+func (f *FileStorage) Exists(ctx context.Context, key string) bool {
+	_, err := f.Stat(ctx, key)
+	return err == nil
+}
+
+func (f *FileStorage) Stat(ctx context.Context, key string) (info certmagic.KeyInfo, err error) {
+	defer f.s.observe("stat", time.Now(), &err)
+
+	ctx, cancel := f.s.withTimeout(ctx, f.s.LoadTimeout)
+	defer cancel()
+
+	props, err := f.fileURL(key).GetProperties(ctx)
+	if err == nil {
+		return certmagic.KeyInfo{
+			Key:        key,
+			Modified:   props.LastModified(),
+			Size:       props.ContentLength(),
+			IsTerminal: true,
+		}, nil
+	}
+	if !isFileNotFound(err) {
+		f.s.logger.Error("Stat Error", zap.String("key", key), f.s.errField(err))
+		return certmagic.KeyInfo{}, err
+	}
+
+	dirProps, err := f.dirURL(key).GetProperties(ctx)
+	if isFileNotFound(err) {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+	if err != nil {
+		f.s.logger.Error("Stat Error", zap.String("key", key), f.s.errField(err))
+		return certmagic.KeyInfo{}, err
+	}
+	return certmagic.KeyInfo{Key: key, Modified: dirProps.LastModified()}, nil
+}
+
+// List returns the files and directories directly below prefix or, if
+// recursive, every file below it.
+func (f *FileStorage) List(ctx context.Context, prefix string, recursive bool) (keys []string, err error) {
+	defer f.s.observe("list", time.Now(), &err)
+
+	ctx, cancel := f.s.withTimeout(ctx, f.s.ListTimeout)
+	defer cancel()
+
+	prefix = strings.Trim(prefix, "/")
+	keys, err = f.listDir(ctx, prefix, recursive)
+	if isFileNotFound(err) {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		f.s.logger.Error("List Error", zap.String("prefix", prefix), f.s.errField(err))
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (f *FileStorage) listDir(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	dirURL := f.dirURL(prefix)
+	keys := make([]string, 0)
+	for marker := (azfile.Marker{}); marker.NotDone(); {
+		ls, err := dirURL.ListFilesAndDirectoriesSegment(ctx, marker, azfile.ListFilesAndDirectoriesOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range ls.FileItems {
+			keys = append(keys, path.Join(prefix, unescapeKey(v.Name)))
+		}
+		for _, v := range ls.DirectoryItems {
+			key := path.Join(prefix, unescapeKey(v.Name))
+			if !recursive {
+				keys = append(keys, key)
+				continue
+			}
+			below, err := f.listDir(ctx, key, true)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, below...)
+		}
+		marker = ls.NextMarker
+	}
+	return keys, nil
+}
+
+// Lock creates the lock directory of key, which only one instance can. As
+// Azure Files has no leases, the holder refreshes its expiry in the
+// directory's metadata and a lock that wasn't refreshed for lock_timeout
+// is taken over.
+func (f *FileStorage) Lock(ctx context.Context, key string) (err error) {
+	defer f.s.observe("lock", time.Now(), &err)
+
+	lockKey := path.Join("locks", key+".lock")
+	dirURL := f.dirURL(lockKey)
+
+	var deadline <-chan time.Time
+	if f.s.LockWaitTimeout > 0 {
+		timer := time.NewTimer(time.Duration(f.s.LockWaitTimeout))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	start := time.Now()
+	var attempts int
+	for {
+		attempts++
+		created, err := f.createLockDir(ctx, dirURL, lockKey)
+		if err != nil {
+			f.s.logger.Error("Lock Error", zap.String("key", key), f.s.errField(err))
+			return err
+		}
+		if created {
+			break
+		}
+		if attempts == 1 {
+			observeLockContended()
+		}
+
+		holder := f.lockHolder(ctx, dirURL)
+		if holder.stale() {
+			f.s.logger.Warn("Lock Stale", zap.String("key", key), zap.String("holder", holder.owner))
+			if err := f.breakLock(ctx, dirURL, holder); err != nil {
+				f.s.logger.Error("Lock Error", zap.String("key", key), f.s.errField(err))
+				return err
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-f.s.ctx.Done():
+			return f.s.ctx.Err()
+		case <-deadline:
+			f.s.logger.Error("Lock Error",
+				zap.String("key", key),
+				zap.String("holder", holder.owner),
+				zap.Duration("waited", time.Since(start)),
+				zap.Int("attempts", attempts),
+				zap.String("err", ErrLockTimeout.Error()))
+			return fmt.Errorf("%w: %s", ErrLockTimeout, key)
+		case <-time.After(f.s.lockPollInterval()):
+		}
+	}
+	observeLockWait(time.Since(start))
+
+	lock := &fileLock{dirURL: dirURL, stop: make(chan struct{}), done: make(chan struct{})}
+	f.locksMu.Lock()
+	f.locks[key] = lock
+	f.locksMu.Unlock()
+
+	go f.keepLockAlive(key, lock)
+	return nil
+}
+
+func (f *FileStorage) Unlock(ctx context.Context, key string) (err error) {
+	f.locksMu.Lock()
+	lock, ok := f.locks[key]
+	delete(f.locks, key)
+	f.locksMu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("lock %s is not held by this instance", key)
+	}
+
+	close(lock.stop)
+	<-lock.done
+
+	ctx, cancel := f.s.withTimeout(ctx, f.s.LockRequestTimeout)
+	defer cancel()
+
+	_, err = lock.dirURL.Delete(ctx)
+	if isFileNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		f.s.logger.Error("Unlock Error", zap.String("key", key), f.s.errField(err))
+	}
+	return err
+}
+
+// lockMetadata records this instance as holder until lock_timeout from
+// now.
+func (f *FileStorage) lockMetadata() azfile.Metadata {
+	return azfile.Metadata{
+		metadataLockOwner:   f.s.uuid,
+		metadataLockExpires: time.Now().UTC().Add(f.s.lockTimeout()).Format(time.RFC3339),
+	}
+}
+
+// createLockDir tries to create the lock directory once, reporting false if
+// it exists. A waiter that read the stale holder before this instance
+// replaced it may still delete the directory right after it was created,
+// so it is only reported as created if it is read back with the metadata
+// it was created with.
+func (f *FileStorage) createLockDir(ctx context.Context, dirURL azfile.DirectoryURL, lockKey string) (bool, error) {
+	ctx, cancel := f.s.withTimeout(ctx, f.s.LockRequestTimeout)
+	defer cancel()
+
+	metadata := f.lockMetadata()
+	_, err := dirURL.Create(ctx, metadata, azfile.SMBProperties{})
+	if fileServiceCode(err) == azfile.ServiceCodeParentNotFound {
+		if err = f.createDirs(ctx, path.Dir(f.filePath(lockKey))); err == nil {
+			_, err = dirURL.Create(ctx, metadata, azfile.SMBProperties{})
+		}
+	}
+	if fileServiceCode(err) == azfile.ServiceCodeResourceAlreadyExists {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	props, err := dirURL.GetProperties(ctx)
+	if isFileNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	current := props.NewMetadata()
+	return current[metadataLockOwner] == metadata[metadataLockOwner] &&
+		current[metadataLockExpires] == metadata[metadataLockExpires], nil
+}
+
+// lockHolder reads who holds the lock directory, zero if it couldn't be
+// read.
+func (f *FileStorage) lockHolder(ctx context.Context, dirURL azfile.DirectoryURL) lockHolder {
+	ctx, cancel := f.s.withTimeout(ctx, f.s.LockRequestTimeout)
+	defer cancel()
+
+	props, err := dirURL.GetProperties(ctx)
+	if err != nil {
+		return lockHolder{}
+	}
+	metadata := props.NewMetadata()
+	expires, _ := time.Parse(time.RFC3339, metadata[metadataLockExpires])
+	return lockHolder{owner: metadata[metadataLockOwner], expires: expires}
+}
+
+// breakLock removes a stale lock directory, including anything another
+// implementation left in it. Another waiter may have broken the lock and
+// taken it since its holder was read, so the directory is left alone
+// unless it still has the same owner and expiry.
+func (f *FileStorage) breakLock(ctx context.Context, dirURL azfile.DirectoryURL, holder lockHolder) error {
+	ctx, cancel := f.s.withTimeout(ctx, f.s.LockRequestTimeout)
+	defer cancel()
+
+	if current := f.lockHolder(ctx, dirURL); current.owner != holder.owner || !current.expires.Equal(holder.expires) {
+		return nil
+	}
+	err := f.deleteDir(ctx, dirURL)
+	if isFileNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// keepLockAlive refreshes the expiry of the lock until it is released or
+// the storage is closed.
+func (f *FileStorage) keepLockAlive(key string, lock *fileLock) {
+	defer close(lock.done)
+
+	ticker := time.NewTicker(f.s.lockTimeout() / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-f.s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := withTimeout(f.s.ctx, f.s.LockRequestTimeout)
+		_, err := lock.dirURL.SetMetadata(ctx, f.lockMetadata())
+		cancel()
+		if err != nil {
+			f.s.logger.Error("Lock Renew Error", zap.String("key", key), f.s.errField(err))
+		}
+	}
+}
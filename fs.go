@@ -0,0 +1,174 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// FS returns a read-only view of the storage as a file system, e.g. for
+// fs.WalkDir or http.FS. Keys are files and the prefixes between their
+// slashes directories. It also implements fs.ReadDirFS, fs.ReadFileFS and
+// fs.StatFS, and makes its requests with ctx.
+func (s *Storage) FS(ctx context.Context) fs.FS {
+	return storageFS{s: s, ctx: ctx}
+}
+
+type storageFS struct {
+	s   *Storage
+	ctx context.Context
+}
+
+// Open opens the key or directory name.
+func (f storageFS) Open(name string) (fs.File, error) {
+	info, err := f.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		entries, err := f.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &storageDir{info: info, entries: entries}, nil
+	}
+
+	value, err := f.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &storageFile{info: info, Reader: bytes.NewReader(value)}, nil
+}
+
+// Stat returns the file info of the key or directory name.
+func (f storageFS) Stat(name string) (fs.FileInfo, error) {
+	return f.stat("stat", name)
+}
+
+func (f storageFS) stat(op, name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return keyFileInfo{certmagic.KeyInfo{Key: "."}}, nil
+	}
+
+	info, err := f.s.Stat(f.ctx, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return keyFileInfo{info}, nil
+}
+
+// ReadFile returns the value of the key name.
+func (f storageFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+	value, err := f.s.Load(f.ctx, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return value, nil
+}
+
+// ReadDir lists the directory name, sorted by file name. Every entry is
+// stat'ed to tell keys and directories apart.
+func (f storageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	prefix := name
+	if name == "." {
+		prefix = ""
+	}
+
+	keys, err := f.s.List(f.ctx, prefix, false)
+	if errors.Is(err, fs.ErrNotExist) && name == "." {
+		return []fs.DirEntry{}, nil
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(keys))
+	for _, key := range keys {
+		info, err := f.s.Stat(f.ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(keyFileInfo{info}))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// keyFileInfo is the fs.FileInfo of a key, whose Sys is the
+// certmagic.KeyInfo.
+type keyFileInfo struct {
+	info certmagic.KeyInfo
+}
+
+func (i keyFileInfo) Name() string       { return path.Base(i.info.Key) }
+func (i keyFileInfo) Size() int64        { return i.info.Size }
+func (i keyFileInfo) ModTime() time.Time { return i.info.Modified }
+func (i keyFileInfo) IsDir() bool        { return !i.info.IsTerminal }
+func (i keyFileInfo) Sys() interface{}   { return i.info }
+
+func (i keyFileInfo) Mode() fs.FileMode {
+	if i.IsDir() {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// storageFile is an opened key, read from memory.
+type storageFile struct {
+	info fs.FileInfo
+	*bytes.Reader
+}
+
+func (f *storageFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *storageFile) Close() error               { return nil }
+
+// storageDir is an opened directory.
+type storageDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *storageDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *storageDir) Close() error               { return nil }
+
+func (d *storageDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries, or all remaining ones if n <= 0.
+func (d *storageDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
@@ -0,0 +1,212 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// defaultGCRetention keeps expired artifacts around for a while, e.g.
+	// to debug a renewal that failed.
+	defaultGCRetention = 7 * 24 * time.Hour
+
+	// gcLockKey makes sure only one instance collects at a time.
+	gcLockKey = "azblob_gc"
+	// gcLockWait is how long a collection waits for another instance's.
+	gcLockWait = 10 * time.Second
+
+	gcArchivePrefix = "archive"
+)
+
+// GCResult counts what a garbage collection found.
+type GCResult struct {
+	Scanned int
+	Expired int
+	Removed int
+}
+
+// collectGarbage runs a collection every GCInterval until the storage is
+// closed.
+func (s *Storage) collectGarbage() {
+	ticker := time.NewTicker(time.Duration(s.GCInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		res, err := s.CollectGarbage(s.ctx)
+		if err != nil {
+			s.logger.Error("Garbage Collection Error", s.errField(err))
+			continue
+		}
+		s.logger.Info("Garbage collection finished",
+			zap.Int("scanned", res.Scanned),
+			zap.Int("expired", res.Expired),
+			zap.Int("removed", res.Removed),
+			zap.Bool("dry_run", s.GCDryRun))
+	}
+}
+
+// CollectGarbage removes certificates and OCSP staples that expired more
+// than the retention ago. Certificates are removed together with their key
+// and metadata. With GCArchive they are moved below archive/ instead, with
+// GCDryRun they are only logged.
+func (s *Storage) CollectGarbage(ctx context.Context) (GCResult, error) {
+	lockCtx, cancel := context.WithTimeout(ctx, gcLockWait)
+	err := s.Lock(lockCtx, gcLockKey)
+	cancel()
+	if err != nil {
+		return GCResult{}, fmt.Errorf("another instance is collecting: %v", err)
+	}
+	defer s.Unlock(context.Background(), gcLockKey)
+
+	cutoff := time.Now().Add(-s.gcRetention())
+	var res GCResult
+
+	// Keys are collected a page at a time, so large stores are never held
+	// in memory at once.
+	err = s.walkKeys(ctx, "certificates", func(certs []string) error {
+		for _, key := range certs {
+			if path.Ext(key) != ".crt" {
+				continue
+			}
+			res.Scanned++
+
+			expires, err := s.artifactExpiry(ctx, key, certificateExpiry)
+			if err != nil {
+				s.logger.Warn("Garbage Collection Skipped", zap.String("key", key), s.errField(err))
+				continue
+			}
+			if expires.After(cutoff) {
+				continue
+			}
+
+			res.Expired++
+			base := strings.TrimSuffix(key, ".crt")
+			for _, ext := range []string{".crt", ".key", ".json"} {
+				if s.removeArtifact(ctx, base+ext, expires) {
+					res.Removed++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return res, err
+	}
+
+	err = s.walkKeys(ctx, "ocsp", func(staples []string) error {
+		for _, key := range staples {
+			res.Scanned++
+
+			expires, err := s.artifactExpiry(ctx, key, stapleExpiry)
+			if err != nil {
+				s.logger.Warn("Garbage Collection Skipped", zap.String("key", key), s.errField(err))
+				continue
+			}
+			if expires.After(cutoff) {
+				continue
+			}
+
+			res.Expired++
+			if s.removeArtifact(ctx, key, expires) {
+				res.Removed++
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return res, err
+	}
+	return res, nil
+}
+
+func (s *Storage) gcRetention() time.Duration {
+	if s.GCRetention > 0 {
+		return time.Duration(s.GCRetention)
+	}
+	return defaultGCRetention
+}
+
+// artifactExpiry loads key and parses its expiry with parse.
+func (s *Storage) artifactExpiry(ctx context.Context, key string, parse func([]byte) (time.Time, error)) (time.Time, error) {
+	value, err := s.Load(ctx, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parse(value)
+}
+
+// certificateExpiry is the end of validity of the leaf of a PEM chain.
+func certificateExpiry(value []byte) (time.Time, error) {
+	block, _ := pem.Decode(value)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return time.Time{}, fmt.Errorf("no PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// stapleExpiry is when a DER encoded OCSP response must be refreshed.
+func stapleExpiry(value []byte) (time.Time, error) {
+	resp, err := ocsp.ParseResponse(value, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if resp.NextUpdate.IsZero() {
+		return time.Time{}, fmt.Errorf("OCSP response has no next update time")
+	}
+	return resp.NextUpdate, nil
+}
+
+// removeArtifact deletes, archives or, on a dry run, logs an expired key,
+// reporting whether it was removed.
+func (s *Storage) removeArtifact(ctx context.Context, key string, expired time.Time) bool {
+	fields := []zap.Field{zap.String("key", key), zap.Time("expired", expired)}
+	if s.GCDryRun {
+		s.logger.Info("Garbage collection would remove expired key", fields...)
+		return false
+	}
+
+	if s.GCArchive {
+		value, err := s.Load(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false
+		}
+		if err == nil {
+			err = s.Store(ctx, path.Join(gcArchivePrefix, key), value)
+		}
+		if err != nil {
+			s.logger.Error("Garbage Collection Error", append(fields, s.errField(err))...)
+			return false
+		}
+	}
+
+	err := s.Delete(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		s.logger.Error("Garbage Collection Error", append(fields, s.errField(err))...)
+		return false
+	}
+	s.logger.Info("Garbage collection removed expired key", fields...)
+	return true
+}
@@ -0,0 +1,43 @@
+package certmagic_azblob
+
+import (
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// defaultContentType is used for keys whose type isn't known from the
+// certmagic key layout.
+const defaultContentType = "application/octet-stream"
+
+// contentTypes maps the extensions of certmagic keys to their content.
+var contentTypes = map[string]string{
+	".crt":  "application/pem-certificate-chain",
+	".key":  "application/x-pem-file",
+	".json": "application/json",
+}
+
+// contentType returns the Content-Type key is stored with.
+func (s *Storage) contentType(key string) string {
+	if strings.HasPrefix(key, "ocsp/") {
+		// Staples are stored as raw DER.
+		return "application/ocsp-response"
+	}
+	if t, ok := contentTypes[path.Ext(key)]; ok {
+		return t
+	}
+	if s.ContentType != "" {
+		return s.ContentType
+	}
+	return defaultContentType
+}
+
+// blobHeaders returns the HTTP headers key is stored with.
+func (s *Storage) blobHeaders(key, encoding string) azblob.BlobHTTPHeaders {
+	return azblob.BlobHTTPHeaders{
+		ContentType:     s.contentType(key),
+		ContentEncoding: encoding,
+		CacheControl:    s.CacheControl,
+	}
+}
@@ -0,0 +1,94 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// HealthStatus is the result of the last health check of a Storage.
+type HealthStatus struct {
+	Container string    `json:"container"`
+	Prefix    string    `json:"prefix,omitempty"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	Checked   time.Time `json:"checked"`
+}
+
+// CheckHealth verifies that the container can be reached and that a probe
+// blob can be written, read back and deleted with the configured
+// credentials. The result is also kept for Health.
+func (s *Storage) CheckHealth(ctx context.Context) error {
+	err := s.checkHealth(ctx)
+
+	status := HealthStatus{
+		Container: s.ContainerName,
+		Prefix:    s.Prefix,
+		Healthy:   err == nil,
+		Checked:   time.Now(),
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	s.healthMu.Lock()
+	s.health = status
+	s.healthMu.Unlock()
+	return err
+}
+
+// Health returns the result of the last CheckHealth.
+func (s *Storage) Health() HealthStatus {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	return s.health
+}
+
+func (s *Storage) checkHealth(ctx context.Context) error {
+	if err := s.checkConnection(ctx); err != nil {
+		return healthError("reading the container", err)
+	}
+
+	key := path.Join("healthcheck", s.uuid)
+	value := []byte(s.uuid)
+	if err := s.Store(ctx, key, value); err != nil {
+		return healthError("writing a probe blob", err)
+	}
+
+	loaded, err := s.Load(ctx, key)
+	if err != nil {
+		return healthError("reading the probe blob", err)
+	}
+	if !bytes.Equal(loaded, value) {
+		return fmt.Errorf("health check: probe blob %s was read back with different content", s.blobName(key))
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		return healthError("deleting the probe blob", err)
+	}
+	return nil
+}
+
+// healthError adds a hint on how to fix the common causes of a failed step.
+func healthError(step string, err error) error {
+	var hint string
+	var serr azblob.StorageError
+	if errors.As(err, &serr) && serr.Response() != nil {
+		switch serr.Response().StatusCode {
+		case http.StatusForbidden:
+			hint = "the credentials need read, write, delete and list permissions on the container"
+		case http.StatusNotFound:
+			hint = "the container does not exist, create it or set create_container"
+		}
+	}
+	if hint == "" {
+		return fmt.Errorf("health check failed %s: %v", step, err)
+	}
+	return fmt.Errorf("health check failed %s (%s): %v", step, hint, err)
+}
@@ -0,0 +1,62 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// metadataIsFolder marks the blobs that stand for directories on accounts
+// with a hierarchical namespace.
+const metadataIsFolder = "hdi_isfolder"
+
+func isFolder(metadata azblob.Metadata) bool {
+	return strings.EqualFold(metadata[metadataIsFolder], "true")
+}
+
+// isDirectoryNotEmpty reports whether err is caused by deleting a directory
+// that still has children on a hierarchical namespace account.
+func isDirectoryNotEmpty(err error) bool {
+	switch serviceCode(err) {
+	case "DirectoryNotEmpty", "DirectoryIsNotEmpty":
+		return true
+	}
+	return false
+}
+
+// deleteFolders removes the directory of key and the directories below it,
+// deepest first, once the blobs in them have been deleted.
+func (s *Storage) deleteFolders(ctx context.Context, key string) error {
+	c := s.container(key)
+	dir := s.blobName(strings.TrimSuffix(key, "/"))
+
+	names := []string{dir}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		ls, err := c.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Details: azblob.BlobListingDetails{Metadata: true},
+			Prefix:  dir + "/",
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, v := range ls.Segment.BlobItems {
+			if isFolder(v.Metadata) {
+				names = append(names, v.Name)
+			}
+		}
+		marker = ls.NextMarker
+	}
+
+	// Children sort after their parent.
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		_, err := c.NewBlobURL(name).Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Hook is called around every Store and Delete, e.g. to audit writes,
+// mirror them elsewhere or invalidate a cache. The Before methods run in
+// order and an error aborts the write with it, the After methods get the
+// result of the write.
+//
+// In Caddy, hooks are modules in the caddy.storage.azblob.hooks namespace.
+type Hook interface {
+	BeforeStore(ctx context.Context, key string, value []byte) error
+	AfterStore(ctx context.Context, key string, value []byte, err error)
+	BeforeDelete(ctx context.Context, key string) error
+	AfterDelete(ctx context.Context, key string, err error)
+}
+
+func (s *Storage) beforeStore(ctx context.Context, key string, value []byte) error {
+	for _, h := range s.Hooks {
+		if err := h.BeforeStore(ctx, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) afterStore(ctx context.Context, key string, value []byte, err error) {
+	for _, h := range s.Hooks {
+		h.AfterStore(ctx, key, value, err)
+	}
+}
+
+func (s *Storage) beforeDelete(ctx context.Context, key string) error {
+	for _, h := range s.Hooks {
+		if err := h.BeforeDelete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) afterDelete(ctx context.Context, key string, err error) {
+	for _, h := range s.Hooks {
+		h.AfterDelete(ctx, key, err)
+	}
+}
+
+func init() {
+	caddy.RegisterModule(LogHook{})
+	caddy.RegisterModule(ProtectHook{})
+}
+
+// LogHook is the caddy.storage.azblob.hooks.log module, an audit log of
+// every write at info level.
+type LogHook struct {
+	logger *zap.Logger
+}
+
+func (LogHook) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.azblob.hooks.log",
+		New: func() caddy.Module { return new(LogHook) },
+	}
+}
+
+func (h *LogHook) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+	return nil
+}
+
+func (h *LogHook) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func (h *LogHook) BeforeStore(ctx context.Context, key string, value []byte) error { return nil }
+
+func (h *LogHook) AfterStore(ctx context.Context, key string, value []byte, err error) {
+	h.log("Stored", key, err, zap.Int("size", len(value)))
+}
+
+func (h *LogHook) BeforeDelete(ctx context.Context, key string) error { return nil }
+
+func (h *LogHook) AfterDelete(ctx context.Context, key string, err error) {
+	h.log("Deleted", key, err)
+}
+
+func (h *LogHook) log(msg, key string, err error, fields ...zap.Field) {
+	fields = append(fields, zap.String("key", key))
+	if err != nil {
+		h.logger.Info(msg+" failed", append(fields, zap.Error(err))...)
+		return
+	}
+	h.logger.Info(msg, fields...)
+}
+
+// ProtectHook is the caddy.storage.azblob.hooks.protect module, refusing
+// to delete keys below any of its prefixes, e.g. to keep expired
+// certificates that certmagic would clean up.
+type ProtectHook struct {
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+func (ProtectHook) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.azblob.hooks.protect",
+		New: func() caddy.Module { return new(ProtectHook) },
+	}
+}
+
+func (h *ProtectHook) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	h.Prefixes = append(h.Prefixes, d.RemainingArgs()...)
+	if len(h.Prefixes) == 0 {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func (h *ProtectHook) BeforeStore(ctx context.Context, key string, value []byte) error { return nil }
+
+func (h *ProtectHook) AfterStore(ctx context.Context, key string, value []byte, err error) {}
+
+func (h *ProtectHook) BeforeDelete(ctx context.Context, key string) error {
+	for _, prefix := range h.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return fmt.Errorf("%w: %s is protected by %s", fs.ErrPermission, key, prefix)
+		}
+	}
+	return nil
+}
+
+func (h *ProtectHook) AfterDelete(ctx context.Context, key string, err error) {}
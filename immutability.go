@@ -0,0 +1,39 @@
+package certmagic_azblob
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+func (s *Storage) validateImmutability() error {
+	switch strings.ToLower(s.ImmutabilityMode) {
+	case "", "unlocked", "locked":
+	default:
+		return fmt.Errorf("invalid immutability_mode %q, must be unlocked or locked", s.ImmutabilityMode)
+	}
+	if s.ImmutabilityMode != "" && s.ImmutabilityPeriod <= 0 {
+		return fmt.Errorf("immutability_mode requires immutability_period")
+	}
+	return nil
+}
+
+// immutabilityPolicy returns the retention settings for a blob written now.
+func (s *Storage) immutabilityPolicy() azblob.ImmutabilityPolicyOptions {
+	var o azblob.ImmutabilityPolicyOptions
+	if s.ImmutabilityPeriod > 0 {
+		until := time.Now().Add(time.Duration(s.ImmutabilityPeriod)).UTC()
+		o.ImmutabilityPolicyUntilDate = &until
+		o.ImmutabilityPolicyMode = azblob.BlobImmutabilityPolicyModeUnlocked
+		if strings.EqualFold(s.ImmutabilityMode, "locked") {
+			o.ImmutabilityPolicyMode = azblob.BlobImmutabilityPolicyModeLocked
+		}
+	}
+	if s.LegalHold {
+		hold := true
+		o.LegalHold = &hold
+	}
+	return o
+}
@@ -0,0 +1,53 @@
+//go:build integration
+
+package certmagic_azblob
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/google/uuid"
+)
+
+// The integration tests run the storage contract against Azurite:
+//
+//	azurite-blob --inMemoryPersistence &
+//	go test -tags integration ./...
+//
+// AZURITE_BLOB_ENDPOINT points them to another instance than the default
+// http://127.0.0.1:10000/devstoreaccount1.
+
+func newIntegrationStorage(t *testing.T, container string) *Storage {
+	t.Helper()
+	endpoint := os.Getenv("AZURITE_BLOB_ENDPOINT")
+	if endpoint == "" {
+		endpoint = devStoreBlobURL
+	}
+
+	s, err := New(Options{
+		Emulator:         true,
+		Endpoint:         endpoint,
+		ContainerName:    container,
+		LockPollInterval: caddy.Duration(100 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.checkConnection(s.ctx); err != nil {
+		t.Fatalf("Azurite is not reachable at %s: %v", endpoint, err)
+	}
+	return s
+}
+
+func TestIntegrationContract(t *testing.T) {
+	container := "integration-" + uuid.NewString()
+	s := newIntegrationStorage(t, container)
+	other := newIntegrationStorage(t, container)
+	t.Cleanup(func() { s.containerURL.Delete(s.ctx, azblob.ContainerAccessConditions{}) })
+
+	testContract(t, s, other)
+}
@@ -0,0 +1,77 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+)
+
+// escapeKey maps a certmagic key to a blob name that Azure and the tools
+// working on the container keep as it is. Characters with a special meaning
+// in URLs or globs, control characters and "%" are percent-encoded, and so
+// are trailing dots of path segments, which Azure strips and which turn
+// "." and ".." segments into path traversals.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = escapeSegment(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func escapeSegment(segment string) string {
+	trimmed := strings.TrimRight(segment, ".")
+
+	var b strings.Builder
+	for i := 0; i < len(trimmed); i++ {
+		c := trimmed[i]
+		if c < 0x20 || c == 0x7f || strings.IndexByte(`%*?#\`, c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	b.WriteString(strings.Repeat("%2E", len(segment)-len(trimmed)))
+	return b.String()
+}
+
+// unescapeKey is the inverse of escapeKey. Names that aren't valid escapes
+// were written before keys were escaped and are returned as they are.
+func unescapeKey(name string) string {
+	key, err := url.PathUnescape(name)
+	if err != nil {
+		return name
+	}
+	return key
+}
+
+// legacyBlobURL returns the blob key was stored under before keys were
+// escaped, if that differs from its current name.
+func (s *Storage) legacyBlobURL(key string) (azblob.BlockBlobURL, bool) {
+	name := key
+	if s.Prefix != "" {
+		name = s.Prefix + "/" + key
+	}
+	if name == s.blobName(key) {
+		return azblob.BlockBlobURL{}, false
+	}
+	return s.container(key).NewBlockBlobURL(name), true
+}
+
+// removeLegacyBlob deletes the unescaped blob of key once its value has
+// been stored under the escaped name.
+func (s *Storage) removeLegacyBlob(ctx context.Context, key string) {
+	blobURL, ok := s.legacyBlobURL(key)
+	if !ok {
+		return
+	}
+
+	_, err := blobURL.Delete(ctx, s.deleteSnapshots(), azblob.BlobAccessConditions{})
+	if err != nil && !isNotFound(err) {
+		s.logger.Warn("Removing unescaped blob failed", zap.String("key", key), s.errField(err))
+	}
+}
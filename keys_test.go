@@ -0,0 +1,37 @@
+package certmagic_azblob
+
+import "testing"
+
+func TestEscapeKey(t *testing.T) {
+	for _, tt := range []struct {
+		key  string
+		want string
+	}{
+		{"", ""},
+		{"certificates/acme/example.com/example.com.crt", "certificates/acme/example.com/example.com.crt"},
+		{"certificates/acme/*.example.com/*.example.com.key", "certificates/acme/%2A.example.com/%2A.example.com.key"},
+		{"100%", "100%25"},
+		{"a?b#c\\d", "a%3Fb%23c%5Cd"},
+		{"line\nbreak\x7f", "line%0Abreak%7F"},
+		{"../dir./.", "%2E%2E/dir%2E/%2E"},
+		{"a.b/c", "a.b/c"},
+	} {
+		got := escapeKey(tt.key)
+		if got != tt.want {
+			t.Errorf("escapeKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+		if key := unescapeKey(got); key != tt.key {
+			t.Errorf("unescapeKey(%q) = %q, want %q", got, key, tt.key)
+		}
+	}
+}
+
+func TestUnescapeKeyLegacy(t *testing.T) {
+	// Names written before keys were escaped are kept unless they happen
+	// to be valid escapes.
+	for _, name := range []string{"100%", "a%zzb", "plain/name.crt"} {
+		if got := unescapeKey(name); got != name {
+			t.Errorf("unescapeKey(%q) = %q, want it unchanged", name, got)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+)
+
+const defaultAccountKeyRefresh = time.Hour
+
+func (s *Storage) newKeyVaultClient(vaultURI string) (*azsecrets.Client, error) {
+	// The vault is reached with the machine identity, unless an Azure AD auth
+	// mode was configured explicitly in which case that identity is reused.
+	mode := s.authMode()
+	if mode == AuthModeSharedKey || mode == AuthModeSAS {
+		mode = AuthModeDefault
+	}
+
+	cred, err := s.newAzureADCredential(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return azsecrets.NewClient(vaultURI, cred, &azsecrets.ClientOptions{ClientOptions: s.clientOptions()})
+}
+
+func fetchSecret(ctx context.Context, client *azsecrets.Client, name string) (string, error) {
+	resp, err := client.GetSecret(ctx, name, "", nil)
+	if err != nil {
+		return "", fmt.Errorf("fetching secret %s from key vault: %v", name, err)
+	}
+
+	if resp.Value == nil || *resp.Value == "" {
+		return "", fmt.Errorf("key vault secret %s is empty", name)
+	}
+
+	return *resp.Value, nil
+}
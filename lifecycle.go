@@ -0,0 +1,141 @@
+package certmagic_azblob
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// tagExpires is the index tag lifecycle_tags adds to certificates and OCSP
+// staples, their expiry in UTC like 2026-10-14T12:00:00Z.
+const tagExpires = "expires"
+
+// Days after their last modification that the lifecycle policy deletes
+// keys, on top of gc_retention. Certificates and their keys are rewritten
+// on every renewal, so one that wasn't for longer than the longest
+// validity of a public certificate is expired, and so is a staple unchanged
+// for longer than the longest validity of an OCSP response. Lock blobs are
+// rewritten on every lease renewal.
+const (
+	lifecycleCertificateDays = 398
+	lifecycleStapleDays      = 10
+	lifecycleLockDays        = 1
+)
+
+// lifecycleTags returns the index tags of blobTags, plus the expiry parsed
+// from the value of certificates and OCSP staples.
+func lifecycleTags(key string, value []byte) azblob.BlobTagsMap {
+	tags := blobTags(key)
+	if tags == nil {
+		return nil
+	}
+
+	var parse func([]byte) (time.Time, error)
+	switch {
+	case tags[tagType] == "certificate" && path.Ext(key) == ".crt":
+		parse = certificateExpiry
+	case tags[tagType] == "ocsp":
+		parse = stapleExpiry
+	}
+	if parse != nil {
+		if expires, err := parse(value); err == nil {
+			tags[tagExpires] = expires.UTC().Format(time.RFC3339)
+		}
+	}
+	return tags
+}
+
+// Management policy of the storage account, as applied with
+// az storage account management-policy create --policy @policy.json.
+type lifecyclePolicy struct {
+	Rules []lifecycleRule `json:"rules"`
+}
+
+type lifecycleRule struct {
+	Enabled    bool                `json:"enabled"`
+	Name       string              `json:"name"`
+	Type       string              `json:"type"`
+	Definition lifecycleDefinition `json:"definition"`
+}
+
+type lifecycleDefinition struct {
+	Filters struct {
+		BlobTypes      []string             `json:"blobTypes"`
+		PrefixMatch    []string             `json:"prefixMatch"`
+		BlobIndexMatch []lifecycleTagFilter `json:"blobIndexMatch,omitempty"`
+	} `json:"filters"`
+	Actions struct {
+		BaseBlob struct {
+			Delete struct {
+				DaysAfterModificationGreaterThan int `json:"daysAfterModificationGreaterThan"`
+			} `json:"delete"`
+		} `json:"baseBlob"`
+	} `json:"actions"`
+}
+
+type lifecycleTagFilter struct {
+	Name  string `json:"name"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// LifecyclePolicy returns a lifecycle management policy for the account
+// that deletes expired certificates, keys and staples written with
+// lifecycle_tags, and abandoned lock blobs, from the containers and below
+// the prefixes of s and its tenants. ACME accounts are never deleted.
+func (s *Storage) LifecyclePolicy() ([]byte, error) {
+	if !s.LifecycleTags {
+		return nil, fmt.Errorf("lifecycle_tags is not enabled, the blobs have no tags for the policy to match")
+	}
+
+	retention := int((s.gcRetention() + 24*time.Hour - 1) / (24 * time.Hour))
+	rules := []lifecycleRule{
+		s.lifecycleRule("certificates", "certificate", lifecycleCertificateDays+retention),
+		s.lifecycleRule("certificates", "key", lifecycleCertificateDays+retention),
+		s.lifecycleRule("certificates", "metadata", lifecycleCertificateDays+retention),
+		s.lifecycleRule("ocsp", "ocsp", lifecycleStapleDays+retention),
+		s.lifecycleRule("locks", "", lifecycleLockDays),
+	}
+	return json.MarshalIndent(lifecyclePolicy{Rules: rules}, "", "  ")
+}
+
+// lifecycleRule deletes the blobs below the class directory that have the
+// given type tag after days, or every blob below it without a type.
+func (s *Storage) lifecycleRule(class, typ string, days int) lifecycleRule {
+	name := "caddy-" + class
+	if typ != "" && typ != class {
+		name += "-" + typ
+	}
+	r := lifecycleRule{Enabled: true, Name: name, Type: "Lifecycle"}
+	r.Definition.Filters.BlobTypes = []string{"blockBlob"}
+	seen := make(map[string]bool)
+	for _, p := range s.lifecyclePrefixes(class) {
+		if !seen[p] {
+			seen[p] = true
+			r.Definition.Filters.PrefixMatch = append(r.Definition.Filters.PrefixMatch, p)
+		}
+	}
+	if typ != "" {
+		r.Definition.Filters.BlobIndexMatch = []lifecycleTagFilter{{Name: tagType, Op: "==", Value: typ}}
+	}
+	r.Definition.Actions.BaseBlob.Delete.DaysAfterModificationGreaterThan = days
+	return r
+}
+
+// lifecyclePrefixes returns the container and blob prefix the keys of the
+// class directory are stored below, for s and each of its tenants.
+func (s *Storage) lifecyclePrefixes(class string) []string {
+	name := s.blobName(class + "/")
+	if class == "locks" {
+		name = strings.TrimSuffix(s.lockBlobName(""), ".lock")
+	}
+	prefixes := []string{s.shardFor(class+"/").name + "/" + name}
+	for _, t := range s.tenants {
+		prefixes = append(prefixes, t.storage.lifecyclePrefixes(class)...)
+	}
+	return prefixes
+}
@@ -0,0 +1,498 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	// Azure grants finite leases of 15 to 60 seconds, the longest is the
+	// default. Infinite leases are only kept alive through the lock expiry.
+	minLockLeaseDuration     = 15 * time.Second
+	defaultLockLeaseDuration = 60 * time.Second
+	infiniteLockLease        = -1
+
+	// defaultLockPollInterval matches certmagic's file storage.
+	defaultLockPollInterval = time.Second
+
+	// lockContentionLogInterval is how often a Lock that keeps waiting logs
+	// the holder again.
+	lockContentionLogInterval = 30 * time.Second
+
+	// defaultLockTimeout leaves room for a couple of missed renewals
+	// before a lock counts as abandoned.
+	defaultLockTimeout = 2 * time.Minute
+
+	// Metadata of lock blobs, recording which instance holds the lock and
+	// until when it is valid without a refresh.
+	metadataLockOwner   = "caddylockowner"
+	metadataLockHost    = "caddylockhost"
+	metadataLockExpires = "caddylockexpires"
+)
+
+// heldLock is a lease on a lock blob held by this instance, kept alive by a
+// renewal goroutine until Unlock.
+type heldLock struct {
+	blobURL azblob.BlobURL
+	leaseID string
+	created time.Time
+	stop    chan struct{}
+	done    chan struct{}
+
+	// stolen is set by the renewal before it closes done once the lease
+	// was lost.
+	stolen bool
+}
+
+// lockMeta is the content of a lock blob, the JSON certmagic's file storage
+// writes into its lock files plus the instance holding the lock, so other
+// implementations sharing or migrating the container can read it.
+type lockMeta struct {
+	Created  time.Time `json:"created,omitempty"`
+	Updated  time.Time `json:"updated,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	Host     string    `json:"host,omitempty"`
+}
+
+// lockBlobName returns the blob holding the lease for a lock key, laid out
+// like certmagic's file storage does unless LocksPrefix is set.
+func (s *Storage) lockBlobName(key string) string {
+	if s.LocksPrefix != "" {
+		return s.LocksPrefix + "/" + escapeKey(key+".lock")
+	}
+	return s.blobName(path.Join("locks", key+".lock"))
+}
+
+// isLockBlob reports whether the blob name is below LocksPrefix.
+func (s *Storage) isLockBlob(name string) bool {
+	return s.LocksPrefix != "" && strings.HasPrefix(name, s.LocksPrefix+"/")
+}
+
+// Lock acquires a lease on the lock blob of key, waiting until it is
+// released by its current holder or ctx is done.
+func (s *Storage) Lock(ctx context.Context, key string) (err error) {
+	if t := s.tenantFor(key); t != nil {
+		return t.Lock(ctx, key)
+	}
+	defer s.observe("lock", time.Now(), &err)
+	ctx, span, err := s.startSpan(ctx, "lock", key)
+	defer endSpan(span, &err)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Debug("Lock", zap.String("key", key))
+
+	if s.failover != nil {
+		defer func() {
+			if s.useFailover(ctx, err) {
+				s.logger.Warn("Lock failing over", zap.String("key", key), s.errField(err))
+				err = s.failover.Lock(ctx, key)
+			}
+		}()
+	}
+
+	blobURL := s.container("locks").NewBlobURL(s.lockBlobName(key))
+	if err := s.ensureLockBlob(ctx, blobURL.ToBlockBlobURL()); err != nil {
+		s.logger.Error("Lock Error", zap.String("key", key), s.errField(err))
+		return err
+	}
+
+	var deadline <-chan time.Time
+	if s.LockWaitTimeout > 0 {
+		timer := time.NewTimer(time.Duration(s.LockWaitTimeout))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	// Every acquisition gets its own lease ID so two callers in this
+	// process don't share a lease.
+	leaseID := uuid.NewString()
+	start := time.Now()
+	var attempts int
+	var lastLogged time.Time
+	for {
+		attempts++
+		acquired, err := s.acquireLease(ctx, blobURL, leaseID)
+		if isNotFound(err) {
+			// A lifecycle rule deleted the lock blob since it was ensured.
+			err = s.ensureLockBlob(ctx, blobURL.ToBlockBlobURL())
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			s.logger.Error("Lock Error", zap.String("key", key), s.errField(err))
+			return err
+		}
+		if acquired {
+			break
+		}
+
+		holder := s.lockHolder(ctx, blobURL)
+		if attempts == 1 {
+			observeLockContended()
+		}
+		if time.Since(lastLogged) >= lockContentionLogInterval {
+			s.logger.Info("Lock Contended",
+				zap.String("key", key),
+				zap.String("holder", holder.owner),
+				zap.Duration("waited", time.Since(start)),
+				zap.Int("attempts", attempts))
+			lastLogged = time.Now()
+		}
+
+		if holder.stale() {
+			s.logger.Warn("Lock Stale", zap.String("key", key), zap.String("holder", holder.owner))
+			err := s.breakLease(ctx, blobURL, holder.etag)
+			if err == nil {
+				continue
+			}
+			// Another waiter broke the lock and took it since its holder
+			// was read, the new holder is not stale.
+			if !isConditionNotMet(err) {
+				s.logger.Error("Lock Error", zap.String("key", key), s.errField(err))
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		case <-s.closing:
+			return context.Canceled
+		case <-deadline:
+			s.logger.Error("Lock Error",
+				zap.String("key", key),
+				zap.String("holder", holder.owner),
+				zap.Duration("waited", time.Since(start)),
+				zap.Int("attempts", attempts),
+				zap.String("err", ErrLockTimeout.Error()))
+			return fmt.Errorf("%w: %s", ErrLockTimeout, key)
+		case <-time.After(s.lockPollInterval()):
+		}
+	}
+
+	observeLockWait(time.Since(start))
+	if attempts > 1 {
+		s.logger.Info("Lock Acquired",
+			zap.String("key", key),
+			zap.Duration("waited", time.Since(start)),
+			zap.Int("attempts", attempts))
+	}
+
+	lock := &heldLock{
+		blobURL: blobURL,
+		leaseID: leaseID,
+		created: time.Now(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if err := s.touchLock(ctx, lock); err != nil {
+		s.logger.Error("Lock Error", zap.String("key", key), s.errField(err))
+		lock.blobURL.ReleaseLease(ctx, leaseID, azblob.ModifiedAccessConditions{})
+		return err
+	}
+
+	s.locksMu.Lock()
+	s.locks[key] = lock
+	s.locksMu.Unlock()
+
+	go s.keepLockAlive(key, lock)
+	return nil
+}
+
+func (s *Storage) Unlock(ctx context.Context, key string) (err error) {
+	if t := s.tenantFor(key); t != nil {
+		return t.Unlock(ctx, key)
+	}
+	ctx, span, err := s.startSpan(ctx, "unlock", key)
+	defer endSpan(span, &err)
+	if err != nil {
+		return err
+	}
+	return s.unlock(ctx, key)
+}
+
+// unlock is Unlock without tracking it as an operation, for Close to
+// release the locks after it waited for them.
+func (s *Storage) unlock(ctx context.Context, key string) (err error) {
+	s.logger.Debug("Unlock", zap.String("key", key))
+
+	s.locksMu.Lock()
+	lock, ok := s.locks[key]
+	delete(s.locks, key)
+	s.locksMu.Unlock()
+
+	if !ok && s.failover != nil {
+		return s.failover.Unlock(ctx, key)
+	}
+	if !ok {
+		return fmt.Errorf("lock %s is not held by this instance", key)
+	}
+
+	close(lock.stop)
+	<-lock.done
+	if lock.stolen {
+		return fmt.Errorf("%w: %s", ErrLockStolen, key)
+	}
+
+	ctx, cancel := s.withTimeout(ctx, s.LockRequestTimeout)
+	defer cancel()
+
+	_, err = lock.blobURL.ReleaseLease(ctx, lock.leaseID, azblob.ModifiedAccessConditions{})
+	if isLeaseLost(err) {
+		s.logger.Error("Lock Stolen", zap.String("key", key), s.errField(err))
+		return fmt.Errorf("%w: %s", ErrLockStolen, key)
+	}
+	if err != nil {
+		s.logger.Error("Unlock Error", zap.String("key", key), s.errField(err))
+	}
+	return err
+}
+
+// ensureLockBlob creates the empty lock blob unless it already exists.
+func (s *Storage) ensureLockBlob(ctx context.Context, blobURL azblob.BlockBlobURL) error {
+	ctx, cancel := s.withTimeout(ctx, s.LockRequestTimeout)
+	defer cancel()
+
+	ac := azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny},
+	}
+	_, err := blobURL.Upload(ctx, bytes.NewReader(nil), azblob.BlobHTTPHeaders{}, azblob.Metadata{}, ac, azblob.DefaultAccessTier, nil, s.cpk, azblob.ImmutabilityPolicyOptions{})
+	// A leased lock blob rejects the write before checking the condition.
+	if isAlreadyExists(err) || serviceCode(err) == azblob.ServiceCodeLeaseIDMissing {
+		return nil
+	}
+	return err
+}
+
+// acquireLease tries to take the lease once, reporting false if another
+// holder has it.
+func (s *Storage) acquireLease(ctx context.Context, blobURL azblob.BlobURL, leaseID string) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx, s.LockRequestTimeout)
+	defer cancel()
+
+	_, err := blobURL.AcquireLease(ctx, leaseID, s.lockLeaseSeconds(), azblob.ModifiedAccessConditions{})
+	switch serviceCode(err) {
+	case "":
+		return err == nil, err
+	case azblob.ServiceCodeLeaseAlreadyPresent, azblob.ServiceCodeLeaseIsBreakingAndCannotBeAcquired:
+		return false, nil
+	}
+	return false, err
+}
+
+// keepLockAlive renews the lease until the lock is released or the storage
+// is closed.
+func (s *Storage) keepLockAlive(key string, lock *heldLock) {
+	defer close(lock.done)
+
+	ticker := time.NewTicker(s.lockRenewInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var err error
+		if s.lockLeaseSeconds() != infiniteLockLease {
+			ctx, cancel := withTimeout(s.ctx, s.LockRequestTimeout)
+			_, err = lock.blobURL.RenewLease(ctx, lock.leaseID, azblob.ModifiedAccessConditions{})
+			cancel()
+		}
+		if err == nil {
+			err = s.touchLock(s.ctx, lock)
+		}
+		if isLeaseLost(err) {
+			s.logger.Error("Lock Stolen", zap.String("key", key), s.errField(err))
+			lock.stolen = true
+			return
+		}
+		if err != nil {
+			s.logger.Error("Lock Renew Error", zap.String("key", key), s.errField(err))
+		}
+	}
+}
+
+// lockPollInterval spreads out the retries of instances waiting on the same
+// lock.
+func (s *Storage) lockPollInterval() time.Duration {
+	interval := defaultLockPollInterval
+	if s.LockPollInterval > 0 {
+		interval = time.Duration(s.LockPollInterval)
+	}
+	return interval + time.Duration(rand.Int63n(int64(interval)/2+1))
+}
+
+// validateLockLeaseDuration checks lock_lease_duration against the leases
+// Azure accepts, negative durations request an infinite lease.
+func (s *Storage) validateLockLeaseDuration() error {
+	d := time.Duration(s.LockLeaseDuration)
+	if d > 0 && (d < minLockLeaseDuration || d > defaultLockLeaseDuration || d%time.Second != 0) {
+		return fmt.Errorf("lock_lease_duration must be whole seconds between %s and %s, or infinite", minLockLeaseDuration, defaultLockLeaseDuration)
+	}
+	return nil
+}
+
+// lockLeaseSeconds is the lease duration requested from Azure.
+func (s *Storage) lockLeaseSeconds() int32 {
+	switch d := time.Duration(s.LockLeaseDuration); {
+	case d < 0:
+		return infiniteLockLease
+	case d == 0:
+		return int32(defaultLockLeaseDuration / time.Second)
+	default:
+		return int32(d / time.Second)
+	}
+}
+
+// lockRenewInterval renews leases well before they run out. Infinite leases
+// are refreshed as often as the default lease to keep their expiry current.
+func (s *Storage) lockRenewInterval() time.Duration {
+	if seconds := s.lockLeaseSeconds(); seconds > 0 {
+		return time.Duration(seconds) * time.Second / 3
+	}
+	return defaultLockLeaseDuration / 3
+}
+
+func (s *Storage) lockTimeout() time.Duration {
+	if s.LockTimeout > 0 {
+		return time.Duration(s.LockTimeout)
+	}
+	return defaultLockTimeout
+}
+
+// touchLock records this instance as owner of the lock and pushes its
+// expiry lock_timeout into the future, in the metadata and as lockMeta.
+func (s *Storage) touchLock(ctx context.Context, lock *heldLock) error {
+	ctx, cancel := s.withTimeout(ctx, s.LockRequestTimeout)
+	defer cancel()
+
+	now := time.Now().UTC()
+	body, err := json.Marshal(lockMeta{Created: lock.created.UTC(), Updated: now, Instance: s.uuid, Host: s.hostname})
+	if err != nil {
+		return err
+	}
+
+	metadata := azblob.Metadata{
+		metadataLockOwner:   s.uuid,
+		metadataLockHost:    s.hostname,
+		metadataLockExpires: now.Add(s.lockTimeout()).Format(time.RFC3339),
+	}
+	ac := azblob.BlobAccessConditions{
+		LeaseAccessConditions: azblob.LeaseAccessConditions{LeaseID: lock.leaseID},
+	}
+	headers := azblob.BlobHTTPHeaders{ContentType: "application/json"}
+	_, err = lock.blobURL.ToBlockBlobURL().Upload(ctx, bytes.NewReader(body), headers, metadata, ac, azblob.DefaultAccessTier, nil, s.cpk, azblob.ImmutabilityPolicyOptions{})
+	return err
+}
+
+// lockHolder is the owner, its host and the expiry recorded in a lock
+// blob, zero if it couldn't be read, and the ETag of the blob they were
+// read from.
+type lockHolder struct {
+	owner   string
+	host    string
+	expires time.Time
+	etag    azblob.ETag
+}
+
+// stale reports whether the holder of a lock stopped refreshing it, e.g.
+// because it hung while its lease kept being renewed. Locks without a
+// readable expiry are never considered stale.
+func (h lockHolder) stale() bool {
+	return !h.expires.IsZero() && time.Now().After(h.expires)
+}
+
+// lockHolder reads who holds the lock blob at blobURL. Lock blobs written
+// without the metadata, e.g. by another implementation, are read as
+// lockMeta and expire lock_timeout after their last update.
+func (s *Storage) lockHolder(ctx context.Context, blobURL azblob.BlobURL) lockHolder {
+	ctx, cancel := s.withTimeout(ctx, s.LockRequestTimeout)
+	defer cancel()
+
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, s.cpk)
+	if err != nil {
+		return lockHolder{}
+	}
+
+	metadata := props.NewMetadata()
+	if expires, err := time.Parse(time.RFC3339, metadata[metadataLockExpires]); err == nil {
+		return lockHolder{owner: metadata[metadataLockOwner], host: metadata[metadataLockHost], expires: expires, etag: props.ETag()}
+	}
+	if props.ContentLength() == 0 {
+		return lockHolder{owner: metadata[metadataLockOwner], host: metadata[metadataLockHost], etag: props.ETag()}
+	}
+
+	ac := azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: props.ETag()},
+	}
+	get, err := blobURL.Download(ctx, 0, 0, ac, false, s.cpk)
+	if err != nil {
+		return lockHolder{}
+	}
+	body := get.Body(s.retryReaderOptions())
+	defer body.Close()
+
+	var meta lockMeta
+	if err := json.NewDecoder(io.LimitReader(body, 4096)).Decode(&meta); err != nil {
+		return lockHolder{}
+	}
+	updated := meta.Updated
+	if updated.IsZero() {
+		updated = meta.Created
+	}
+	if updated.IsZero() {
+		return lockHolder{owner: meta.Instance, host: meta.Host, etag: props.ETag()}
+	}
+	return lockHolder{owner: meta.Instance, host: meta.Host, expires: updated.Add(s.lockTimeout()), etag: props.ETag()}
+}
+
+// breakLease ends the lease of a stale lock immediately, unless the lock
+// blob no longer has the ETag its holder was read with, which fails as
+// isConditionNotMet.
+func (s *Storage) breakLease(ctx context.Context, blobURL azblob.BlobURL, etag azblob.ETag) error {
+	ctx, cancel := s.withTimeout(ctx, s.LockRequestTimeout)
+	defer cancel()
+
+	_, err := blobURL.BreakLease(ctx, 0, azblob.ModifiedAccessConditions{IfMatch: etag})
+	if serviceCode(err) == azblob.ServiceCodeLeaseNotPresentWithLeaseOperation {
+		return nil
+	}
+	return err
+}
+
+// leaseBreakPolicy sends the break period of lease breaks, which
+// BlobURL.BreakLease drops, so Azure breaks the lease right away instead
+// of letting it run out. Like the API version it is signed.
+func leaseBreakPolicy() pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			if request.Header.Get("x-ms-lease-action") == "break" && request.Header.Get("x-ms-lease-break-period") == "" {
+				request.Header.Set("x-ms-lease-break-period", "0")
+			}
+			return next.Do(ctx, request)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestLockTakesOverStaleLock(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStorage(t)
+	putLockBlob(t, s, "key", "crashed", "elsewhere", time.Now().Add(-time.Minute), true)
+
+	// The lease is broken right away rather than left to run out.
+	lockCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := s.Lock(lockCtx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unlock(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBreakLeaseOfChangedHolder(t *testing.T) {
+	ctx := context.Background()
+	container := "test-" + uuid.NewString()
+	s := newMemoryContainerStorage(t, container)
+	other := newMemoryContainerStorage(t, container)
+	putLockBlob(t, s, "key", "crashed", "elsewhere", time.Now().Add(-time.Minute), true)
+
+	// s reads the stale holder, then other takes the lock over first.
+	blobURL := s.container("locks").NewBlobURL(s.lockBlobName("key"))
+	holder := s.lockHolder(ctx, blobURL)
+	if !holder.stale() {
+		t.Fatalf("holder %+v is not stale", holder)
+	}
+	if err := other.Lock(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.breakLease(ctx, blobURL, holder.etag); !isConditionNotMet(err) {
+		t.Fatalf("breaking the lease of the previous holder: expected ConditionNotMet, got %v", err)
+	}
+	if err := other.Unlock(ctx, "key"); err != nil {
+		t.Fatalf("lock of the new holder was broken: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+)
+
+// loadInstanceFile remembers the instance ID the previous run persisted in
+// InstanceFile and replaces it with this one's.
+func (s *Storage) loadInstanceFile() error {
+	prev, err := os.ReadFile(s.InstanceFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	s.prevUUID = strings.TrimSpace(string(prev))
+	return os.WriteFile(s.InstanceFile, []byte(s.uuid+"\n"), 0o600)
+}
+
+// orphaned reports whether a lock was left behind by a previous run of this
+// instance, identified by the ID in InstanceFile or else by the hostname,
+// or whether its holder stopped refreshing it. Locks of the storages of
+// this process are never orphaned: on a config reload the old config's
+// storage still holds them, and it shares the hostname and the previous
+// ID in InstanceFile. Leased locks of previous runs are left to expire,
+// as they may still be renewed by a run that didn't stop.
+func (s *Storage) orphaned(h lockHolder, leased bool) bool {
+	switch {
+	case h.owner == s.uuid || provisionedInstance(h.owner):
+		return false
+	case h.stale():
+		return true
+	case leased:
+		return false
+	case s.InstanceFile != "":
+		return s.prevUUID != "" && h.owner == s.prevUUID
+	default:
+		return s.hostname != "" && h.host == s.hostname
+	}
+}
+
+// CleanupLocks removes the lock blobs of previous runs of this instance and
+// stale ones, so locks a crashed instance left behind don't hold up its own
+// renewals after a restart. It returns how many it removed.
+func (s *Storage) CleanupLocks(ctx context.Context) (int, error) {
+	if s.NoList {
+		return 0, ErrListUnsupported
+	}
+
+	c := s.container("locks")
+	prefix := s.blobName("locks") + "/"
+	if s.LocksPrefix != "" {
+		prefix = s.LocksPrefix + "/"
+	}
+
+	var removed int
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listCtx, cancel := s.withTimeout(ctx, s.ListTimeout)
+		ls, err := c.ListBlobsFlatSegment(listCtx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		cancel()
+		if err != nil {
+			return removed, err
+		}
+
+		for _, v := range ls.Segment.BlobItems {
+			if !strings.HasSuffix(v.Name, ".lock") {
+				continue
+			}
+			blobURL := c.NewBlobURL(v.Name)
+			leased := v.Properties.LeaseState == azblob.LeaseStateLeased
+			holder := s.lockHolder(ctx, blobURL)
+			if !s.orphaned(holder, leased) {
+				continue
+			}
+
+			err := s.removeLockBlob(ctx, blobURL, leased, holder.etag)
+			if isConditionNotMet(err) {
+				// Someone took the lock since its holder was read.
+				continue
+			}
+			if err != nil {
+				s.logger.Warn("Lock Cleanup Error", zap.String("blob", v.Name), s.errField(err))
+				continue
+			}
+			s.logger.Info("Removed orphaned lock", zap.String("blob", v.Name), zap.String("holder", holder.owner), zap.String("host", holder.host))
+			removed++
+		}
+		marker = ls.NextMarker
+	}
+	return removed, nil
+}
+
+// removeLockBlob deletes a lock blob that still has the given ETag,
+// breaking its lease first if leased.
+func (s *Storage) removeLockBlob(ctx context.Context, blobURL azblob.BlobURL, leased bool, etag azblob.ETag) error {
+	if leased {
+		if err := s.breakLease(ctx, blobURL, etag); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := s.withTimeout(ctx, s.LockRequestTimeout)
+	defer cancel()
+
+	ac := azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: etag},
+	}
+	_, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, ac)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/google/uuid"
+)
+
+// putLockBlob writes the lock blob of key as a run with the given owner and
+// host would have left it, leased or not.
+func putLockBlob(t *testing.T, s *Storage, key, owner, host string, expires time.Time, leased bool) {
+	t.Helper()
+	ctx := context.Background()
+	blobURL := s.container("locks").NewBlockBlobURL(s.lockBlobName(key))
+	metadata := azblob.Metadata{
+		metadataLockOwner:   owner,
+		metadataLockHost:    host,
+		metadataLockExpires: expires.UTC().Format(time.RFC3339),
+	}
+	_, err := blobURL.Upload(ctx, bytes.NewReader(nil), azblob.BlobHTTPHeaders{}, metadata, azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil, s.cpk, azblob.ImmutabilityPolicyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leased {
+		if _, err := blobURL.AcquireLease(ctx, uuid.NewString(), 60, azblob.ModifiedAccessConditions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func lockBlobExists(t *testing.T, s *Storage, key string) bool {
+	t.Helper()
+	blobURL := s.container("locks").NewBlobURL(s.lockBlobName(key))
+	_, err := blobURL.GetProperties(context.Background(), azblob.BlobAccessConditions{}, s.cpk)
+	if err != nil && !isNotFound(err) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestCleanupLocks(t *testing.T) {
+	ctx := context.Background()
+	container := "test-" + uuid.NewString()
+
+	// The storage of the config being replaced holds a lock.
+	live := newMemoryContainerStorage(t, container)
+	registerStorage(live)
+	t.Cleanup(func() { unregisterStorage(live) })
+	if err := live.Lock(ctx, "live"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newMemoryContainerStorage(t, container)
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+	putLockBlob(t, s, "crashed", "previous", s.hostname, future, false)
+	putLockBlob(t, s, "leased", "previous", s.hostname, future, true)
+	putLockBlob(t, s, "stale", "other", "elsewhere", past, false)
+	putLockBlob(t, s, "stale-leased", "other", "elsewhere", past, true)
+	putLockBlob(t, s, "fresh", "other", "elsewhere", future, false)
+	putLockBlob(t, s, "live-stale", live.uuid, s.hostname, past, false)
+
+	removed, err := s.CleanupLocks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("removed %d locks, expected 3", removed)
+	}
+	for key, kept := range map[string]bool{
+		"live":         true,
+		"crashed":      false,
+		"leased":       true,
+		"stale":        false,
+		"stale-leased": false,
+		"fresh":        true,
+		"live-stale":   true,
+	} {
+		if lockBlobExists(t, s, key) != kept {
+			t.Errorf("lock %s kept: %v, expected %v", key, !kept, kept)
+		}
+	}
+
+	if err := live.Unlock(ctx, "live"); err != nil {
+		t.Fatalf("live lock was broken: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package certmagic_azblob
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// newLogger applies log_level to the configured logger. Levels below the
+// level of the parent logger are still dropped by it.
+func (s *Storage) newLogger() (*zap.Logger, error) {
+	logger := s.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if s.LogLevel == "" {
+		return logger, nil
+	}
+
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(s.LogLevel)); err != nil {
+		return nil, fmt.Errorf("invalid log_level %q", s.LogLevel)
+	}
+	return logger.WithOptions(zap.IncreaseLevel(level)), nil
+}
+
+// errField logs err with secrets the SDK includes in its error messages
+// removed. Storage errors dump the failed request, which redacts the
+// Authorization header and SAS signatures but not customer-provided keys.
+func (s *Storage) errField(err error) zap.Field {
+	return zap.String("err", s.redact(err.Error()))
+}
+
+func (s *Storage) redact(msg string) string {
+	if s.EncryptionKey != "" {
+		msg = strings.ReplaceAll(msg, s.EncryptionKey, "REDACTED")
+	}
+	return msg
+}
+
+// sdkLogOptions routes the SDK's request, response and retry logs to the
+// debug log when DebugHTTP is set. The SDK redacts the Authorization header
+// and SAS signatures itself.
+func (s *Storage) sdkLogOptions() pipeline.LogOptions {
+	if !s.DebugHTTP {
+		return pipeline.LogOptions{}
+	}
+
+	logger := s.logger.Named("http")
+	return pipeline.LogOptions{
+		Log: func(level pipeline.LogLevel, message string) {
+			logger.Debug("Azure SDK",
+				zap.String("sdk_level", sdkLevel(level)),
+				zap.String("message", s.redact(strings.TrimSpace(message))))
+		},
+		ShouldLog: func(level pipeline.LogLevel) bool {
+			return logger.Core().Enabled(zapcore.DebugLevel)
+		},
+	}
+}
+
+func sdkLevel(level pipeline.LogLevel) string {
+	switch level {
+	case pipeline.LogPanic, pipeline.LogFatal, pipeline.LogError:
+		return "error"
+	case pipeline.LogWarning:
+		return "warn"
+	case pipeline.LogInfo:
+		return "info"
+	}
+	return "debug"
+}
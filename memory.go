@@ -0,0 +1,888 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// memoryScheme as container_name, e.g. memory:// or memory://staging,
+	// keeps the keys in memory instead of an Azure container.
+	memoryScheme = "memory://"
+
+	memoryEndpoint         = "http://memory"
+	memoryAccountName      = "memory"
+	defaultMemoryContainer = "caddy"
+
+	memoryMaxResults = 5000
+)
+
+// memoryBlobs is the in-memory blob service of the process. Storages with
+// the same memory:// container share its keys and locks, also across
+// config reloads, but nothing survives the process.
+var memoryBlobs = &memoryService{containers: make(map[string]*memoryContainer)}
+
+// useMemory points s at memoryBlobs instead of Azure. The credentials and
+// endpoint are replaced, all other options apply as configured, so the
+// whole storage runs against the blob REST API as it would on Azure.
+func (s *Storage) useMemory() {
+	s.memory = true
+	s.ContainerName = strings.TrimPrefix(s.ContainerName, memoryScheme)
+	if s.ContainerName == "" {
+		s.ContainerName = defaultMemoryContainer
+	}
+
+	s.AuthMode = AuthModeSharedKey
+	s.AccountName = memoryAccountName
+	s.AccountKey = devStoreAccountKey
+	s.AccountKeyFile = ""
+	s.AccountKeyVaultURI = ""
+	s.ConnectionString = ""
+	s.SASURL, s.ContainerSASURL, s.SASToken, s.SASTokenFile = "", "", "", ""
+	s.BlobHost = ""
+	s.Endpoint = memoryEndpoint
+	s.Emulator = false
+	s.InsecureAllowHTTP = true
+	s.CreateContainer = true
+}
+
+// memoryService implements the subset of the blob REST API the storage
+// uses as an http.RoundTripper. Requests for anything else fail like an
+// Azure error would.
+type memoryService struct {
+	mu         sync.Mutex
+	containers map[string]*memoryContainer
+	lastETag   int64
+}
+
+type memoryContainer struct {
+	etag     string
+	modified time.Time
+	blobs    map[string]*memoryBlob
+	// blocks are the staged blocks of a blob by name and block ID.
+	blocks map[string]map[string][]byte
+}
+
+type memoryBlob struct {
+	blobType string
+	data     []byte
+	md5      []byte
+	headers  http.Header
+	metadata map[string]string
+	tier     string
+	etag     string
+	created  time.Time
+	modified time.Time
+	blocks   int
+
+	leaseID       string
+	leaseState    string
+	leaseInfinite bool
+	leaseDuration time.Duration
+	leaseExpires  time.Time
+	breakAt       time.Time
+}
+
+// memoryHeaders are the HTTP headers stored with a blob, by the request
+// header that sets them.
+var memoryHeaders = map[string]string{
+	"x-ms-blob-content-type":        "Content-Type",
+	"x-ms-blob-content-encoding":    "Content-Encoding",
+	"x-ms-blob-content-language":    "Content-Language",
+	"x-ms-blob-content-disposition": "Content-Disposition",
+	"x-ms-blob-cache-control":       "Cache-Control",
+}
+
+// memoryError is the body of an error response.
+type memoryError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeMemoryError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	body, _ := xml.Marshal(memoryError{Code: code, Message: code})
+	w.Write(append([]byte(xml.Header), body...))
+}
+
+func (m *memoryService) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	rec := httptest.NewRecorder()
+	m.serve(rec, req)
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+func (m *memoryService) serve(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("x-ms-request-id", uuid.NewString())
+	w.Header().Set("x-ms-version", req.Header.Get("x-ms-version"))
+	w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			writeMemoryError(w, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+	}
+	if want := req.Header.Get("Content-MD5"); want != "" {
+		if sum := md5.Sum(body); base64.StdEncoding.EncodeToString(sum[:]) != want {
+			writeMemoryError(w, http.StatusBadRequest, "Md5Mismatch")
+			return
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := req.URL.Query()
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	if len(parts) == 1 || parts[1] == "" {
+		if q.Get("restype") != "container" {
+			writeMemoryError(w, http.StatusBadRequest, "UnsupportedQueryParameter")
+			return
+		}
+		m.serveContainer(w, req, parts[0])
+		return
+	}
+
+	c, ok := m.containers[parts[0]]
+	if !ok {
+		writeMemoryError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	// The service keeps no snapshots or versions.
+	if q.Get("versionid") != "" || q.Get("snapshot") != "" {
+		writeMemoryError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	m.serveBlob(w, req, c, parts[1], body)
+}
+
+func (m *memoryService) serveContainer(w http.ResponseWriter, req *http.Request, name string) {
+	c, ok := m.containers[name]
+	q := req.URL.Query()
+	switch {
+	case req.Method == http.MethodPut && q.Get("comp") == "":
+		if ok {
+			writeMemoryError(w, http.StatusConflict, "ContainerAlreadyExists")
+			return
+		}
+		c = &memoryContainer{
+			etag:     m.nextETag(),
+			modified: time.Now().UTC(),
+			blobs:    make(map[string]*memoryBlob),
+			blocks:   make(map[string]map[string][]byte),
+		}
+		m.containers[name] = c
+		setMemoryModified(w, c.etag, c.modified)
+		w.WriteHeader(http.StatusCreated)
+	case !ok:
+		writeMemoryError(w, http.StatusNotFound, "ContainerNotFound")
+	case req.Method == http.MethodDelete && q.Get("comp") == "":
+		delete(m.containers, name)
+		w.WriteHeader(http.StatusAccepted)
+	case (req.Method == http.MethodGet || req.Method == http.MethodHead) && q.Get("comp") == "":
+		setMemoryModified(w, c.etag, c.modified)
+		w.Header().Set("x-ms-lease-state", "available")
+		w.Header().Set("x-ms-lease-status", "unlocked")
+		w.WriteHeader(http.StatusOK)
+	case req.Method == http.MethodGet && q.Get("comp") == "list":
+		m.list(w, req, name, c)
+	default:
+		writeMemoryError(w, http.StatusBadRequest, "UnsupportedQueryParameter")
+	}
+}
+
+// nextETag returns a new, ever increasing ETag.
+func (m *memoryService) nextETag() string {
+	n := time.Now().UnixNano()
+	if n <= m.lastETag {
+		n = m.lastETag + 1
+	}
+	m.lastETag = n
+	return fmt.Sprintf("\"0x%X\"", n)
+}
+
+func setMemoryModified(w http.ResponseWriter, etag string, modified time.Time) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+}
+
+func (m *memoryService) serveBlob(w http.ResponseWriter, req *http.Request, c *memoryContainer, name string, body []byte) {
+	b := c.blobs[name]
+	if b != nil {
+		b.expireLease()
+	}
+	q := req.URL.Query()
+	comp := q.Get("comp")
+
+	switch {
+	case (req.Method == http.MethodGet || req.Method == http.MethodHead) && comp == "":
+		m.read(w, req, b)
+		return
+	case req.Method == http.MethodPut && comp == "block":
+		id := q.Get("blockid")
+		if id == "" {
+			writeMemoryError(w, http.StatusBadRequest, "InvalidQueryParameterValue")
+			return
+		}
+		if c.blocks[name] == nil {
+			c.blocks[name] = make(map[string][]byte)
+		}
+		c.blocks[name][id] = body
+		w.WriteHeader(http.StatusCreated)
+		return
+	case req.Method == http.MethodPut && comp == "lease":
+		m.lease(w, req, b)
+		return
+	}
+
+	// Everything else writes to the blob, which checks the lease if there
+	// is one before any other condition.
+	creates := req.Method == http.MethodPut && (comp == "" || comp == "blocklist")
+	if b == nil && !creates {
+		writeMemoryError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	if status, code := checkMemoryLease(req, b); status != 0 {
+		writeMemoryError(w, status, code)
+		return
+	}
+	if status, code := checkMemoryConditions(req, b, true); status != 0 {
+		writeMemoryError(w, status, code)
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodPut && comp == "" && req.Header.Get("x-ms-copy-source") != "":
+		m.copy(w, req, c, name, b)
+	case req.Method == http.MethodPut && comp == "":
+		blobType := req.Header.Get("x-ms-blob-type")
+		if blobType != "BlockBlob" && blobType != "AppendBlob" {
+			writeMemoryError(w, http.StatusBadRequest, "InvalidBlobType")
+			return
+		}
+		if blobType == "AppendBlob" {
+			body = nil
+		}
+		b = m.put(req, c, name, b, blobType, body)
+		if blobType == "BlockBlob" && b.md5 == nil {
+			sum := md5.Sum(body)
+			b.md5 = sum[:]
+		}
+		m.written(w, b)
+	case req.Method == http.MethodPut && comp == "blocklist":
+		var list struct {
+			Committed   []string `xml:"Committed"`
+			Uncommitted []string `xml:"Uncommitted"`
+			Latest      []string `xml:"Latest"`
+		}
+		if err := xml.Unmarshal(body, &list); err != nil || len(list.Committed)+len(list.Uncommitted) > 0 {
+			writeMemoryError(w, http.StatusBadRequest, "InvalidBlockList")
+			return
+		}
+		var data []byte
+		for _, id := range list.Latest {
+			block, ok := c.blocks[name][id]
+			if !ok {
+				writeMemoryError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		b = m.put(req, c, name, b, "BlockBlob", data)
+		b.blocks = len(list.Latest)
+		m.written(w, b)
+	case req.Method == http.MethodDelete && comp == "":
+		delete(c.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == http.MethodPut && comp == "undelete":
+		// Nothing is soft deleted, an existing blob stays as it is.
+		w.WriteHeader(http.StatusOK)
+	case req.Method == http.MethodPut && comp == "snapshot":
+		w.Header().Set("x-ms-snapshot", time.Now().UTC().Format("2006-01-02T15:04:05.0000000Z"))
+		setMemoryModified(w, b.etag, b.modified)
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodPut && comp == "appendblock":
+		if b.blobType != "AppendBlob" {
+			writeMemoryError(w, http.StatusConflict, "InvalidBlobType")
+			return
+		}
+		w.Header().Set("x-ms-blob-append-offset", strconv.Itoa(len(b.data)))
+		b.data = append(b.data, body...)
+		b.blocks++
+		m.touch(b)
+		w.Header().Set("x-ms-blob-committed-block-count", strconv.Itoa(b.blocks))
+		setMemoryModified(w, b.etag, b.modified)
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodPut && comp == "metadata":
+		b.metadata = memoryMetadata(req.Header)
+		m.touch(b)
+		setMemoryModified(w, b.etag, b.modified)
+		w.WriteHeader(http.StatusOK)
+	case req.Method == http.MethodPut && comp == "properties":
+		b.headers, b.md5 = memoryBlobHeaders(req.Header)
+		m.touch(b)
+		setMemoryModified(w, b.etag, b.modified)
+		w.WriteHeader(http.StatusOK)
+	case req.Method == http.MethodPut && comp == "tier":
+		// Rehydration completes right away.
+		b.tier = req.Header.Get("x-ms-access-tier")
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeMemoryError(w, http.StatusBadRequest, "UnsupportedQueryParameter")
+	}
+}
+
+// put replaces the blob name with data, keeping its lease.
+func (m *memoryService) put(req *http.Request, c *memoryContainer, name string, old *memoryBlob, blobType string, data []byte) *memoryBlob {
+	b := &memoryBlob{
+		blobType:   blobType,
+		data:       data,
+		metadata:   memoryMetadata(req.Header),
+		tier:       req.Header.Get("x-ms-access-tier"),
+		created:    time.Now().UTC(),
+		leaseState: "available",
+	}
+	if b.tier == "" {
+		b.tier = "Hot"
+	}
+	b.headers, b.md5 = memoryBlobHeaders(req.Header)
+	if old != nil {
+		b.created = old.created
+		b.leaseID, b.leaseState, b.leaseInfinite = old.leaseID, old.leaseState, old.leaseInfinite
+		b.leaseDuration, b.leaseExpires, b.breakAt = old.leaseDuration, old.leaseExpires, old.breakAt
+	}
+	m.touch(b)
+	c.blobs[name] = b
+	// Writing a blob discards the blocks staged for it.
+	delete(c.blocks, name)
+	return b
+}
+
+func (m *memoryService) touch(b *memoryBlob) {
+	b.etag = m.nextETag()
+	b.modified = time.Now().UTC()
+}
+
+func (m *memoryService) written(w http.ResponseWriter, b *memoryBlob) {
+	setMemoryModified(w, b.etag, b.modified)
+	if b.md5 != nil {
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(b.md5))
+	}
+	w.Header().Set("x-ms-request-server-encrypted", "true")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func memoryMetadata(h http.Header) map[string]string {
+	md := make(map[string]string)
+	for k, v := range h {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-ms-meta-") {
+			md[strings.TrimPrefix(k, "x-ms-meta-")] = v[0]
+		}
+	}
+	return md
+}
+
+func memoryBlobHeaders(h http.Header) (http.Header, []byte) {
+	headers := make(http.Header)
+	for from, to := range memoryHeaders {
+		if v := h.Get(from); v != "" {
+			headers.Set(to, v)
+		}
+	}
+	sum, _ := base64.StdEncoding.DecodeString(h.Get("x-ms-blob-content-md5"))
+	if len(sum) == 0 {
+		sum = nil
+	}
+	return headers, sum
+}
+
+// read serves the properties or, for GET, the content of b.
+func (m *memoryService) read(w http.ResponseWriter, req *http.Request, b *memoryBlob) {
+	if b == nil {
+		writeMemoryError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	if status, code := checkMemoryConditions(req, b, false); status != 0 {
+		if status == http.StatusNotModified {
+			setMemoryModified(w, b.etag, b.modified)
+			w.WriteHeader(status)
+			return
+		}
+		writeMemoryError(w, status, code)
+		return
+	}
+	if req.Method == http.MethodGet && b.tier == "Archive" {
+		writeMemoryError(w, http.StatusConflict, "BlobArchived")
+		return
+	}
+
+	h := w.Header()
+	for k, v := range b.headers {
+		h[k] = v
+	}
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+	for k, v := range b.metadata {
+		h.Set("x-ms-meta-"+k, v)
+	}
+	setMemoryModified(w, b.etag, b.modified)
+	h.Set("x-ms-creation-time", b.created.Format(http.TimeFormat))
+	h.Set("x-ms-blob-type", b.blobType)
+	h.Set("x-ms-server-encrypted", "true")
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("x-ms-lease-state", b.leaseState)
+	h.Set("x-ms-lease-status", "unlocked")
+	if b.leaseState == "leased" {
+		h.Set("x-ms-lease-status", "locked")
+		h.Set("x-ms-lease-duration", "fixed")
+		if b.leaseInfinite {
+			h.Set("x-ms-lease-duration", "infinite")
+		}
+	}
+	if b.blobType == "AppendBlob" {
+		h.Set("x-ms-blob-committed-block-count", strconv.Itoa(b.blocks))
+	}
+
+	if req.Method == http.MethodHead {
+		h.Set("x-ms-access-tier", b.tier)
+		h.Set("Content-Length", strconv.Itoa(len(b.data)))
+		if b.md5 != nil {
+			h.Set("Content-MD5", base64.StdEncoding.EncodeToString(b.md5))
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rng := req.Header.Get("x-ms-range")
+	if rng == "" {
+		rng = req.Header.Get("Range")
+	}
+	if rng == "" {
+		h.Set("Content-Length", strconv.Itoa(len(b.data)))
+		if b.md5 != nil {
+			h.Set("Content-MD5", base64.StdEncoding.EncodeToString(b.md5))
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(b.data)
+		return
+	}
+
+	start, end, ok := parseMemoryRange(rng, len(b.data))
+	if !ok {
+		writeMemoryError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+		return
+	}
+	if b.md5 != nil {
+		h.Set("x-ms-blob-content-md5", base64.StdEncoding.EncodeToString(b.md5))
+	}
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(b.data)))
+	h.Set("Content-Length", strconv.Itoa(end-start))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(b.data[start:end])
+}
+
+// parseMemoryRange parses "bytes=<start>-[<end>]" into a half-open range of
+// a blob of size bytes.
+func parseMemoryRange(rng string, size int) (int, int, bool) {
+	bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.Atoi(bounds[0])
+	if err != nil || start < 0 || start >= size && size > 0 {
+		return 0, 0, false
+	}
+	end := size
+	if bounds[1] != "" {
+		last, err := strconv.Atoi(bounds[1])
+		if err != nil || last < start {
+			return 0, 0, false
+		}
+		if last+1 < end {
+			end = last + 1
+		}
+	}
+	return start, end, true
+}
+
+// checkMemoryConditions checks the If-* headers of req against b, which is
+// nil if the blob doesn't exist. Reads that fail If-None-Match or
+// If-Modified-Since are answered with 304.
+func checkMemoryConditions(req *http.Request, b *memoryBlob, write bool) (int, string) {
+	failed := http.StatusPreconditionFailed
+	if !write {
+		failed = http.StatusNotModified
+	}
+
+	if match := req.Header.Get("If-Match"); match != "" && (b == nil || !memoryETagMatch(match, b.etag)) {
+		return http.StatusPreconditionFailed, "ConditionNotMet"
+	}
+	if match := req.Header.Get("If-None-Match"); match != "" && b != nil && memoryETagMatch(match, b.etag) {
+		if write && match == "*" {
+			return http.StatusConflict, "BlobAlreadyExists"
+		}
+		return failed, "ConditionNotMet"
+	}
+	if b == nil {
+		return 0, ""
+	}
+	if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && !b.modified.Truncate(time.Second).After(since) {
+		return failed, "ConditionNotMet"
+	}
+	if since, err := http.ParseTime(req.Header.Get("If-Unmodified-Since")); err == nil && b.modified.Truncate(time.Second).After(since) {
+		return http.StatusPreconditionFailed, "ConditionNotMet"
+	}
+	return 0, ""
+}
+
+func memoryETagMatch(condition, etag string) bool {
+	return condition == "*" || strings.Trim(condition, `"`) == strings.Trim(etag, `"`)
+}
+
+// expireLease moves a lease whose time is up on to expired or broken.
+func (b *memoryBlob) expireLease() {
+	now := time.Now()
+	switch {
+	case b.leaseState == "leased" && !b.leaseInfinite && now.After(b.leaseExpires):
+		b.leaseState = "expired"
+	case b.leaseState == "breaking" && !now.Before(b.breakAt):
+		b.leaseState = "broken"
+	}
+}
+
+// checkMemoryLease checks the lease ID of a write to b. The holder of an
+// expired lease may still write with it until someone else takes it.
+func checkMemoryLease(req *http.Request, b *memoryBlob) (int, string) {
+	id := req.Header.Get("x-ms-lease-id")
+	if b == nil || id == "" && b.leaseState != "leased" && b.leaseState != "breaking" {
+		return 0, ""
+	}
+	switch {
+	case id == "":
+		return http.StatusPreconditionFailed, "LeaseIdMissing"
+	case b.leaseState == "available" || b.leaseState == "broken":
+		return http.StatusPreconditionFailed, "LeaseNotPresentWithBlobOperation"
+	case id != b.leaseID:
+		return http.StatusPreconditionFailed, "LeaseIdMismatchWithBlobOperation"
+	}
+	return 0, ""
+}
+
+func (m *memoryService) lease(w http.ResponseWriter, req *http.Request, b *memoryBlob) {
+	if b == nil {
+		writeMemoryError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	if status, code := checkMemoryConditions(req, b, true); status != 0 {
+		writeMemoryError(w, status, code)
+		return
+	}
+
+	id := req.Header.Get("x-ms-lease-id")
+	switch req.Header.Get("x-ms-lease-action") {
+	case "acquire":
+		proposed := req.Header.Get("x-ms-proposed-lease-id")
+		if proposed == "" {
+			proposed = uuid.NewString()
+		}
+		switch {
+		case b.leaseState == "breaking":
+			writeMemoryError(w, http.StatusConflict, "LeaseIsBreakingAndCannotBeAcquired")
+			return
+		case b.leaseState == "leased" && b.leaseID != proposed:
+			writeMemoryError(w, http.StatusConflict, "LeaseAlreadyPresent")
+			return
+		}
+		seconds, err := strconv.Atoi(req.Header.Get("x-ms-lease-duration"))
+		if err != nil || seconds != -1 && (seconds < 15 || seconds > 60) {
+			writeMemoryError(w, http.StatusBadRequest, "InvalidHeaderValue")
+			return
+		}
+		b.leaseID, b.leaseState = proposed, "leased"
+		b.leaseInfinite = seconds == -1
+		b.leaseDuration = time.Duration(seconds) * time.Second
+		b.leaseExpires = time.Now().Add(b.leaseDuration)
+		w.Header().Set("x-ms-lease-id", proposed)
+		setMemoryModified(w, b.etag, b.modified)
+		w.WriteHeader(http.StatusCreated)
+	case "renew":
+		if status, code := checkMemoryLeaseID(b, id); status != 0 {
+			writeMemoryError(w, status, code)
+			return
+		}
+		if b.leaseState == "breaking" || b.leaseState == "broken" {
+			writeMemoryError(w, http.StatusConflict, "LeaseIsBrokenAndCannotBeRenewed")
+			return
+		}
+		b.leaseState = "leased"
+		b.leaseExpires = time.Now().Add(b.leaseDuration)
+		w.Header().Set("x-ms-lease-id", id)
+		setMemoryModified(w, b.etag, b.modified)
+		w.WriteHeader(http.StatusOK)
+	case "release":
+		if status, code := checkMemoryLeaseID(b, id); status != 0 {
+			writeMemoryError(w, status, code)
+			return
+		}
+		b.leaseID, b.leaseState = "", "available"
+		setMemoryModified(w, b.etag, b.modified)
+		w.WriteHeader(http.StatusOK)
+	case "break":
+		if b.leaseState == "available" || b.leaseState == "expired" {
+			writeMemoryError(w, http.StatusConflict, "LeaseNotPresentWithLeaseOperation")
+			return
+		}
+		if b.leaseState == "leased" {
+			period, err := strconv.Atoi(req.Header.Get("x-ms-lease-break-period"))
+			if err != nil {
+				period = 60
+			}
+			b.breakAt = time.Now().Add(time.Duration(period) * time.Second)
+			if !b.leaseInfinite && b.leaseExpires.Before(b.breakAt) {
+				b.breakAt = b.leaseExpires
+			}
+			b.leaseState = "breaking"
+			b.expireLease()
+		}
+		remaining := 0
+		if b.leaseState == "breaking" {
+			remaining = int(time.Until(b.breakAt).Seconds())
+		}
+		w.Header().Set("x-ms-lease-time", strconv.Itoa(remaining))
+		setMemoryModified(w, b.etag, b.modified)
+		w.WriteHeader(http.StatusAccepted)
+	case "change":
+		if status, code := checkMemoryLeaseID(b, id); status != 0 {
+			writeMemoryError(w, status, code)
+			return
+		}
+		b.leaseID = req.Header.Get("x-ms-proposed-lease-id")
+		w.Header().Set("x-ms-lease-id", b.leaseID)
+		setMemoryModified(w, b.etag, b.modified)
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeMemoryError(w, http.StatusBadRequest, "InvalidHeaderValue")
+	}
+}
+
+// checkMemoryLeaseID checks the lease ID of a lease operation on b.
+func checkMemoryLeaseID(b *memoryBlob, id string) (int, string) {
+	if b.leaseState == "available" || b.leaseID == "" {
+		return http.StatusConflict, "LeaseNotPresentWithLeaseOperation"
+	}
+	if id != b.leaseID {
+		return http.StatusConflict, "LeaseIdMismatchWithLeaseOperation"
+	}
+	return 0, ""
+}
+
+// copy copies a blob of the memory service to name, completing right away
+// also when the copy was started asynchronously.
+func (m *memoryService) copy(w http.ResponseWriter, req *http.Request, c *memoryContainer, name string, b *memoryBlob) {
+	source, err := url.Parse(req.Header.Get("x-ms-copy-source"))
+	if err != nil || source.Host != strings.TrimPrefix(memoryEndpoint, "http://") {
+		writeMemoryError(w, http.StatusBadRequest, "CannotVerifyCopySource")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(source.Path, "/"), "/", 2)
+	var src *memoryBlob
+	if sc, ok := m.containers[parts[0]]; ok && len(parts) == 2 {
+		src = sc.blobs[parts[1]]
+	}
+	if src == nil {
+		writeMemoryError(w, http.StatusNotFound, "CannotVerifyCopySource")
+		return
+	}
+	if match := req.Header.Get("x-ms-source-if-match"); match != "" && !memoryETagMatch(match, src.etag) {
+		writeMemoryError(w, http.StatusPreconditionFailed, "SourceConditionNotMet")
+		return
+	}
+	if want := req.Header.Get("x-ms-source-content-md5"); want != "" {
+		if sum := md5.Sum(src.data); base64.StdEncoding.EncodeToString(sum[:]) != want {
+			writeMemoryError(w, http.StatusBadRequest, "Md5Mismatch")
+			return
+		}
+	}
+
+	copied := m.put(req, c, name, b, src.blobType, append([]byte(nil), src.data...))
+	copied.headers, copied.md5, copied.blocks = src.headers, src.md5, src.blocks
+	if len(copied.metadata) == 0 {
+		copied.metadata = src.metadata
+	}
+	setMemoryModified(w, copied.etag, copied.modified)
+	w.Header().Set("x-ms-copy-id", uuid.NewString())
+	w.Header().Set("x-ms-copy-status", "success")
+	if req.Header.Get("x-ms-requires-sync") == "true" {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// memoryListing is the list blobs response, with the fields the SDK reads.
+type memoryListing struct {
+	XMLName         xml.Name           `xml:"EnumerationResults"`
+	ServiceEndpoint string             `xml:"ServiceEndpoint,attr"`
+	ContainerName   string             `xml:"ContainerName,attr"`
+	Prefix          string             `xml:"Prefix"`
+	Marker          string             `xml:"Marker"`
+	MaxResults      int                `xml:"MaxResults"`
+	Delimiter       string             `xml:"Delimiter,omitempty"`
+	Blobs           []memoryListedBlob `xml:"Blobs>Blob"`
+	Prefixes        []memoryPrefix     `xml:"Blobs>BlobPrefix"`
+	NextMarker      string             `xml:"NextMarker"`
+}
+
+type memoryPrefix struct {
+	Name string `xml:"Name"`
+}
+
+type memoryListedBlob struct {
+	Name       string `xml:"Name"`
+	Properties struct {
+		CreationTime  string `xml:"Creation-Time"`
+		LastModified  string `xml:"Last-Modified"`
+		Etag          string `xml:"Etag"`
+		ContentLength int    `xml:"Content-Length"`
+		ContentType   string `xml:"Content-Type"`
+		ContentMD5    string `xml:"Content-MD5,omitempty"`
+		BlobType      string `xml:"BlobType"`
+		AccessTier    string `xml:"AccessTier"`
+		LeaseStatus   string `xml:"LeaseStatus"`
+		LeaseState    string `xml:"LeaseState"`
+	} `xml:"Properties"`
+	Metadata *memoryListedMetadata `xml:"Metadata,omitempty"`
+}
+
+type memoryListedMetadata map[string]string
+
+func (md memoryListedMetadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := e.EncodeElement(md[k], xml.StartElement{Name: xml.Name{Local: k}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// list serves a page of the blobs of c in name order, their names cut at
+// the delimiter if one is given. The marker is the name to continue at.
+func (m *memoryService) list(w http.ResponseWriter, req *http.Request, name string, c *memoryContainer) {
+	q := req.URL.Query()
+	prefix, delimiter, marker := q.Get("prefix"), q.Get("delimiter"), q.Get("marker")
+	max := memoryMaxResults
+	if n, err := strconv.Atoi(q.Get("maxresults")); err == nil && n > 0 && n < max {
+		max = n
+	}
+	withMetadata := strings.Contains(q.Get("include"), "metadata")
+
+	names := make([]string, 0, len(c.blobs))
+	for blobName := range c.blobs {
+		if strings.HasPrefix(blobName, prefix) && blobName >= marker {
+			names = append(names, blobName)
+		}
+	}
+	sort.Strings(names)
+
+	listing := memoryListing{
+		ServiceEndpoint: memoryEndpoint + "/",
+		ContainerName:   name,
+		Prefix:          prefix,
+		Marker:          marker,
+		MaxResults:      max,
+		Delimiter:       delimiter,
+	}
+	var entries int
+	for _, blobName := range names {
+		dir := ""
+		if delimiter != "" {
+			if i := strings.Index(blobName[len(prefix):], delimiter); i >= 0 {
+				dir = blobName[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if dir != "" && len(listing.Prefixes) > 0 && listing.Prefixes[len(listing.Prefixes)-1].Name == dir {
+			continue
+		}
+		if entries == max {
+			listing.NextMarker = blobName
+			break
+		}
+		entries++
+
+		if dir != "" {
+			listing.Prefixes = append(listing.Prefixes, memoryPrefix{dir})
+			continue
+		}
+		b := c.blobs[blobName]
+		b.expireLease()
+		var item memoryListedBlob
+		item.Name = blobName
+		item.Properties.CreationTime = b.created.Format(http.TimeFormat)
+		item.Properties.LastModified = b.modified.Format(http.TimeFormat)
+		item.Properties.Etag = b.etag
+		item.Properties.ContentLength = len(b.data)
+		item.Properties.ContentType = b.headers.Get("Content-Type")
+		if b.md5 != nil {
+			item.Properties.ContentMD5 = base64.StdEncoding.EncodeToString(b.md5)
+		}
+		item.Properties.BlobType = b.blobType
+		item.Properties.AccessTier = b.tier
+		item.Properties.LeaseState = b.leaseState
+		item.Properties.LeaseStatus = "unlocked"
+		if b.leaseState == "leased" {
+			item.Properties.LeaseStatus = "locked"
+		}
+		if withMetadata {
+			md := memoryListedMetadata(b.metadata)
+			item.Metadata = &md
+		}
+		listing.Blobs = append(listing.Blobs, item)
+	}
+
+	body, err := xml.Marshal(listing)
+	if err != nil {
+		writeMemoryError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes.Join([][]byte{[]byte(xml.Header), body}, nil))
+}
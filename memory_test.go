@@ -0,0 +1,230 @@
+package certmagic_azblob
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMemoryService returns a memory service of its own with a container c.
+func newMemoryService(t *testing.T) *memoryService {
+	t.Helper()
+	m := &memoryService{containers: make(map[string]*memoryContainer)}
+	if rec := memoryRequest(m, http.MethodPut, "/c?restype=container", nil, ""); rec.Code != http.StatusCreated {
+		t.Fatalf("creating the container: %d", rec.Code)
+	}
+	return m
+}
+
+// memoryRequest serves a request of the blob REST API with the given
+// headers and body.
+func memoryRequest(m *memoryService, method, target string, header map[string]string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, memoryEndpoint+target, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	m.serve(rec, req)
+	return rec
+}
+
+func putMemoryBlob(t *testing.T, m *memoryService, name string) {
+	t.Helper()
+	rec := memoryRequest(m, http.MethodPut, "/c/"+name, map[string]string{"x-ms-blob-type": "BlockBlob"}, name)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("putting %s: %d %s", name, rec.Code, rec.Header().Get("x-ms-error-code"))
+	}
+}
+
+// expectMemoryStatus checks the status and error code of a response.
+func expectMemoryStatus(t *testing.T, what string, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if rec.Code != status || rec.Header().Get("x-ms-error-code") != code {
+		t.Fatalf("%s: got %d %q, expected %d %q", what, rec.Code, rec.Header().Get("x-ms-error-code"), status, code)
+	}
+}
+
+func TestMemoryLease(t *testing.T) {
+	m := newMemoryService(t)
+	putMemoryBlob(t, m, "lock")
+	lease := func(action string, header map[string]string) *httptest.ResponseRecorder {
+		h := map[string]string{"x-ms-lease-action": action}
+		for k, v := range header {
+			h[k] = v
+		}
+		return memoryRequest(m, http.MethodPut, "/c/lock?comp=lease", h, "")
+	}
+	write := func(id string) *httptest.ResponseRecorder {
+		h := map[string]string{"x-ms-blob-type": "BlockBlob"}
+		if id != "" {
+			h["x-ms-lease-id"] = id
+		}
+		return memoryRequest(m, http.MethodPut, "/c/lock", h, "value")
+	}
+
+	expectMemoryStatus(t, "acquire with an invalid duration",
+		lease("acquire", map[string]string{"x-ms-lease-duration": "10"}), http.StatusBadRequest, "InvalidHeaderValue")
+	expectMemoryStatus(t, "release without a lease",
+		lease("release", map[string]string{"x-ms-lease-id": "a"}), http.StatusConflict, "LeaseNotPresentWithLeaseOperation")
+
+	expectMemoryStatus(t, "acquire",
+		lease("acquire", map[string]string{"x-ms-lease-duration": "15", "x-ms-proposed-lease-id": "a"}), http.StatusCreated, "")
+	expectMemoryStatus(t, "acquire by another",
+		lease("acquire", map[string]string{"x-ms-lease-duration": "15", "x-ms-proposed-lease-id": "b"}), http.StatusConflict, "LeaseAlreadyPresent")
+	expectMemoryStatus(t, "acquire again by the holder",
+		lease("acquire", map[string]string{"x-ms-lease-duration": "15", "x-ms-proposed-lease-id": "a"}), http.StatusCreated, "")
+	expectMemoryStatus(t, "write without the lease", write(""), http.StatusPreconditionFailed, "LeaseIdMissing")
+	expectMemoryStatus(t, "write with another lease", write("b"), http.StatusPreconditionFailed, "LeaseIdMismatchWithBlobOperation")
+	expectMemoryStatus(t, "write with the lease", write("a"), http.StatusCreated, "")
+	expectMemoryStatus(t, "renew by another",
+		lease("renew", map[string]string{"x-ms-lease-id": "b"}), http.StatusConflict, "LeaseIdMismatchWithLeaseOperation")
+	expectMemoryStatus(t, "renew",
+		lease("renew", map[string]string{"x-ms-lease-id": "a"}), http.StatusOK, "")
+
+	// An expired lease may be taken by anyone, its holder can still write
+	// until then.
+	m.containers["c"].blobs["lock"].leaseExpires = time.Now().Add(-time.Second)
+	expectMemoryStatus(t, "write with an expired lease", write("a"), http.StatusCreated, "")
+	expectMemoryStatus(t, "write without an expired lease", write(""), http.StatusCreated, "")
+	expectMemoryStatus(t, "acquire an expired lease",
+		lease("acquire", map[string]string{"x-ms-lease-duration": "-1", "x-ms-proposed-lease-id": "b"}), http.StatusCreated, "")
+	expectMemoryStatus(t, "write with the expired lease", write("a"), http.StatusPreconditionFailed, "LeaseIdMismatchWithBlobOperation")
+
+	expectMemoryStatus(t, "break",
+		lease("break", map[string]string{"x-ms-lease-break-period": "60"}), http.StatusAccepted, "")
+	expectMemoryStatus(t, "acquire a breaking lease",
+		lease("acquire", map[string]string{"x-ms-lease-duration": "15", "x-ms-proposed-lease-id": "b"}), http.StatusConflict, "LeaseIsBreakingAndCannotBeAcquired")
+	expectMemoryStatus(t, "renew a breaking lease",
+		lease("renew", map[string]string{"x-ms-lease-id": "b"}), http.StatusConflict, "LeaseIsBrokenAndCannotBeRenewed")
+
+	m.containers["c"].blobs["lock"].breakAt = time.Now().Add(-time.Second)
+	expectMemoryStatus(t, "write with a broken lease", write("b"), http.StatusPreconditionFailed, "LeaseNotPresentWithBlobOperation")
+	expectMemoryStatus(t, "write without a broken lease", write(""), http.StatusCreated, "")
+	expectMemoryStatus(t, "acquire a broken lease",
+		lease("acquire", map[string]string{"x-ms-lease-duration": "15", "x-ms-proposed-lease-id": "c"}), http.StatusCreated, "")
+	expectMemoryStatus(t, "release",
+		lease("release", map[string]string{"x-ms-lease-id": "c"}), http.StatusOK, "")
+	expectMemoryStatus(t, "break a released lease",
+		lease("break", nil), http.StatusConflict, "LeaseNotPresentWithLeaseOperation")
+	expectMemoryStatus(t, "write after release", write(""), http.StatusCreated, "")
+}
+
+func TestMemoryList(t *testing.T) {
+	m := newMemoryService(t)
+	for _, name := range []string{"a", "dir/b", "dir/c", "dir/sub/d", "e", "other/f"} {
+		putMemoryBlob(t, m, name)
+	}
+
+	// list returns the names and prefixes of all pages.
+	list := func(query string) (names []string) {
+		marker := ""
+		for {
+			rec := memoryRequest(m, http.MethodGet, "/c?restype=container&comp=list&"+query+"&marker="+marker, nil, "")
+			expectMemoryStatus(t, "list "+query, rec, http.StatusOK, "")
+			var listing memoryListing
+			if err := xml.Unmarshal(rec.Body.Bytes(), &listing); err != nil {
+				t.Fatal(err)
+			}
+			// A page lists its blobs and prefixes separately.
+			for _, b := range listing.Blobs {
+				names = append(names, b.Name)
+			}
+			for _, p := range listing.Prefixes {
+				names = append(names, p.Name)
+			}
+			if listing.NextMarker == "" {
+				return names
+			}
+			names = append(names, "|")
+			marker = listing.NextMarker
+		}
+	}
+
+	for _, tt := range []struct {
+		query string
+		want  string
+	}{
+		{"", "a,dir/b,dir/c,dir/sub/d,e,other/f"},
+		{"maxresults=4", "a,dir/b,dir/c,dir/sub/d,|,e,other/f"},
+		{"delimiter=/", "a,e,dir/,other/"},
+		{"delimiter=/&maxresults=2", "a,dir/,|,e,other/"},
+		{"prefix=dir/&delimiter=/", "dir/b,dir/c,dir/sub/"},
+		{"prefix=dir/&delimiter=/&maxresults=1", "dir/b,|,dir/c,|,dir/sub/"},
+		{"prefix=dir", "dir/b,dir/c,dir/sub/d"},
+		{"prefix=missing/", ""},
+	} {
+		if got := strings.Join(list(tt.query), ","); got != tt.want {
+			t.Errorf("list %s = %s, expected %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParseMemoryRange(t *testing.T) {
+	for _, tt := range []struct {
+		rng        string
+		size       int
+		start, end int
+		ok         bool
+	}{
+		{"bytes=0-", 10, 0, 10, true},
+		{"bytes=0-3", 10, 0, 4, true},
+		{"bytes=4-", 10, 4, 10, true},
+		{"bytes=8-20", 10, 8, 10, true},
+		{"bytes=9-9", 10, 9, 10, true},
+		{"bytes=0-", 0, 0, 0, true},
+		{"bytes=10-", 10, 0, 0, false},
+		{"bytes=5-4", 10, 0, 0, false},
+		{"bytes=-5", 10, 0, 0, false},
+		{"bytes=a-", 10, 0, 0, false},
+		{"bytes=5", 10, 0, 0, false},
+	} {
+		start, end, ok := parseMemoryRange(tt.rng, tt.size)
+		if start != tt.start || end != tt.end || ok != tt.ok {
+			t.Errorf("parseMemoryRange(%q, %d) = %d, %d, %v, expected %d, %d, %v",
+				tt.rng, tt.size, start, end, ok, tt.start, tt.end, tt.ok)
+		}
+	}
+}
+
+func TestCheckMemoryConditions(t *testing.T) {
+	modified := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	b := &memoryBlob{etag: `"0x1"`, modified: modified.Add(500 * time.Millisecond)}
+	before := modified.Add(-time.Second).Format(http.TimeFormat)
+	at := modified.Format(http.TimeFormat)
+
+	for _, tt := range []struct {
+		name   string
+		header map[string]string
+		blob   *memoryBlob
+		write  bool
+		status int
+		code   string
+	}{
+		{"none", nil, b, true, 0, ""},
+		{"if-match", map[string]string{"If-Match": `"0x1"`}, b, true, 0, ""},
+		{"if-match unquoted", map[string]string{"If-Match": "0x1"}, b, true, 0, ""},
+		{"if-match other", map[string]string{"If-Match": `"0x2"`}, b, true, http.StatusPreconditionFailed, "ConditionNotMet"},
+		{"if-match missing", map[string]string{"If-Match": "*"}, nil, true, http.StatusPreconditionFailed, "ConditionNotMet"},
+		{"if-none-match any", map[string]string{"If-None-Match": "*"}, b, true, http.StatusConflict, "BlobAlreadyExists"},
+		{"if-none-match any missing", map[string]string{"If-None-Match": "*"}, nil, true, 0, ""},
+		{"if-none-match write", map[string]string{"If-None-Match": `"0x1"`}, b, true, http.StatusPreconditionFailed, "ConditionNotMet"},
+		{"if-none-match read", map[string]string{"If-None-Match": `"0x1"`}, b, false, http.StatusNotModified, "ConditionNotMet"},
+		{"if-none-match other", map[string]string{"If-None-Match": `"0x2"`}, b, false, 0, ""},
+		{"if-modified-since", map[string]string{"If-Modified-Since": before}, b, false, 0, ""},
+		{"if-modified-since unmodified", map[string]string{"If-Modified-Since": at}, b, false, http.StatusNotModified, "ConditionNotMet"},
+		{"if-unmodified-since", map[string]string{"If-Unmodified-Since": at}, b, true, 0, ""},
+		{"if-unmodified-since modified", map[string]string{"If-Unmodified-Since": before}, b, true, http.StatusPreconditionFailed, "ConditionNotMet"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, memoryEndpoint+"/c/b", nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		status, code := checkMemoryConditions(req, tt.blob, tt.write)
+		if status != tt.status || code != tt.code {
+			t.Errorf("%s: got %d %q, expected %d %q", tt.name, status, code, tt.status, tt.code)
+		}
+	}
+}
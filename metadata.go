@@ -0,0 +1,74 @@
+package certmagic_azblob
+
+import (
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// Metadata added to every stored blob, telling which instance wrote it and
+// when.
+const (
+	metadataInstance      = "caddyinstance"
+	metadataModuleVersion = "caddymoduleversion"
+	metadataStoredAt      = "caddystoredat"
+)
+
+const modulePath = "github.com/konaryio/certmagic-azblob"
+
+var version = moduleVersion()
+
+// metadataName matches the names Azure accepts for metadata, which must be
+// valid C# identifiers.
+var metadataName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateMetadata checks the configured static metadata. The caddy prefix
+// is reserved for the metadata the module sets itself.
+func validateMetadata(metadata map[string]string) error {
+	for name := range metadata {
+		if !metadataName.MatchString(name) {
+			return fmt.Errorf("invalid metadata name %q, must be a valid C# identifier", name)
+		}
+		if strings.HasPrefix(strings.ToLower(name), "caddy") {
+			return fmt.Errorf("invalid metadata name %q, the caddy prefix is reserved", name)
+		}
+	}
+	return nil
+}
+
+// blobMetadata returns the metadata for a blob stored now.
+func (s *Storage) blobMetadata() azblob.Metadata {
+	metadata := azblob.Metadata{}
+	for name, value := range s.Metadata {
+		// The SDK returns names lowercased, store them that way too.
+		metadata[strings.ToLower(name)] = value
+	}
+	metadata[metadataInstance] = s.uuid
+	metadata[metadataModuleVersion] = version
+	metadata[metadataStoredAt] = time.Now().UTC().Format(time.RFC3339)
+	return metadata
+}
+
+// moduleVersion returns the version of this module in the running binary.
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
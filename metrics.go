@@ -0,0 +1,121 @@
+package certmagic_azblob
+
+import (
+	"errors"
+	"io/fs"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// storageMetrics are registered with the default Prometheus registry, which
+// Caddy serves on its metrics endpoint. They are shared by all Storage
+// instances, so they are only registered once.
+var storageMetrics = struct {
+	init       sync.Once
+	operations *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	throttled  *prometheus.CounterVec
+	contended  prometheus.Counter
+	lockWait   prometheus.Histogram
+	usageKeys  *prometheus.GaugeVec
+	usageBytes *prometheus.GaugeVec
+}{}
+
+func initStorageMetrics() {
+	const ns, sub = "caddy", "storage_azblob"
+
+	labels := []string{"operation"}
+	storageMetrics.operations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "operations_total",
+		Help:      "Counter of storage operations.",
+	}, labels)
+	storageMetrics.errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "operation_errors_total",
+		Help:      "Number of storage operations that failed, not counting missing keys.",
+	}, labels)
+	storageMetrics.duration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "operation_duration_seconds",
+		Help:      "Histogram of storage operation durations, including retries.",
+		Buckets:   prometheus.DefBuckets,
+	}, labels)
+	storageMetrics.throttled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "throttled_total",
+		Help:      "Number of requests the storage account throttled after the SDK's retries, by status code.",
+	}, []string{"code"})
+	storageMetrics.contended = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "lock_contended_total",
+		Help:      "Number of Lock calls that found the lock held by another holder.",
+	})
+	storageMetrics.lockWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "lock_wait_seconds",
+		Help:      "Histogram of how long Lock waited until it acquired the lock.",
+		Buckets:   []float64{.1, .5, 1, 5, 15, 30, 60, 120, 300, 600},
+	})
+
+	usageLabels := []string{"container", "prefix"}
+	storageMetrics.usageKeys = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "keys",
+		Help:      "Number of stored keys per top level directory at the last usage report.",
+	}, usageLabels)
+	storageMetrics.usageBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "bytes",
+		Help:      "Stored bytes per top level directory at the last usage report.",
+	}, usageLabels)
+}
+
+// observe records an operation that started at start and finished with
+// *err. It is meant to be deferred with a named error result.
+func (s *Storage) observe(op string, start time.Time, err *error) {
+	storageMetrics.init.Do(initStorageMetrics)
+
+	storageMetrics.operations.WithLabelValues(op).Inc()
+	storageMetrics.duration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if *err != nil && !errors.Is(*err, fs.ErrNotExist) {
+		storageMetrics.errors.WithLabelValues(op).Inc()
+		return
+	}
+	s.recordSuccess(op)
+}
+
+// observeThrottled counts a request throttled with the given status code.
+func observeThrottled(code int) {
+	storageMetrics.init.Do(initStorageMetrics)
+	storageMetrics.throttled.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+func observeLockContended() {
+	storageMetrics.init.Do(initStorageMetrics)
+	storageMetrics.contended.Inc()
+}
+
+func observeLockWait(d time.Duration) {
+	storageMetrics.init.Do(initStorageMetrics)
+	storageMetrics.lockWait.Observe(d.Seconds())
+}
+
+func observeUsage(container string, u PrefixUsage) {
+	storageMetrics.init.Do(initStorageMetrics)
+	storageMetrics.usageKeys.WithLabelValues(container, u.Prefix).Set(float64(u.Keys))
+	storageMetrics.usageBytes.WithLabelValues(container, u.Prefix).Set(float64(u.Bytes))
+}
@@ -0,0 +1,24 @@
+package certmagic_azblob
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// migrateLoad reads key from the storage being migrated from and copies it
+// into the container, so the next load is served from Azure.
+func (s *Storage) migrateLoad(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.MigrateFrom.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Store(ctx, key, value); err != nil {
+		// The old storage still has it, the next load tries again.
+		s.logger.Warn("Migrate Error", zap.String("key", key), s.errField(err))
+		return value, nil
+	}
+	s.logger.Info("Migrated key from previous storage", zap.String("key", key))
+	return value, nil
+}
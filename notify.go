@@ -0,0 +1,188 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	// notifyQueueSize bounds the events waiting to be sent. Events beyond
+	// it are dropped.
+	notifyQueueSize = 256
+
+	notifyRetries    = 3
+	notifyRetryDelay = 2 * time.Second
+	notifyTimeout    = 10 * time.Second
+
+	// Event types, also used as the Event Grid eventType.
+	eventCertificateStored  = "certificate.stored"
+	eventCertificateDeleted = "certificate.deleted"
+)
+
+// CertificateEvent is sent to NotifyURL when a key below certificates/ is
+// stored or deleted.
+type CertificateEvent struct {
+	Type      string    `json:"type"`
+	Key       string    `json:"key"`
+	Container string    `json:"container"`
+	Instance  string    `json:"instance"`
+	Time      time.Time `json:"time"`
+
+	// Fingerprint is the hex SHA-256 of the leaf certificate and NotAfter
+	// its expiry, only for stored certificate chains (.crt).
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+}
+
+// eventGridEvent is an event in the Event Grid schema.
+type eventGridEvent struct {
+	ID          string           `json:"id"`
+	EventType   string           `json:"eventType"`
+	Subject     string           `json:"subject"`
+	EventTime   time.Time        `json:"eventTime"`
+	Data        CertificateEvent `json:"data"`
+	DataVersion string           `json:"dataVersion"`
+}
+
+// startNotifier sends queued events until the storage is closed.
+func (s *Storage) startNotifier() {
+	s.notifyQueue = make(chan CertificateEvent, notifyQueueSize)
+	go s.notifyEvents()
+}
+
+// notifyStore queues an event for key if it is a certificate artifact.
+func (s *Storage) notifyStore(key string, value []byte) {
+	if !strings.HasPrefix(key, "certificates/") {
+		return
+	}
+	event := s.newEvent(eventCertificateStored, key)
+	if path.Ext(key) == ".crt" {
+		if block, _ := pem.Decode(value); block != nil && block.Type == "CERTIFICATE" {
+			sum := sha256.Sum256(block.Bytes)
+			event.Fingerprint = hex.EncodeToString(sum[:])
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				event.NotAfter = &cert.NotAfter
+			}
+		}
+	}
+	s.enqueueEvent(event)
+}
+
+// notifyDelete queues an event for key if it is a certificate artifact.
+func (s *Storage) notifyDelete(key string) {
+	if strings.HasPrefix(key, "certificates/") {
+		s.enqueueEvent(s.newEvent(eventCertificateDeleted, key))
+	}
+}
+
+func (s *Storage) newEvent(typ, key string) CertificateEvent {
+	return CertificateEvent{
+		Type:      typ,
+		Key:       key,
+		Container: s.shardFor(key).name,
+		Instance:  s.uuid,
+		Time:      time.Now().UTC(),
+	}
+}
+
+func (s *Storage) enqueueEvent(event CertificateEvent) {
+	select {
+	case s.notifyQueue <- event:
+	default:
+		s.logger.Warn("Notify queue full, dropping event", zap.String("key", event.Key), zap.String("type", event.Type))
+	}
+}
+
+// notifyEvents sends queued events one at a time, retrying each a few
+// times.
+func (s *Storage) notifyEvents() {
+	for {
+		var event CertificateEvent
+		select {
+		case <-s.ctx.Done():
+			return
+		case event = <-s.notifyQueue:
+		}
+
+		var err error
+		for attempt := 0; attempt < notifyRetries; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-s.ctx.Done():
+					return
+				case <-time.After(notifyRetryDelay << (attempt - 1)):
+				}
+			}
+			if err = s.sendEvent(s.ctx, event); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			s.logger.Error("Notify Error", zap.String("key", event.Key), zap.String("type", event.Type), s.errField(err))
+		}
+	}
+}
+
+// sendEvent posts event to NotifyURL, as an Event Grid event with the topic
+// key if NotifyEventGrid is set and otherwise as is, signed with the HMAC
+// of NotifyKey if one is set.
+func (s *Storage) sendEvent(ctx context.Context, event CertificateEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+
+	var body []byte
+	var err error
+	if s.NotifyEventGrid {
+		body, err = json.Marshal([]eventGridEvent{{
+			ID:          uuid.NewString(),
+			EventType:   event.Type,
+			Subject:     event.Container + "/" + event.Key,
+			EventTime:   event.Time,
+			Data:        event,
+			DataVersion: "1.0",
+		}})
+	} else {
+		body, err = json.Marshal(event)
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.NotifyURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	switch {
+	case s.NotifyEventGrid:
+		req.Header.Set("aeg-sas-key", s.NotifyKey)
+	case s.NotifyKey != "":
+		mac := hmac.New(sha256.New, []byte(s.NotifyKey))
+		mac.Write(body)
+		req.Header.Set("X-Azblob-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded %s", s.NotifyURL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+)
+
+// Defaults of the SDK's exponential retry policy, used to fill in the
+// counterpart when only one of the delays is configured.
+const (
+	defaultRetryDelay    = 4 * time.Second
+	defaultMaxRetryDelay = 120 * time.Second
+
+	// defaultDownloadRetries rides out a connection reset mid-download.
+	defaultDownloadRetries = 3
+)
+
+func (s *Storage) pipelineOptions() azblob.PipelineOptions {
+	retry := azblob.RetryOptions{
+		TryTimeout:    time.Duration(s.TryTimeout),
+		RetryDelay:    time.Duration(s.RetryDelay),
+		MaxRetryDelay: time.Duration(s.MaxRetryDelay),
+	}
+
+	if s.MaxRetries > 0 {
+		retry.MaxTries = int32(s.MaxRetries) + 1
+	}
+
+	// The SDK requires both delays to be set or neither.
+	if retry.RetryDelay > 0 && retry.MaxRetryDelay == 0 {
+		retry.MaxRetryDelay = defaultMaxRetryDelay
+		if retry.RetryDelay > retry.MaxRetryDelay {
+			retry.MaxRetryDelay = retry.RetryDelay
+		}
+	}
+	if retry.MaxRetryDelay > 0 && retry.RetryDelay == 0 {
+		retry.RetryDelay = defaultRetryDelay
+		if retry.RetryDelay > retry.MaxRetryDelay {
+			retry.RetryDelay = retry.MaxRetryDelay
+		}
+	}
+
+	o := azblob.PipelineOptions{
+		Retry:     retry,
+		Telemetry: azblob.TelemetryOptions{Value: s.userAgent()},
+		Log:       s.sdkLogOptions(),
+		// Failed requests are logged to zap instead of syslog.
+		RequestLog: azblob.RequestLogOptions{SyslogDisabled: s.DebugHTTP},
+	}
+	if s.blobClient != nil {
+		o.HTTPSender = newHTTPSender(s.blobClient)
+	}
+	return o
+}
+
+// downloadRetries is how often an interrupted download is resumed.
+func (s *Storage) downloadRetries() int {
+	switch {
+	case s.DownloadRetries < 0:
+		return 0
+	case s.DownloadRetries > 0:
+		return s.DownloadRetries
+	case s.MaxRetries > 0:
+		return s.MaxRetries
+	}
+	return defaultDownloadRetries
+}
+
+// failedRead logs a download that was interrupted mid-stream.
+func (s *Storage) failedRead(failures int, err error, offset, count int64, willRetry bool) {
+	if willRetry {
+		s.logger.Warn("Download interrupted, resuming", zap.Int("failures", failures), zap.Int64("offset", offset), s.errField(err))
+	}
+}
+
+func (s *Storage) retryReaderOptions() azblob.RetryReaderOptions {
+	return azblob.RetryReaderOptions{
+		MaxRetryRequests:       s.downloadRetries(),
+		TreatEarlyCloseAsError: s.DownloadEarlyCloseError,
+		NotifyFailedRead:       s.failedRead,
+	}
+}
+
+// userAgent identifies this module and the operator's suffix in the
+// User-Agent of every request, ahead of the SDK's own value.
+func (s *Storage) userAgent() string {
+	ua := "caddy-azblob/" + version
+	if s.UserAgent != "" {
+		ua += " " + s.UserAgent
+	}
+	return ua
+}
+
+// newPipeline mirrors azblob.NewPipeline but accepts any pipeline.Factory as
+// the credential, which allows credentials that can be swapped at runtime.
+// A nil credential is treated as anonymous access.
+func (s *Storage) newPipeline(creds pipeline.Factory) pipeline.Pipeline {
+	o := s.pipelineOptions()
+
+	// Closest to API goes first; closest to the wire goes last
+	var f []pipeline.Factory
+	if !s.DisableTelemetry {
+		f = append(f, azblob.NewTelemetryPolicyFactory(o.Telemetry))
+	}
+	f = append(f, azblob.NewUniqueRequestIDPolicyFactory())
+	f = append(f, s.PerCallPolicies...)
+	f = append(f,
+		s.throttlePolicy(),
+		azblob.NewRetryPolicyFactory(o.Retry),
+		spanStatusPolicy())
+	f = append(f, s.PerRetryPolicies...)
+
+	if s.APIVersion != "" {
+		f = append(f, s.apiVersionPolicy())
+	}
+	f = append(f, leaseBreakPolicy())
+	if s.rotatesCredential() {
+		f = append(f, s.credentialRefreshPolicy())
+	}
+
+	if creds != nil {
+		f = append(f, creds)
+	}
+
+	f = append(f,
+		azblob.NewRequestLogPolicyFactory(o.RequestLog),
+		pipeline.MethodFactoryMarker())
+
+	return pipeline.NewPipeline(f, pipeline.Options{HTTPSender: o.HTTPSender, Log: o.Log})
+}
+
+// rotatingSharedKey is a shared key credential whose key can be replaced
+// while requests are in flight.
+type rotatingSharedKey struct {
+	cred atomic.Value // *azblob.SharedKeyCredential
+}
+
+func newRotatingSharedKey(accountName, accountKey string) (*rotatingSharedKey, error) {
+	r := &rotatingSharedKey{}
+	if err := r.SetAccountKey(accountName, accountKey); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingSharedKey) SetAccountKey(accountName, accountKey string) error {
+	cred, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return err
+	}
+	r.cred.Store(cred)
+	return nil
+}
+
+func (r *rotatingSharedKey) New(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.Policy {
+	return pipeline.PolicyFunc(func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+		cred := r.cred.Load().(*azblob.SharedKeyCredential)
+		return cred.New(next, po).Do(ctx, request)
+	})
+}
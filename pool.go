@@ -0,0 +1,120 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/caddyserver/caddy/v2"
+)
+
+// clientPool shares HTTP clients and Azure AD tokens between the storages
+// of a config, e.g. one per site, that reach the same account the same way,
+// so they reuse connections and don't each request their own tokens.
+var clientPool = caddy.NewUsagePool()
+
+// pooledClient is what storages with the same poolKey share. Its context
+// stops the token refreshers once the last of them is closed.
+type pooledClient struct {
+	httpClient *http.Client
+	blobClient *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	tokensMu sync.Mutex
+	tokens   map[string]azblob.TokenCredential
+}
+
+// Destruct is called by the pool when the last storage releases c.
+func (c *pooledClient) Destruct() error {
+	c.cancel()
+	c.httpClient.CloseIdleConnections()
+	c.blobClient.CloseIdleConnections()
+	return nil
+}
+
+// poolKey identifies the account, the identity and the transport settings.
+// It is hashed as it includes the client certificate and secret.
+func (s *Storage) poolKey() string {
+	h := sha256.New()
+	for _, v := range []string{
+		s.AccountName, s.Endpoint,
+		s.TenantID, s.ClientID, s.FederatedTokenFile,
+		s.Certificate, s.CertificatePath, s.CertificatePassword, s.CertificatePasswordFile,
+		s.ClientSecret, s.ClientSecretFile,
+		s.Proxy, s.CACertFile, s.TLSServerName,
+		fmt.Sprint(s.TLSInsecureSkipVerify),
+		fmt.Sprint(s.MaxIdleConns, s.MaxIdleConnsPerHost, s.MaxConnsPerHost, s.IdleConnTimeout, s.KeepAlive, s.DisableHTTP2),
+	} {
+		fmt.Fprintf(h, "%q\n", v)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// acquireClient sets the HTTP clients of s from the pool, creating them for
+// the first storage with its settings. It must be paired with
+// releaseClient.
+func (s *Storage) acquireClient() error {
+	key := s.poolKey()
+	val, _, err := clientPool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		httpClient, err := s.newHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		c := &pooledClient{
+			httpClient: httpClient,
+			blobClient: httpClient,
+			tokens:     make(map[string]azblob.TokenCredential),
+		}
+		if s.TLSServerName != "" {
+			c.blobClient = withServerName(httpClient, s.TLSServerName)
+		}
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		return c, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.clientKey = key
+	s.client = val.(*pooledClient)
+	s.httpClient, s.blobClient = s.client.httpClient, s.client.blobClient
+	return nil
+}
+
+// releaseClient gives the clients of s back to the pool.
+func (s *Storage) releaseClient() {
+	if s.client == nil {
+		return
+	}
+	clientPool.Delete(s.clientKey)
+	s.client = nil
+}
+
+// sharedToken returns the token credential of the Azure AD auth mode,
+// shared with the other storages of the pooled client.
+func (s *Storage) sharedToken(mode string) (azblob.TokenCredential, error) {
+	c := s.client
+	c.tokensMu.Lock()
+	defer c.tokensMu.Unlock()
+
+	if tc, ok := c.tokens[mode]; ok {
+		return tc, nil
+	}
+
+	cred, err := s.newAzureADCredential(mode)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := s.newTokenCredential(c.ctx, cred)
+	if err != nil {
+		return nil, err
+	}
+	c.tokens[mode] = tc
+	return tc, nil
+}
@@ -0,0 +1,159 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// replicaQueueSize bounds the writes waiting for the replica. Writes
+	// beyond it are dropped until the sweep of the next start.
+	replicaQueueSize = 1024
+
+	replicaRetries    = 3
+	replicaRetryDelay = 2 * time.Second
+)
+
+// replicaOp is a write to mirror to the replica, the store of value unless
+// it is a delete.
+type replicaOp struct {
+	key    string
+	value  []byte
+	delete bool
+}
+
+// startReplica mirrors writes to the replica in the background, after
+// bringing it up to date with a sweep.
+func (s *Storage) startReplica() {
+	s.replicaQueue = make(chan replicaOp, replicaQueueSize)
+	go func() {
+		// Without listing only new writes are mirrored.
+		if !s.NoList {
+			s.sweepReplica(s.ctx)
+		}
+		s.replicateQueue()
+	}()
+}
+
+// replicateStore queues key to be written to the replica.
+func (s *Storage) replicateStore(key string, value []byte) {
+	s.enqueueReplica(replicaOp{key: key, value: append([]byte(nil), value...)})
+}
+
+// replicateDelete queues key to be deleted from the replica.
+func (s *Storage) replicateDelete(key string) {
+	s.enqueueReplica(replicaOp{key: key, delete: true})
+}
+
+func (s *Storage) enqueueReplica(op replicaOp) {
+	select {
+	case s.replicaQueue <- op:
+	default:
+		s.logger.Warn("Replica queue full, dropping write until the next sweep", zap.String("key", op.key))
+	}
+}
+
+// replicateQueue applies queued writes to the replica until the storage is
+// closed, retrying each a few times.
+func (s *Storage) replicateQueue() {
+	for {
+		var op replicaOp
+		select {
+		case <-s.ctx.Done():
+			return
+		case op = <-s.replicaQueue:
+		}
+
+		var err error
+		for attempt := 0; attempt < replicaRetries; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-s.ctx.Done():
+					return
+				case <-time.After(replicaRetryDelay << (attempt - 1)):
+				}
+			}
+			if err = s.applyReplica(s.ctx, op); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			s.logger.Error("Replica Error", zap.String("key", op.key), s.errField(err))
+		}
+	}
+}
+
+func (s *Storage) applyReplica(ctx context.Context, op replicaOp) error {
+	if op.delete {
+		err := s.Replica.Delete(ctx, op.key)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return s.Replica.Store(ctx, op.key, op.value)
+}
+
+// sweepReplica copies every key that is missing from the replica or older
+// there. Keys only present in the replica are left alone, so a
+// misconfigured primary can't empty the standby.
+func (s *Storage) sweepReplica(ctx context.Context) {
+	keys, err := s.List(ctx, "", true)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		s.logger.Error("Replica Sweep Error", s.errField(err))
+		return
+	}
+
+	var copied int
+	for _, key := range keys {
+		// Locks and health check probes belong to running instances.
+		if strings.HasPrefix(key, "locks/") || strings.HasPrefix(key, "healthcheck/") {
+			continue
+		}
+
+		outdated, err := s.replicaOutdated(ctx, key)
+		if err == nil && outdated {
+			var value []byte
+			value, err = s.Load(ctx, key)
+			if err == nil {
+				err = s.Replica.Store(ctx, key, value)
+			}
+			if err == nil {
+				copied++
+			}
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			if ctx.Err() != nil {
+				return
+			}
+			s.logger.Warn("Replica Sweep Error", zap.String("key", key), s.errField(err))
+		}
+	}
+	s.logger.Info("Replica sweep finished", zap.Int("keys", len(keys)), zap.Int("copied", copied))
+}
+
+// replicaOutdated reports whether the replica lacks key or has an older
+// version of it.
+func (s *Storage) replicaOutdated(ctx context.Context, key string) (bool, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	replicaInfo, err := s.Replica.Stat(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return replicaInfo.Modified.Before(info.Modified), nil
+}
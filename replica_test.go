@@ -0,0 +1,57 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// eventually polls cond until it holds, failing the test after 5 seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestReplica(t *testing.T) {
+	ctx := context.Background()
+	container := "test-" + uuid.NewString()
+	replica := newMemoryStorage(t)
+
+	// Keys stored before the replica was configured are swept to it.
+	before := newMemoryContainerStorage(t, container)
+	if err := before.Store(ctx, "swept", []byte("swept")); err != nil {
+		t.Fatal(err)
+	}
+	s := newMemoryContainerStorage(t, container, func(o *Options) { o.Replica = replica })
+	eventually(t, "the sweep", func() bool { return replica.Exists(ctx, "swept") })
+
+	if err := s.Store(ctx, "key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, "empty", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the stores", func() bool {
+		value, err := replica.Load(ctx, "empty")
+		return err == nil && len(value) == 0 && replica.Exists(ctx, "key")
+	})
+
+	if err := s.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the delete", func() bool {
+		_, err := replica.Load(ctx, "key")
+		return errors.Is(err, fs.ErrNotExist)
+	})
+	if !replica.Exists(ctx, "empty") {
+		t.Fatal("empty value was deleted from the replica")
+	}
+}
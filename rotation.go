@@ -0,0 +1,216 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"go.uber.org/zap"
+)
+
+const (
+	// credentialRecheckInterval keeps a burst of rejected requests from
+	// re-reading the credential source for every one of them.
+	credentialRecheckInterval = 30 * time.Second
+
+	// credentialFileCheckInterval is how often the modification time of a
+	// credential file is checked.
+	credentialFileCheckInterval = 10 * time.Second
+)
+
+// rotatingSAS is a SAS token credential whose token can be replaced while
+// requests are in flight.
+type rotatingSAS struct {
+	token atomic.Value // string
+}
+
+func newRotatingSAS(token string) *rotatingSAS {
+	r := &rotatingSAS{}
+	r.SetToken(token)
+	return r
+}
+
+func (r *rotatingSAS) SetToken(token string) {
+	r.token.Store(strings.TrimPrefix(token, "?"))
+}
+
+func (r *rotatingSAS) New(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.Policy {
+	return pipeline.PolicyFunc(func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+		signed := request.Copy()
+		if token := r.token.Load().(string); token != "" {
+			if signed.URL.RawQuery != "" {
+				signed.URL.RawQuery += "&"
+			}
+			signed.URL.RawQuery += token
+		}
+		return next.Do(ctx, signed)
+	})
+}
+
+// rotatesCredential reports whether the account key or SAS token is read
+// from a source that can change while Caddy runs.
+func (s *Storage) rotatesCredential() bool {
+	switch s.authMode() {
+	case AuthModeSharedKey:
+		return s.keyVault != nil || s.AccountKeyFile != ""
+	case AuthModeSAS:
+		return s.SASTokenFile != ""
+	}
+	return false
+}
+
+// readCredential reads the account key or SAS token from Key Vault or its
+// file.
+func (s *Storage) readCredential(ctx context.Context) (string, error) {
+	if s.authMode() == AuthModeSharedKey && s.keyVault != nil {
+		return fetchSecret(ctx, s.keyVault, s.AccountKeySecretName)
+	}
+
+	file := s.credentialFile()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	return value, nil
+}
+
+// credentialFile is the file the credential is read from, if any.
+func (s *Storage) credentialFile() string {
+	switch s.authMode() {
+	case AuthModeSharedKey:
+		if s.keyVault == nil {
+			return s.AccountKeyFile
+		}
+	case AuthModeSAS:
+		return s.SASTokenFile
+	}
+	return ""
+}
+
+// rotateCredential re-reads the credential and switches the pipeline over
+// to it if it changed, reporting whether it did.
+func (s *Storage) rotateCredential(ctx context.Context) (bool, error) {
+	s.credMu.Lock()
+	defer s.credMu.Unlock()
+
+	s.credChecked = time.Now()
+	value, err := s.readCredential(ctx)
+	if err != nil || value == s.credential {
+		return false, err
+	}
+
+	if s.sasToken != nil {
+		s.sasToken.SetToken(value)
+	} else if err := s.sharedKey.SetAccountKey(s.AccountName, value); err != nil {
+		return false, err
+	}
+	s.credential = value
+	s.credRotated = time.Now()
+	s.logger.Info("Credential rotated", zap.String("auth_mode", s.authMode()))
+	return true, nil
+}
+
+// refreshCredential rotates the credential after a request sent at sent was
+// rejected, reporting whether the request should be retried with a new one.
+func (s *Storage) refreshCredential(ctx context.Context, sent time.Time) bool {
+	s.credMu.Lock()
+	rotated, checked := s.credRotated, s.credChecked
+	s.credMu.Unlock()
+
+	// Another request already picked up the new credential.
+	if rotated.After(sent) {
+		return true
+	}
+	if time.Since(checked) < credentialRecheckInterval {
+		return false
+	}
+
+	changed, err := s.rotateCredential(ctx)
+	if err != nil {
+		s.logger.Error("Credential Refresh Error", s.errField(err))
+	}
+	return changed
+}
+
+// refreshCredentials re-reads the credential every AccountKeyRefresh, and a
+// credential file as soon as it changes, until the storage is closed, so a
+// rotation is picked up before the old credential is revoked.
+func (s *Storage) refreshCredentials() {
+	interval := time.Duration(s.AccountKeyRefresh)
+	if interval <= 0 {
+		interval = defaultAccountKeyRefresh
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	file := s.credentialFile()
+	var fileCheck <-chan time.Time
+	var modified time.Time
+	if file != "" {
+		fileTicker := time.NewTicker(credentialFileCheckInterval)
+		defer fileTicker.Stop()
+		fileCheck = fileTicker.C
+		if info, err := os.Stat(file); err == nil {
+			modified = info.ModTime()
+		}
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-fileCheck:
+			// Stat follows the symlinks Kubernetes swaps on a secret update.
+			info, err := os.Stat(file)
+			if err != nil || info.ModTime().Equal(modified) {
+				continue
+			}
+			modified = info.ModTime()
+		}
+
+		if _, err := s.rotateCredential(s.ctx); err != nil && s.ctx.Err() == nil {
+			s.logger.Error("Credential Refresh Error", s.errField(err))
+		}
+	}
+}
+
+// isAuthFailure reports whether err is the service rejecting the
+// credential of a request.
+func isAuthFailure(err error) bool {
+	resp := errorResponse(err)
+	if resp == nil {
+		return false
+	}
+	code := resp.StatusCode
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+// credentialRefreshPolicy retries a request rejected with 401 or 403 once
+// if re-reading the credential turned up a new one, so a rotated account
+// key or SAS token doesn't fail requests until the next refresh.
+func (s *Storage) credentialRefreshPolicy() pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			sent := time.Now()
+			resp, err := next.Do(ctx, request)
+			if !isAuthFailure(err) || !s.refreshCredential(ctx, sent) {
+				return resp, err
+			}
+			if err := request.RewindBody(); err != nil {
+				return resp, err
+			}
+			return next.Do(ctx, request)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// newSecondaryURL returns the container on the read-only secondary endpoint
+// of a geo-redundant account, reached with the same pipeline as primary.
+func (s *Storage) newSecondaryURL(primary azblob.ContainerURL) (azblob.ContainerURL, error) {
+	u := primary.URL()
+
+	if s.SecondaryEndpoint != "" {
+		endpoint, err := url.Parse(strings.TrimSuffix(s.SecondaryEndpoint, "/"))
+		if err != nil {
+			return azblob.ContainerURL{}, fmt.Errorf("parsing secondary_endpoint: %v", err)
+		}
+		if endpoint.Scheme != "https" && !s.InsecureAllowHTTP {
+			return azblob.ContainerURL{}, fmt.Errorf("secondary_endpoint %s is not https, set insecure_allow_http to allow it", s.SecondaryEndpoint)
+		}
+		u.Scheme, u.Host = endpoint.Scheme, endpoint.Host
+		u.Path = endpoint.Path + "/" + path.Base(u.Path)
+	} else {
+		if s.Endpoint != "" {
+			return azblob.ContainerURL{}, fmt.Errorf("read_secondary with a custom endpoint requires secondary_endpoint")
+		}
+		// <account>.blob.core.windows.net becomes
+		// <account>-secondary.blob.core.windows.net.
+		i := strings.Index(u.Host, ".")
+		if i < 0 {
+			return azblob.ContainerURL{}, fmt.Errorf("can't derive the secondary endpoint of %s, set secondary_endpoint", u.Host)
+		}
+		u.Host = u.Host[:i] + "-secondary" + u.Host[i:]
+	}
+
+	return azblob.NewContainerURL(u, s.pipeline), nil
+}
+
+// useSecondary reports whether a failed read should be retried on the
+// secondary endpoint, which is the case when the primary region appears to
+// be down rather than the request being invalid.
+func (s *Storage) useSecondary(ctx context.Context, err error) bool {
+	if s.secondaryURL == nil || err == nil || ctx.Err() != nil || isNotFound(err) {
+		return false
+	}
+
+	var serr azblob.StorageError
+	if errors.As(err, &serr) {
+		resp := serr.Response()
+		return resp != nil && resp.StatusCode >= 500
+	}
+
+	// No response at all, e.g. a DNS or connection failure.
+	return true
+}
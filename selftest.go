@@ -0,0 +1,175 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// selfTestLockWait is how long a contended Lock is expected to block.
+const selfTestLockWait = 3 * time.Second
+
+// selfTestCheck is one step of the certmagic.Storage contract.
+type selfTestCheck struct {
+	name string
+	run  func(ctx context.Context, s *Storage, dir string) error
+}
+
+// selfTestChecks run in order against keys below a fresh directory, later
+// checks rely on the keys stored by earlier ones.
+var selfTestChecks = []selfTestCheck{
+	{"store", func(ctx context.Context, s *Storage, dir string) error {
+		for _, key := range []string{"one", "sub/two", "sub/three"} {
+			if err := s.Store(ctx, path.Join(dir, key), []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"load", func(ctx context.Context, s *Storage, dir string) error {
+		value, err := s.Load(ctx, path.Join(dir, "sub/two"))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(value, []byte("sub/two")) {
+			return fmt.Errorf("loaded %q, stored %q", value, "sub/two")
+		}
+		return nil
+	}},
+	{"load missing key", func(ctx context.Context, s *Storage, dir string) error {
+		_, err := s.Load(ctx, path.Join(dir, "missing"))
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("expected fs.ErrNotExist, got %v", err)
+		}
+		return nil
+	}},
+	{"exists", func(ctx context.Context, s *Storage, dir string) error {
+		if !s.Exists(ctx, path.Join(dir, "one")) {
+			return fmt.Errorf("stored key does not exist")
+		}
+		if s.Exists(ctx, path.Join(dir, "missing")) {
+			return fmt.Errorf("missing key exists")
+		}
+		return nil
+	}},
+	{"stat", func(ctx context.Context, s *Storage, dir string) error {
+		info, err := s.Stat(ctx, path.Join(dir, "one"))
+		if err != nil {
+			return err
+		}
+		if !info.IsTerminal || info.Modified.IsZero() {
+			return fmt.Errorf("key stats as %+v", info)
+		}
+
+		info, err = s.Stat(ctx, path.Join(dir, "sub"))
+		if err != nil {
+			return err
+		}
+		if info.IsTerminal {
+			return fmt.Errorf("directory stats as a terminal key")
+		}
+
+		if _, err := s.Stat(ctx, path.Join(dir, "missing")); !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("expected fs.ErrNotExist, got %v", err)
+		}
+		return nil
+	}},
+	{"list", func(ctx context.Context, s *Storage, dir string) error {
+		keys, err := s.List(ctx, dir, false)
+		return expectKeys(dir, keys, err, "one", "sub")
+	}},
+	{"list recursive", func(ctx context.Context, s *Storage, dir string) error {
+		keys, err := s.List(ctx, dir, true)
+		return expectKeys(dir, keys, err, "one", "sub/three", "sub/two")
+	}},
+	{"lock contention", func(ctx context.Context, s *Storage, dir string) error {
+		key := path.Join(dir, "lock")
+		if err := s.Lock(ctx, key); err != nil {
+			return err
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, selfTestLockWait)
+		err := s.Lock(waitCtx, key)
+		cancel()
+		if err == nil {
+			s.Unlock(ctx, key)
+			return fmt.Errorf("lock was acquired twice")
+		}
+
+		if err := s.Unlock(ctx, key); err != nil {
+			return err
+		}
+		if err := s.Lock(ctx, key); err != nil {
+			return fmt.Errorf("relocking after unlock: %v", err)
+		}
+		return s.Unlock(ctx, key)
+	}},
+	{"delete", func(ctx context.Context, s *Storage, dir string) error {
+		key := path.Join(dir, "one")
+		if err := s.Delete(ctx, key); err != nil {
+			return err
+		}
+		if _, err := s.Load(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("deleted key still loads: %v", err)
+		}
+		return nil
+	}},
+	{"delete directory", func(ctx context.Context, s *Storage, dir string) error {
+		if err := s.Delete(ctx, path.Join(dir, "sub")); err != nil {
+			return err
+		}
+		keys, err := s.List(ctx, dir, true)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if len(keys) > 0 {
+			return fmt.Errorf("keys left after deleting their directory: %v", keys)
+		}
+		return nil
+	}},
+}
+
+// expectKeys checks a List result against the expected keys below dir.
+func expectKeys(dir string, keys []string, err error, want ...string) error {
+	if err != nil {
+		return err
+	}
+	for i := range want {
+		want[i] = path.Join(dir, want[i])
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		return fmt.Errorf("listed %v, expected %v", keys, want)
+	}
+	return nil
+}
+
+// selfTest runs the certmagic.Storage contract against s below a random
+// directory and removes it afterwards. It returns how many checks failed.
+func selfTest(ctx context.Context, s *Storage) int {
+	dir := "selftest/" + uuid.NewString()
+	defer func() {
+		s.DeleteAll(context.Background(), dir+"/")
+		s.DeleteAll(context.Background(), path.Join("locks", dir)+"/")
+	}()
+
+	var failed int
+	for _, check := range selfTestChecks {
+		start := time.Now()
+		if err := check.run(ctx, s, dir); err != nil {
+			fmt.Printf("FAIL %s: %v\n", check.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s (%s)\n", check.name, time.Since(start).Round(time.Millisecond))
+	}
+	return failed
+}
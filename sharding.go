@@ -0,0 +1,125 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// shard is the container a class of keys is stored in.
+type shard struct {
+	name         string
+	containerURL azblob.ContainerURL
+	secondaryURL *azblob.ContainerURL
+}
+
+// shardContainers maps the top level directory of certmagic's key layout
+// to the container configured for it, if any.
+func (s *Storage) shardContainers() map[string]string {
+	return map[string]string{
+		"certificates": s.CertificatesContainer,
+		"acme":         s.AccountsContainer,
+		"ocsp":         s.OCSPContainer,
+		"locks":        s.LocksContainer,
+	}
+}
+
+// newShards returns the containers of the key classes that don't use the
+// default container. They are in the same account and reached with the same
+// pipeline as primary.
+func (s *Storage) newShards(primary azblob.ContainerURL) (map[string]shard, error) {
+	shards := make(map[string]shard)
+	for class, name := range s.shardContainers() {
+		if name == "" || name == s.ContainerName {
+			continue
+		}
+		if s.authMode() == AuthModeSAS && s.SASURL != "" {
+			return nil, fmt.Errorf("per class containers can not be used with container_sas_url, which is scoped to a single container")
+		}
+
+		u := primary.URL()
+		u.Path = path.Join(path.Dir(u.Path), name)
+		shards[class] = shard{name: name, containerURL: azblob.NewContainerURL(u, s.pipeline)}
+	}
+	return shards, nil
+}
+
+// shardFor returns the shard key is stored in.
+func (s *Storage) shardFor(key string) shard {
+	class := strings.TrimPrefix(key, "/")
+	if i := strings.Index(class, "/"); i >= 0 {
+		class = class[:i]
+	}
+	if sh, ok := s.shards[class]; ok {
+		return sh
+	}
+	return shard{name: s.ContainerName, containerURL: s.containerURL, secondaryURL: s.secondaryURL}
+}
+
+// container returns the container key is stored in.
+func (s *Storage) container(key string) azblob.ContainerURL {
+	return s.shardFor(key).containerURL
+}
+
+// allShards returns the default container followed by every other
+// container keys may be stored in.
+func (s *Storage) allShards() []shard {
+	all := []shard{s.shardFor("")}
+	seen := map[string]bool{s.ContainerName: true}
+	for _, class := range []string{"acme", "certificates", "locks", "ocsp"} {
+		sh, ok := s.shards[class]
+		if !ok || seen[sh.name] {
+			continue
+		}
+		seen[sh.name] = true
+		all = append(all, sh)
+	}
+	return all
+}
+
+// listShards lists prefix in every container keys below it may be stored
+// in, on the secondary endpoint if secondary is set. Only keys that belong
+// into a container are taken from it, so each key is listed once.
+// Recursive listings are walked in parallel and sorted afterwards.
+func (s *Storage) listShards(ctx context.Context, prefix string, recursive, secondary bool) ([]string, error) {
+	if recursive {
+		keys := make([]string, 0)
+		err := s.walkShards(ctx, prefix, secondary, func(page []string) error {
+			keys = append(keys, page...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(keys)
+		return keys, nil
+	}
+
+	shards := []shard{s.shardFor(prefix)}
+	if strings.Trim(prefix, "/") == "" {
+		shards = s.allShards()
+	}
+
+	keys := make([]string, 0)
+	for _, sh := range shards {
+		c := sh.containerURL
+		if secondary {
+			c = *sh.secondaryURL
+		}
+
+		found, err := s.listHierarchy(ctx, c, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range found {
+			if len(shards) == 1 || s.shardFor(key).name == sh.name {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
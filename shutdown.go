@@ -0,0 +1,104 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// defaultShutdownTimeout bounds how long Close waits for in-flight work.
+const defaultShutdownTimeout = 10 * time.Second
+
+// trackedSpan marks an operation as finished when its span ends.
+type trackedSpan struct {
+	trace.Span
+	done func()
+}
+
+func (t trackedSpan) End(options ...trace.SpanEndOption) {
+	t.done()
+	t.Span.End(options...)
+}
+
+func (s *Storage) shutdownTimeout() time.Duration {
+	if s.ShutdownTimeout > 0 {
+		return time.Duration(s.ShutdownTimeout)
+	}
+	return defaultShutdownTimeout
+}
+
+// Close stops the background work of the storage. Within ShutdownTimeout,
+// it waits for operations in flight, releases the locks this instance
+// holds so other instances don't wait for their leases to expire, and lets
+// the replica and notification queues drain. Calling it again is a no-op.
+func (s *Storage) Close() error {
+	s.closeOnce.Do(func() {
+		s.inflightMu.Lock()
+		s.closed = true
+		s.inflightMu.Unlock()
+		close(s.closing)
+		deadline := time.Now().Add(s.shutdownTimeout())
+
+		if !waitTimeout(&s.inflight, deadline) {
+			s.logger.Warn("Shutting down with operations in flight")
+		}
+		s.releaseLocks(deadline)
+		s.drainQueues(deadline)
+
+		s.cancel()
+		if s.failover != nil {
+			s.failover.Close()
+		}
+		closeTenants(s.tenants)
+		s.releaseClient()
+	})
+	return nil
+}
+
+// waitTimeout waits for wg until deadline, reporting whether it finished.
+func waitTimeout(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// releaseLocks unlocks every lock still held by this instance.
+func (s *Storage) releaseLocks(deadline time.Time) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	for _, key := range s.heldLocks() {
+		if err := s.unlock(ctx, key); err != nil {
+			s.logger.Warn("Lock Release Error", zap.String("key", key), s.errField(err))
+			continue
+		}
+		s.logger.Info("Released lock on shutdown", zap.String("key", key))
+	}
+}
+
+// drainQueues waits until the replica and notification queues are empty.
+func (s *Storage) drainQueues(deadline time.Time) {
+	for len(s.replicaQueue)+len(s.notifyQueue) > 0 {
+		if time.Now().After(deadline) {
+			s.logger.Warn("Shutting down with queued writes",
+				zap.Int("replica", len(s.replicaQueue)),
+				zap.Int("notify", len(s.notifyQueue)))
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
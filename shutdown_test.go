@@ -0,0 +1,69 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCloseRejectsNewOperations(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStorage(t)
+	if err := s.Store(ctx, "key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if err := s.Store(ctx, "key", []byte("value")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Store after Close: expected ErrClosed, got %v", err)
+	}
+	if _, err := s.Load(ctx, "key"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Load after Close: expected ErrClosed, got %v", err)
+	}
+	if err := s.Lock(ctx, "key"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Lock after Close: expected ErrClosed, got %v", err)
+	}
+	if s.Exists(ctx, "key") {
+		t.Error("Exists after Close reported the key")
+	}
+}
+
+func TestCloseWithOperationsInFlight(t *testing.T) {
+	ctx := context.Background()
+	container := "test-" + uuid.NewString()
+	s := newMemoryContainerStorage(t, container)
+	other := newMemoryContainerStorage(t, container)
+	if err := s.Lock(ctx, "held"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Operations keep starting while Close waits for those in flight.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if err := s.Store(ctx, "busy", []byte("value")); errors.Is(err, ErrClosed) {
+					return
+				}
+				s.Exists(ctx, "busy")
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+	wg.Wait()
+
+	// The lock was released rather than left to its lease.
+	lockCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := other.Lock(lockCtx, "held"); err != nil {
+		t.Fatalf("lock held at Close was not released: %v", err)
+	}
+	other.Unlock(ctx, "held")
+}
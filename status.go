@@ -0,0 +1,214 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// StorageStatus describes a Storage and what it holds, as served on the
+// admin API at /azblob/status.
+type StorageStatus struct {
+	Account    string   `json:"account,omitempty"`
+	Container  string   `json:"container"`
+	Containers []string `json:"containers,omitempty"`
+	Prefix     string   `json:"prefix,omitempty"`
+	AuthMode   string   `json:"auth_mode"`
+	APIVersion string   `json:"api_version"`
+	Instance   string   `json:"instance"`
+
+	// Usage counts the keys and their stored bytes per top level
+	// directory, e.g. certificates or acme.
+	Usage      []PrefixUsage `json:"usage"`
+	TotalKeys  int           `json:"total_keys"`
+	TotalBytes int64         `json:"total_bytes"`
+
+	// LastSuccess is when each operation last succeeded.
+	LastSuccess map[string]time.Time `json:"last_success"`
+	HeldLocks   []string             `json:"held_locks"`
+}
+
+// PrefixUsage is the number of keys and bytes below a top level directory.
+type PrefixUsage struct {
+	Prefix string `json:"prefix"`
+	Keys   int    `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// MarshalLogObject logs the usage as {"keys": ..., "bytes": ...}.
+func (u PrefixUsage) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddInt("keys", u.Keys)
+	enc.AddInt64("bytes", u.Bytes)
+	return nil
+}
+
+// Status lists every container of s to report its usage alongside the
+// configuration and the locks held by this instance.
+func (s *Storage) Status(ctx context.Context) (StorageStatus, error) {
+	status := StorageStatus{
+		Account:     s.AccountName,
+		Container:   s.ContainerName,
+		Prefix:      s.Prefix,
+		AuthMode:    s.authMode(),
+		APIVersion:  s.apiVersion(),
+		Instance:    s.uuid,
+		LastSuccess: s.lastSuccesses(),
+		HeldLocks:   s.heldLocks(),
+	}
+
+	for _, sh := range s.allShards() {
+		if sh.name != s.ContainerName {
+			status.Containers = append(status.Containers, sh.name)
+		}
+	}
+
+	usage, err := s.Usage(ctx)
+	if errors.Is(err, ErrListUnsupported) {
+		// Without listing there is only the configuration to report.
+		return status, nil
+	}
+	if err != nil {
+		return StorageStatus{}, err
+	}
+	status.Usage = usage
+	for _, u := range usage {
+		status.TotalKeys += u.Keys
+		status.TotalBytes += u.Bytes
+	}
+	return status, nil
+}
+
+// Usage counts the stored keys and bytes per top level directory, which
+// are the certmagic key classes: certificates, acme, ocsp and locks.
+func (s *Storage) Usage(ctx context.Context) ([]PrefixUsage, error) {
+	if s.NoList {
+		return nil, ErrListUnsupported
+	}
+
+	usage := make(map[string]*PrefixUsage)
+	for _, sh := range s.allShards() {
+		if err := s.addUsage(ctx, sh, usage); err != nil {
+			return nil, err
+		}
+	}
+
+	all := make([]PrefixUsage, 0, len(usage))
+	for _, u := range usage {
+		all = append(all, *u)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Prefix < all[j].Prefix })
+	return all, nil
+}
+
+// reportUsage logs and exports the usage every UsageReportInterval until
+// the storage is closed.
+func (s *Storage) reportUsage() {
+	ticker := time.NewTicker(time.Duration(s.UsageReportInterval))
+	defer ticker.Stop()
+
+	for {
+		usage, err := s.Usage(s.ctx)
+		if err != nil && s.ctx.Err() == nil {
+			s.logger.Error("Usage Error", s.errField(err))
+		}
+		if err == nil {
+			fields := make([]zap.Field, 0, len(usage))
+			for _, u := range usage {
+				observeUsage(s.ContainerName, u)
+				fields = append(fields, zap.Object(u.Prefix, u))
+			}
+			s.logger.Info("Storage usage", fields...)
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// addUsage counts the keys of sh by their top level directory. Only keys
+// that belong into sh are counted, like listShards does.
+func (s *Storage) addUsage(ctx context.Context, sh shard, usage map[string]*PrefixUsage) error {
+	ctx, cancel := s.withTimeout(ctx, s.ListTimeout)
+	defer cancel()
+
+	var prefix string
+	if s.Prefix != "" {
+		prefix = s.Prefix + "/"
+	}
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		ls, err := sh.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Details: azblob.BlobListingDetails{Metadata: s.HNS},
+			Prefix:  prefix,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, v := range ls.Segment.BlobItems {
+			if s.HNS && isFolder(v.Metadata) || s.isLockBlob(v.Name) {
+				continue
+			}
+			key := s.keyName(v.Name)
+			if s.shardFor(key).name != sh.name {
+				continue
+			}
+
+			top := key
+			if i := strings.Index(key, "/"); i >= 0 {
+				top = key[:i]
+			}
+			u, ok := usage[top]
+			if !ok {
+				u = &PrefixUsage{Prefix: top}
+				usage[top] = u
+			}
+			u.Keys++
+			if v.Properties.ContentLength != nil {
+				u.Bytes += *v.Properties.ContentLength
+			}
+		}
+		marker = ls.NextMarker
+	}
+	return nil
+}
+
+// recordSuccess remembers when op last succeeded.
+func (s *Storage) recordSuccess(op string) {
+	s.statusMu.Lock()
+	s.lastSuccess[op] = time.Now()
+	s.statusMu.Unlock()
+}
+
+func (s *Storage) lastSuccesses() map[string]time.Time {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	last := make(map[string]time.Time, len(s.lastSuccess))
+	for op, t := range s.lastSuccess {
+		last[op] = t
+	}
+	return last
+}
+
+// heldLocks returns the keys this instance holds a lock on.
+func (s *Storage) heldLocks() []string {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+
+	keys := make([]string, 0, len(s.locks))
+	for key := range s.locks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
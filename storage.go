@@ -0,0 +1,1844 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const defaultEndpointSuffix = "blob.core.windows.net"
+
+// Options configures a Storage. The JSON names double as the Caddy config.
+type Options struct {
+	// Logger receives the storage logs, defaults to a no-op logger.
+	Logger *zap.Logger `json:"-"`
+
+	// LogLevel raises the minimum level of the storage logs, e.g. to only
+	// log errors. Routine operations are logged at debug level.
+	LogLevel string `json:"log_level,omitempty"`
+
+	// DebugHTTP logs every request and response of the Azure SDK, including
+	// its retries, at debug level.
+	DebugHTTP bool `json:"debug_http,omitempty"`
+
+	// TracerProvider is used for spans when Tracing is enabled, defaults to
+	// the global OpenTelemetry provider.
+	TracerProvider trace.TracerProvider `json:"-"`
+
+	// PerCallPolicies are added to the request pipeline once per operation,
+	// ahead of the retries. PerRetryPolicies run for every attempt, after
+	// the retry policy and before the request is signed, so headers they
+	// set are covered by shared key signatures. Both only apply to storage
+	// requests, not to Azure AD or Key Vault.
+	PerCallPolicies  []pipeline.Factory `json:"-"`
+	PerRetryPolicies []pipeline.Factory `json:"-"`
+
+	AccountName      string `json:"account_name"`
+	AccountKey       string `json:"account_key"`
+	ContainerName    string `json:"container_name"`
+	SASToken         string `json:"sas_token,omitempty"`
+	SASURL           string `json:"sas_url,omitempty"`
+	ConnectionString string `json:"connection_string,omitempty"`
+	AuthMode         string `json:"auth_mode,omitempty"`
+
+	// ContainerSASURL is a container SAS URL that alone configures the
+	// account, container, endpoint and credentials. SASURL is its older
+	// name.
+	ContainerSASURL string `json:"container_sas_url,omitempty"`
+
+	// Endpoint overrides the blob service base URL, e.g. for Azurite
+	// (http://127.0.0.1:10000/devstoreaccount1). Plain HTTP endpoints are
+	// refused unless InsecureAllowHTTP is set.
+	Endpoint          string `json:"endpoint,omitempty"`
+	InsecureAllowHTTP bool   `json:"insecure_allow_http,omitempty"`
+
+	// BlobHost reaches the blob service at https://<BlobHost> instead of
+	// the public account hostname, e.g. a private endpoint or custom domain.
+	// TLSServerName is sent as Host and SNI and verified against the
+	// certificate of blob requests when it differs from the host they are
+	// sent to.
+	BlobHost      string `json:"blob_host,omitempty"`
+	TLSServerName string `json:"tls_server_name,omitempty"`
+
+	// Emulator targets Azurite on its default port with the well-known
+	// development account unless AccountName, AccountKey or Endpoint say
+	// otherwise, and creates the container, "caddy" unless ContainerName is
+	// set. It is also turned on by
+	// use_development_storage in the Caddyfile, AZBLOB_USE_DEVELOPMENT_STORAGE
+	// and a UseDevelopmentStorage=true connection string.
+	Emulator bool `json:"emulator,omitempty"`
+
+	// EndpointSuffix selects a sovereign cloud, e.g. blob.core.chinacloudapi.cn
+	// or blob.core.usgovcloudapi.net. Ignored when Endpoint is set.
+	EndpointSuffix string `json:"endpoint_suffix,omitempty"`
+
+	// APIVersion is the blob service version requests are sent with instead
+	// of the SDK's, e.g. 2019-02-02 for Azure Stack Hub. Options that need a
+	// newer version are refused and blob versioning is reported unsupported.
+	APIVersion string `json:"api_version,omitempty"`
+
+	// CertificatesContainer, AccountsContainer, OCSPContainer and
+	// LocksContainer store certificates, ACME account data, OCSP staples and
+	// locks in their own container of the account instead of ContainerName,
+	// e.g. to apply different lifecycle rules or access policies.
+	CertificatesContainer string `json:"certificates_container,omitempty"`
+	AccountsContainer     string `json:"accounts_container,omitempty"`
+	OCSPContainer         string `json:"ocsp_container,omitempty"`
+	LocksContainer        string `json:"locks_container,omitempty"`
+
+	// Prefix namespaces every key, e.g. "caddy/prod", so several deployments
+	// can share a container.
+	Prefix string `json:"prefix,omitempty"`
+
+	// LocksPrefix stores lock blobs below this blob prefix of the locks
+	// container instead of below Prefix/locks, so a lifecycle rule can
+	// delete abandoned locks without matching any other key. Lock blobs
+	// there are left out of listings.
+	LocksPrefix string `json:"locks_prefix,omitempty"`
+
+	// CreateContainer creates the container in New if it does not
+	// exist yet. Off by default since SAS and data plane roles usually lack
+	// the permission to create containers.
+	CreateContainer bool `json:"create_container,omitempty"`
+
+	// AccessTier is the tier new blobs are written with (Hot, Cool or
+	// Cold). Empty uses the account default.
+	AccessTier string `json:"access_tier,omitempty"`
+
+	// TierRules pick the tier by key prefix instead of AccessTier, e.g.
+	// Cool for ocsp/. Rules with After are applied by the tier sweep once
+	// a key wasn't modified for that long.
+	TierRules []TierRule `json:"tier_rules,omitempty"`
+
+	// TierSweepInterval moves blobs to the tier their rules ask for at
+	// this interval.
+	TierSweepInterval caddy.Duration `json:"tier_sweep_interval,omitempty"`
+
+	// RehydratePriority (Standard or High) makes loads of blobs a
+	// lifecycle policy moved to the archive tier start rehydrating them
+	// and fail with ErrRehydrating until they are back. Empty fails them
+	// with ErrArchived.
+	RehydratePriority string `json:"rehydrate_priority,omitempty"`
+
+	// ContentType is the Content-Type of keys whose type isn't known from
+	// their name, default application/octet-stream. Certificates, keys,
+	// JSON metadata and OCSP staples get their own type. CacheControl sets
+	// the Cache-Control header of every blob.
+	ContentType  string `json:"content_type,omitempty"`
+	CacheControl string `json:"cache_control,omitempty"`
+
+	// Metadata is added to every stored blob, e.g. the cluster name, next
+	// to the writing instance, module version and time.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Compress gzips values before they are stored. Blobs written without
+	// it are still read as they are.
+	Compress bool `json:"compress,omitempty"`
+
+	// HNS adapts Stat, List and Delete to accounts with a hierarchical
+	// namespace (ADLS Gen2), where directories are objects of their own.
+	HNS bool `json:"hns,omitempty"`
+
+	// NoList never lists the container, for credentials limited to reading,
+	// writing and deleting single blobs. List, DeleteAll and usage fail with
+	// ErrListUnsupported, Stat and Delete don't treat keys as directories.
+	NoList bool `json:"no_list,omitempty"`
+
+	// IndexTags tags blobs with the type, issuer and domain derived from
+	// their key, for tag queries and lifecycle rules. The credentials need
+	// the tag permission and the account must not have a hierarchical
+	// namespace.
+	IndexTags bool `json:"index_tags,omitempty"`
+
+	// LifecycleTags writes the index tags of IndexTags plus the expiry of
+	// certificates and OCSP staples, for the lifecycle rules of
+	// LifecyclePolicy to delete expired keys.
+	LifecycleTags bool `json:"lifecycle_tags,omitempty"`
+
+	// UndeleteOnLoad makes Load restore a missing key from soft delete
+	// before reporting it as not existing.
+	UndeleteOnLoad bool `json:"undelete_on_load,omitempty"`
+
+	// SnapshotOnWrite snapshots the current value of a key before Store
+	// overwrites it. Deleting a key also deletes its snapshots.
+	SnapshotOnWrite bool `json:"snapshot_on_write,omitempty"`
+
+	// ImmutabilityPeriod writes blobs with a time-based retention policy
+	// in ImmutabilityMode (unlocked or locked, default unlocked), LegalHold
+	// with a legal hold. Both require version-level immutability on the
+	// container.
+	ImmutabilityPeriod caddy.Duration `json:"immutability_period,omitempty"`
+	ImmutabilityMode   string         `json:"immutability_mode,omitempty"`
+	LegalHold          bool           `json:"legal_hold,omitempty"`
+
+	// EncryptionKey is a base64 encoded AES-256 customer-provided key sent
+	// with every request; Azure never stores it. EncryptionKeySHA256 is
+	// computed when empty.
+	EncryptionKey       string `json:"encryption_key,omitempty"`
+	EncryptionKeySHA256 string `json:"encryption_key_sha256,omitempty"`
+
+	// EncryptionScope writes every blob with the named account encryption
+	// scope. It can not be combined with EncryptionKey.
+	EncryptionScope string `json:"encryption_scope,omitempty"`
+
+	// ClientEncryptionKey is a base64 encoded AES-256 key used to encrypt
+	// values before they are uploaded. It can be read from Key Vault with
+	// ClientEncryptionKeyVaultURI and ClientEncryptionKeySecretName.
+	ClientEncryptionKey           string `json:"client_encryption_key,omitempty"`
+	ClientEncryptionKeyID         string `json:"client_encryption_key_id,omitempty"`
+	ClientEncryptionKeyVaultURI   string `json:"client_encryption_key_vault_uri,omitempty"`
+	ClientEncryptionKeySecretName string `json:"client_encryption_key_secret_name,omitempty"`
+
+	// ClientEncryptionPreviousKeys are retired keys that values may still
+	// be encrypted with, as "<key id>:<base64 key>" or just the base64 key.
+	// New values always use ClientEncryptionKey, Rewrap moves old ones to it.
+	ClientEncryptionPreviousKeys []string `json:"client_encryption_previous_keys,omitempty"`
+
+	TenantID           string `json:"tenant_id,omitempty"`
+	ClientID           string `json:"client_id,omitempty"`
+	FederatedTokenFile string `json:"federated_token_file,omitempty"`
+
+	// Certificate is an inline PEM certificate and private key, CertificatePath
+	// points to a PEM or PFX file.
+	Certificate         string `json:"certificate,omitempty"`
+	CertificatePath     string `json:"certificate_path,omitempty"`
+	CertificatePassword string `json:"certificate_password,omitempty"`
+
+	// CertificatePasswordFile reads CertificatePassword from a file, e.g. a
+	// mounted secret or systemd credential.
+	CertificatePasswordFile string `json:"certificate_password_file,omitempty"`
+
+	// ClientSecret is the secret of the Azure AD application for
+	// auth_mode client_secret, ClientSecretFile reads it from a file.
+	ClientSecret     string `json:"client_secret,omitempty"`
+	ClientSecretFile string `json:"client_secret_file,omitempty"`
+
+	// The account key can be read from a Key Vault secret or a file, and
+	// the SAS token from a file, instead. They are re-read every
+	// AccountKeyRefresh (default 1h), files also when they change, and
+	// whenever a request is rejected with 401 or 403, so rotation doesn't
+	// need a restart.
+	AccountKeyVaultURI   string         `json:"account_key_vault_uri,omitempty"`
+	AccountKeySecretName string         `json:"account_key_secret_name,omitempty"`
+	AccountKeyFile       string         `json:"account_key_file,omitempty"`
+	SASTokenFile         string         `json:"sas_token_file,omitempty"`
+	AccountKeyRefresh    caddy.Duration `json:"account_key_refresh,omitempty"`
+
+	// Retry policy of the Azure pipeline, zero values use the SDK defaults.
+	MaxRetries    int            `json:"max_retries,omitempty"`
+	RetryDelay    caddy.Duration `json:"retry_delay,omitempty"`
+	MaxRetryDelay caddy.Duration `json:"max_retry_delay,omitempty"`
+	TryTimeout    caddy.Duration `json:"try_timeout,omitempty"`
+
+	// DownloadRetries is how often a download interrupted mid-stream is
+	// resumed from where it broke off: 3 by default, MaxRetries if only
+	// that is set, and none if negative. DownloadEarlyCloseError fails a
+	// body that is closed while it's read instead of retrying it.
+	DownloadRetries         int  `json:"download_retries,omitempty"`
+	DownloadEarlyCloseError bool `json:"download_early_close_error,omitempty"`
+
+	// Connection pool of the transport. MaxIdleConnsPerHost defaults to 16
+	// as nearly all requests go to the account's endpoint, the other
+	// limits keep Go's defaults. KeepAlive is the TCP keep-alive interval,
+	// negative to disable them. DisableHTTP2 sticks to HTTP/1.1.
+	MaxIdleConns        int            `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int            `json:"max_idle_conns_per_host,omitempty"`
+	MaxConnsPerHost     int            `json:"max_conns_per_host,omitempty"`
+	IdleConnTimeout     caddy.Duration `json:"idle_conn_timeout,omitempty"`
+	KeepAlive           caddy.Duration `json:"keep_alive,omitempty"`
+	DisableHTTP2        bool           `json:"disable_http2,omitempty"`
+
+	// Proxy overrides the HTTPS_PROXY environment variable. CACertFile adds
+	// a PEM encoded CA, e.g. of a TLS intercepting egress proxy.
+	Proxy                 string `json:"proxy,omitempty"`
+	CACertFile            string `json:"ca_cert_file,omitempty"`
+	TLSInsecureSkipVerify bool   `json:"tls_insecure_skip_verify,omitempty"`
+
+	// BlockSize is the size up to which values are uploaded and downloaded
+	// in a single request (default 4 MiB). Larger values are split into
+	// blocks of that size, of which Parallelism (default 5) are transferred
+	// at once.
+	BlockSize   int64 `json:"block_size,omitempty"`
+	Parallelism int   `json:"parallelism,omitempty"`
+
+	// MaxValueSize is the largest value in bytes Load reads into memory
+	// (default 64 MiB, negative for no limit). Larger blobs fail with
+	// ErrTooLarge, LoadStream streams them regardless.
+	MaxValueSize int64 `json:"max_value_size,omitempty"`
+
+	// Stores and deletes are conditional on the ETag this instance last
+	// saw, so a concurrent change made by another instance is noticed.
+	// Deletes of such a key are skipped.
+	// StrictWrites fails such stores with ErrConflict instead of
+	// overwriting the change with a warning.
+	StrictWrites bool `json:"strict_writes,omitempty"`
+
+	// Per-operation timeouts, zero means no timeout besides try_timeout.
+	// StoreTimeout also covers Delete, LoadTimeout covers Stat and Exists.
+	StoreTimeout       caddy.Duration `json:"store_timeout,omitempty"`
+	LoadTimeout        caddy.Duration `json:"load_timeout,omitempty"`
+	ListTimeout        caddy.Duration `json:"list_timeout,omitempty"`
+	LockRequestTimeout caddy.Duration `json:"lock_request_timeout,omitempty"`
+
+	// ShutdownTimeout bounds how long Close waits for operations in flight,
+	// releasing held locks and queued replica writes and notifications
+	// (default 10s).
+	ShutdownTimeout caddy.Duration `json:"shutdown_timeout,omitempty"`
+
+	// LockTimeout is how long a lock stays valid without being refreshed by
+	// its owner before another instance may take it over.
+	LockTimeout caddy.Duration `json:"lock_timeout,omitempty"`
+
+	// LockLeaseDuration is the lease taken on lock blobs, 15s to 60s
+	// (default), or infinite when negative. Leases are renewed at a third of
+	// their duration.
+	LockLeaseDuration caddy.Duration `json:"lock_lease_duration,omitempty"`
+
+	// LockPollInterval is how often Lock retries a contended lock, jittered
+	// by up to half the interval. LockWaitTimeout bounds how long it waits,
+	// zero waits until the context is done.
+	LockPollInterval caddy.Duration `json:"lock_poll_interval,omitempty"`
+	LockWaitTimeout  caddy.Duration `json:"lock_wait_timeout,omitempty"`
+
+	// LockCleanup removes the lock blobs a previous run of this instance
+	// left behind, and stale ones, when the module is provisioned. Previous
+	// runs are recognized by the instance ID persisted in InstanceFile, or
+	// by the hostname without one.
+	LockCleanup  bool   `json:"lock_cleanup,omitempty"`
+	InstanceFile string `json:"instance_file,omitempty"`
+
+	// ValidateConnection fetches the container properties during Validate
+	// so bad credentials are reported at startup.
+	ValidateConnection bool `json:"validate_connection,omitempty"`
+
+	// CacheTTL enables an in-memory LRU cache of up to CacheSize (default
+	// 1000) loaded values. Stores and deletes of this instance update it
+	// right away, those of other instances are seen after the TTL.
+	CacheTTL  caddy.Duration `json:"cache_ttl,omitempty"`
+	CacheSize int            `json:"cache_size,omitempty"`
+
+	// ListCacheTTL keeps List results for a short while, e.g. 30s, so the
+	// repeated listings of certmagic's maintenance only list the container
+	// once. Writes and deletes through this instance drop affected results.
+	ListCacheTTL caddy.Duration `json:"list_cache_ttl,omitempty"`
+
+	// CacheDir keeps a copy of every stored and loaded value on local disk.
+	// Load serves that copy without waiting for Azure and refreshes it in
+	// the background when the blob changed, so existing certificates keep
+	// working while Azure is unreachable. The copies are unencrypted, so it
+	// can't be combined with ClientEncryptionKey.
+	CacheDir string `json:"cache_dir,omitempty"`
+
+	// ReadSecondary retries Load and List on the secondary endpoint of an
+	// RA-GRS or RA-GZRS account when the primary region is unavailable.
+	// SecondaryEndpoint is required with a custom Endpoint.
+	ReadSecondary     bool   `json:"read_secondary,omitempty"`
+	SecondaryEndpoint string `json:"secondary_endpoint,omitempty"`
+
+	// Failover is a storage in another account or container that Store
+	// writes to while the primary is unavailable or rejects the
+	// credentials. Keys written there are read from it until they have been
+	// copied back to the primary, which is retried every minute.
+	Failover *Options `json:"failover,omitempty"`
+
+	// Tenants store the keys of some domains or key prefixes elsewhere,
+	// e.g. in each customer's own account. Keys of no tenant, like the
+	// ACME accounts, stay in this storage.
+	Tenants []Tenant `json:"tenants,omitempty"`
+
+	// GCInterval enables a background job that removes certificates and
+	// OCSP staples expired for longer than GCRetention (default 7 days).
+	// GCArchive moves them below archive/ instead of deleting them, GCDryRun
+	// only logs what would be removed.
+	GCInterval  caddy.Duration `json:"gc_interval,omitempty"`
+	GCRetention caddy.Duration `json:"gc_retention,omitempty"`
+	GCArchive   bool           `json:"gc_archive,omitempty"`
+	GCDryRun    bool           `json:"gc_dry_run,omitempty"`
+
+	// UsageReportInterval logs the number of keys and bytes per top level
+	// directory at this interval and exports them as metrics.
+	UsageReportInterval caddy.Duration `json:"usage_report_interval,omitempty"`
+
+	// Replica is a second certmagic storage that every Store and Delete is
+	// mirrored to in the background, after a sweep on start copied the keys
+	// it lacks. In Caddy it is configured as a storage module in replica.
+	Replica certmagic.Storage `json:"-"`
+
+	// MigrateFrom is the storage this one replaces. Keys missing from the
+	// container are read from it and copied over on first load, and deletes
+	// apply to both. In Caddy it is configured as a storage module in
+	// migrate_from.
+	MigrateFrom certmagic.Storage `json:"-"`
+
+	// Hooks are called around every Store and Delete. In Caddy they are
+	// configured as modules in hooks.
+	Hooks []Hook `json:"-"`
+
+	// AuditLog appends a record of every Store, Delete, DeleteAll, Undelete
+	// and RestoreVersion to an append blob per day below this directory,
+	// e.g. "audit", with the operation, key, instance and result.
+	AuditLog string `json:"audit_log,omitempty"`
+
+	// NotifyURL receives a CertificateEvent as JSON POST in the background
+	// whenever a key below certificates/ is stored or deleted. With
+	// NotifyEventGrid it is an Event Grid topic endpoint and NotifyKey its
+	// access key, otherwise NotifyKey signs the body as HMAC-SHA256 in the
+	// X-Azblob-Signature header.
+	NotifyURL       string `json:"notify_url,omitempty"`
+	NotifyEventGrid bool   `json:"notify_event_grid,omitempty"`
+	NotifyKey       string `json:"notify_key,omitempty"`
+
+	// HealthCheck writes, reads and deletes a probe blob during provisioning
+	// and serves the result on the admin API at /azblob/health.
+	HealthCheck bool `json:"health_check,omitempty"`
+
+	// Tracing records an OpenTelemetry span for every storage operation.
+	Tracing bool `json:"tracing,omitempty"`
+
+	// ThrottleRetries is how often a request that is still throttled (429 or
+	// 503) after the SDK's retries is retried with backoff, default 3. A
+	// negative value disables it.
+	ThrottleRetries int `json:"throttle_retries,omitempty"`
+
+	// UserAgent is appended to the caddy-azblob/<version> User-Agent of
+	// requests. DisableTelemetry sends neither it nor the SDK's telemetry.
+	UserAgent        string `json:"user_agent,omitempty"`
+	DisableTelemetry bool   `json:"disable_telemetry,omitempty"`
+}
+
+// Storage is a certmagic.Storage backed by an Azure Blob Storage container.
+type Storage struct {
+	Options
+
+	logger       *zap.Logger
+	tracer       trace.Tracer
+	uuid         string
+	prevUUID     string
+	hostname     string
+	containerURL azblob.ContainerURL
+	secondaryURL *azblob.ContainerURL
+	shards       map[string]shard
+	pipeline     pipeline.Pipeline
+	sharedKey    *rotatingSharedKey
+	sasToken     *rotatingSAS
+	keyVault     *azsecrets.Client
+	accessTier   azblob.AccessTierType
+	tierRules    []tierRule
+	rehydrate    azblob.RehydratePriorityType
+	cpk          azblob.ClientProvidedKeyOptions
+	cipher       *valueCipher
+	failover     *Storage
+	tenants      []tenant
+	cache        *loadCache
+	listCache    *listCache
+	diskCache    *diskCache
+	httpClient   *http.Client
+	blobClient   *http.Client
+	client       *pooledClient
+	clientKey    string
+	memory       bool
+
+	locksMu sync.Mutex
+	locks   map[string]*heldLock
+
+	// credential is the account key or SAS token in use, when it is read
+	// from a source that may rotate it.
+	credMu      sync.Mutex
+	credential  string
+	credChecked time.Time
+	credRotated time.Time
+
+	// failoverKeys are the keys whose current value this instance wrote to
+	// the failover storage.
+	failoverMu   sync.Mutex
+	failoverKeys map[string]bool
+
+	etagsMu sync.Mutex
+	etags   map[string]azblob.ETag
+
+	healthMu sync.Mutex
+	health   HealthStatus
+
+	replicaQueue chan replicaOp
+	notifyQueue  chan CertificateEvent
+
+	auditMu   sync.Mutex
+	auditPrev string
+
+	// lastSuccess is when each instrumented operation last succeeded.
+	statusMu    sync.Mutex
+	lastSuccess map[string]time.Time
+
+	// inflight counts the running operations, closing is closed when
+	// Close starts to wait for them. closed is set under inflightMu at
+	// the same time, so no operation is added once Close waits.
+	inflightMu sync.Mutex
+	inflight   sync.WaitGroup
+	closed     bool
+	closing    chan struct{}
+	closeOnce  sync.Once
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New returns a Storage for the given options. It can be used without Caddy,
+// e.g. as certmagic.Default.Storage.
+func New(o Options) (_ *Storage, err error) {
+	s := &Storage{
+		Options: o,
+		//Used for lock ownership, each process must have its own uuid
+		uuid:         uuid.NewString(),
+		locks:        make(map[string]*heldLock),
+		failoverKeys: make(map[string]bool),
+		etags:        make(map[string]azblob.ETag),
+		lastSuccess:  make(map[string]time.Time),
+		closing:      make(chan struct{}),
+	}
+	logger, err := s.newLogger()
+	if err != nil {
+		return nil, err
+	}
+	s.logger = logger
+	s.tracer = s.newTracer()
+	if s.CacheTTL > 0 {
+		s.cache = newLoadCache(time.Duration(s.CacheTTL), s.CacheSize)
+	}
+	if s.ListCacheTTL > 0 {
+		s.listCache = newListCache(time.Duration(s.ListCacheTTL))
+	}
+	if err := s.validateLockLeaseDuration(); err != nil {
+		return nil, err
+	}
+	if s.BlockSize > azblob.BlockBlobMaxUploadBlobBytes {
+		return nil, fmt.Errorf("block_size may be at most %d bytes", azblob.BlockBlobMaxUploadBlobBytes)
+	}
+	if s.CacheDir != "" {
+		if s.ClientEncryptionKey != "" || s.ClientEncryptionKeyVaultURI != "" {
+			return nil, fmt.Errorf("cache_dir keeps values unencrypted on disk and can't be combined with client_encryption_key")
+		}
+		s.diskCache, err = newDiskCache(s.CacheDir)
+		if err != nil {
+			return nil, fmt.Errorf("creating cache_dir: %v", err)
+		}
+	}
+	s.Prefix = strings.Trim(s.Prefix, "/")
+	s.LocksPrefix = strings.Trim(s.LocksPrefix, "/")
+	s.AuditLog = strings.Trim(s.AuditLog, "/")
+	s.hostname, _ = os.Hostname()
+	if s.InstanceFile != "" {
+		if err := s.loadInstanceFile(); err != nil {
+			return nil, fmt.Errorf("instance_file: %v", err)
+		}
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	tier, err := parseAccessTier(s.AccessTier)
+	if err != nil {
+		return nil, err
+	}
+	s.accessTier = tier
+
+	s.tierRules, err = parseTierRules(s.TierRules)
+	if err != nil {
+		return nil, err
+	}
+
+	s.rehydrate, err = parseRehydratePriority(s.RehydratePriority)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateMetadata(s.Metadata); err != nil {
+		return nil, err
+	}
+
+	if err := s.validateImmutability(); err != nil {
+		return nil, err
+	}
+
+	s.cpk, err = s.clientProvidedKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(s.ContainerName, memoryScheme) {
+		s.useMemory()
+		s.logger.Warn("Keeping keys in memory, they are lost when the process exits", zap.String("container", s.ContainerName))
+	}
+
+	if s.BlobHost != "" {
+		if s.Endpoint != "" {
+			return nil, fmt.Errorf("blob_host and endpoint can not be combined")
+		}
+		s.Endpoint = "https://" + strings.TrimSuffix(s.BlobHost, "/")
+	}
+
+	if s.ContainerSASURL != "" {
+		s.SASURL = s.ContainerSASURL
+	}
+	if s.SASURL != "" {
+		sas, err := parseContainerSASURL(s.SASURL)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.AccountName == "" {
+			s.AccountName = sas.AccountName
+		}
+		if s.ContainerName == "" {
+			s.ContainerName = sas.ContainerName
+		}
+		if s.Endpoint == "" {
+			s.Endpoint = sas.Endpoint
+		}
+		if s.SASToken == "" {
+			s.SASToken = sas.SASToken
+		}
+	}
+
+	if s.ConnectionString != "" {
+		cs, err := parseConnectionString(s.ConnectionString)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.AccountName == "" {
+			s.AccountName = cs.AccountName
+		}
+		if s.AccountKey == "" {
+			s.AccountKey = cs.AccountKey
+		}
+		if s.SASToken == "" {
+			s.SASToken = cs.SASToken
+		}
+		if s.Endpoint == "" {
+			s.Endpoint = cs.BlobEndpoint
+		}
+		if cs.DevelopmentStorage {
+			s.Emulator = true
+		}
+	}
+
+	if s.Emulator {
+		if s.AccountName == "" {
+			s.AccountName = devStoreAccountName
+		}
+		if s.AccountKey == "" && s.AccountName == devStoreAccountName {
+			s.AccountKey = devStoreAccountKey
+		}
+		if s.Endpoint == "" {
+			s.Endpoint = devStoreEndpoint + "/" + s.AccountName
+		}
+		if s.ContainerName == "" {
+			s.ContainerName = devStoreContainerName
+		}
+		s.InsecureAllowHTTP = true
+		s.CreateContainer = true
+	}
+
+	if err := s.acquireClient(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			s.releaseClient()
+		}
+	}()
+
+	if s.TLSInsecureSkipVerify {
+		s.logger.Warn("TLS certificate verification of Azure endpoints is disabled")
+	}
+
+	if s.AccountKeyVaultURI != "" {
+		s.keyVault, err = s.newKeyVaultClient(s.AccountKeyVaultURI)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.rotatesCredential() {
+		s.credential, err = s.readCredential(s.ctx)
+		if err != nil {
+			return nil, err
+		}
+		if s.authMode() == AuthModeSAS {
+			s.SASToken = s.credential
+		} else {
+			s.AccountKey = s.credential
+		}
+	}
+
+	if s.ClientEncryptionKeyVaultURI != "" {
+		client, err := s.newKeyVaultClient(s.ClientEncryptionKeyVaultURI)
+		if err != nil {
+			return nil, err
+		}
+
+		s.ClientEncryptionKey, err = fetchSecret(s.ctx, client, s.ClientEncryptionKeySecretName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.ClientEncryptionKey != "" {
+		s.cipher, err = newValueCipher(s.ClientEncryptionKey, s.ClientEncryptionKeyID, s.ClientEncryptionPreviousKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	if err := s.validateAPIVersion(); err != nil {
+		return nil, err
+	}
+
+	containerURL, err := s.newContainerURL()
+	if err != nil {
+		return nil, err
+	}
+
+	s.shards, err = s.newShards(containerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.CreateContainer {
+		if err := s.createContainer(s.ctx, containerURL); err != nil {
+			return nil, err
+		}
+		for _, sh := range s.shards {
+			if err := s.createContainer(s.ctx, sh.containerURL); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if s.rotatesCredential() {
+		go s.refreshCredentials()
+	}
+
+	s.containerURL = containerURL
+
+	if s.ReadSecondary {
+		secondaryURL, err := s.newSecondaryURL(containerURL)
+		if err != nil {
+			return nil, err
+		}
+		s.secondaryURL = &secondaryURL
+
+		for class, sh := range s.shards {
+			secondaryURL, err := s.newSecondaryURL(sh.containerURL)
+			if err != nil {
+				return nil, err
+			}
+			sh.secondaryURL = &secondaryURL
+			s.shards[class] = sh
+		}
+	}
+
+	if len(s.Tenants) > 0 {
+		s.tenants, err = s.newTenants()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.Failover != nil {
+		s.failover, err = s.newFailover()
+		if err != nil {
+			return nil, err
+		}
+		go s.reconcileFailover()
+	}
+	if s.NoList && (s.GCInterval > 0 || s.UsageReportInterval > 0 || s.TierSweepInterval > 0 || s.LockCleanup) {
+		return nil, fmt.Errorf("gc_interval, usage_report_interval, tier_sweep_interval and lock_cleanup list the container and can't be combined with no_list")
+	}
+	if s.GCInterval > 0 {
+		go s.collectGarbage()
+	}
+	if s.UsageReportInterval > 0 {
+		go s.reportUsage()
+	}
+	if s.TierSweepInterval > 0 {
+		go s.sweepTiers()
+	}
+	if s.Replica != nil {
+		s.startReplica()
+	}
+	if s.NotifyURL != "" {
+		s.startNotifier()
+	}
+	return s, nil
+}
+
+// accountName matches the names Azure allows for storage accounts.
+var accountName = regexp.MustCompile(`^[a-z0-9]{3,24}$`)
+
+// validate checks that the settings required by the auth mode are present.
+func (s *Storage) validate() error {
+	mode := s.authMode()
+
+	if s.ContainerName == "" {
+		return fmt.Errorf("container_name is required")
+	}
+
+	if s.Endpoint == "" && s.AccountName == "" {
+		return fmt.Errorf("account_name is required for auth_mode %s", mode)
+	}
+	// Azurite accepts any account name.
+	if s.AccountName != "" && !s.Emulator && !accountName.MatchString(s.AccountName) {
+		return fmt.Errorf("account_name %q must be 3 to 24 lowercase letters and digits, the name of the storage account rather than its URL", s.AccountName)
+	}
+
+	if s.NotifyURL != "" {
+		if _, err := url.Parse(s.NotifyURL); err != nil {
+			return fmt.Errorf("parsing notify_url: %v", err)
+		}
+	}
+	if (s.IndexTags || s.LifecycleTags) && s.HNS {
+		return fmt.Errorf("index_tags and lifecycle_tags can't be combined with hns, accounts with a hierarchical namespace don't support blob index tags")
+	}
+	if s.NotifyEventGrid && (s.NotifyURL == "" || s.NotifyKey == "") {
+		return fmt.Errorf("notify_event_grid requires notify_url and notify_key")
+	}
+
+	switch mode {
+	case AuthModeSharedKey:
+		if s.AccountKey == "" {
+			return fmt.Errorf("account_key is required for auth_mode %s", mode)
+		}
+	case AuthModeSAS:
+		if s.SASURL == "" && s.SASToken == "" {
+			return fmt.Errorf("sas_token, sas_token_file or sas_url is required for auth_mode %s", mode)
+		}
+	case AuthModeCert:
+		if s.TenantID == "" || s.ClientID == "" {
+			return fmt.Errorf("tenant_id and client_id are required for auth_mode %s", mode)
+		}
+	case AuthModeSecret:
+		if s.TenantID == "" || s.ClientID == "" || s.ClientSecret == "" && s.ClientSecretFile == "" {
+			return fmt.Errorf("tenant_id, client_id and client_secret or client_secret_file are required for auth_mode %s", mode)
+		}
+	case AuthModeDefault, AuthModeWorkload, AuthModeManaged:
+	default:
+		return fmt.Errorf("unsupported auth_mode %q", mode)
+	}
+
+	return nil
+}
+
+// checkConnection fetches the container properties to verify the
+// credentials and that the container exists.
+func (s *Storage) checkConnection(ctx context.Context) error {
+	ctx, cancel := s.withTimeout(ctx, s.LoadTimeout)
+	defer cancel()
+
+	for _, sh := range s.allShards() {
+		if _, err := sh.containerURL.GetProperties(ctx, azblob.LeaseAccessConditions{}); err != nil {
+			return fmt.Errorf("connecting to container %s: %v", sh.name, err)
+		}
+	}
+	return nil
+}
+
+// newContainerURL builds the container URL from whichever credential is
+// configured. A SAS token, also the one of a container SAS URL, is used
+// as-is with an anonymous pipeline, Azure AD modes use a bearer token and
+// otherwise the account key is used as a shared key credential.
+func (s *Storage) newContainerURL() (azblob.ContainerURL, error) {
+	mode := s.authMode()
+
+	endpoint := strings.TrimSuffix(s.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.%s", s.AccountName, s.endpointSuffix())
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return azblob.ContainerURL{}, fmt.Errorf("parsing endpoint: %v", err)
+	}
+
+	if u.Scheme != "https" && !s.InsecureAllowHTTP {
+		return azblob.ContainerURL{}, fmt.Errorf("endpoint %s is not https, set insecure_allow_http to allow it", endpoint)
+	}
+
+	creds, err := s.newCredential(mode)
+	if err != nil {
+		return azblob.ContainerURL{}, err
+	}
+
+	s.pipeline = s.newPipeline(creds)
+	serviceURL := azblob.NewServiceURL(*u, s.pipeline)
+	return serviceURL.NewContainerURL(s.ContainerName), nil
+}
+
+// newCredential returns the pipeline policy that authenticates requests in
+// the given auth mode.
+func (s *Storage) newCredential(mode string) (pipeline.Factory, error) {
+	switch mode {
+	case AuthModeSAS:
+		s.sasToken = newRotatingSAS(s.SASToken)
+		return s.sasToken, nil
+	case AuthModeSharedKey:
+		var err error
+		s.sharedKey, err = newRotatingSharedKey(s.AccountName, s.AccountKey)
+		if err != nil {
+			return nil, fmt.Errorf("account_key must be the base64 encoded key1 or key2 of the storage account's access keys: %v", err)
+		}
+		return s.sharedKey, nil
+	}
+	return s.sharedToken(mode)
+}
+
+func (s *Storage) createContainer(ctx context.Context, containerURL azblob.ContainerURL) error {
+	_, err := containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
+	if err != nil {
+		if serviceCode(err) == azblob.ServiceCodeContainerAlreadyExists {
+			return nil
+		}
+		return fmt.Errorf("creating container %s: %v", path.Base(containerURL.URL().Path), err)
+	}
+
+	s.logger.Info("Created container", zap.String("container", path.Base(containerURL.URL().Path)))
+	return nil
+}
+
+// clientProvidedKey validates the customer-provided key or encryption scope
+// and returns the options passed along with every blob request.
+func (s *Storage) clientProvidedKey() (azblob.ClientProvidedKeyOptions, error) {
+	if s.EncryptionScope != "" {
+		if s.EncryptionKey != "" {
+			return azblob.ClientProvidedKeyOptions{}, fmt.Errorf("encryption_key and encryption_scope are mutually exclusive")
+		}
+
+		scope := s.EncryptionScope
+		return azblob.ClientProvidedKeyOptions{EncryptionScope: &scope}, nil
+	}
+
+	if s.EncryptionKey == "" {
+		return azblob.ClientProvidedKeyOptions{}, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(s.EncryptionKey)
+	if err != nil {
+		return azblob.ClientProvidedKeyOptions{}, fmt.Errorf("decoding encryption_key: %v", err)
+	}
+	if len(key) != 32 {
+		return azblob.ClientProvidedKeyOptions{}, fmt.Errorf("encryption_key must be a 256 bit key, got %d bits", len(key)*8)
+	}
+
+	sum := sha256.Sum256(key)
+	hash := base64.StdEncoding.EncodeToString(sum[:])
+	if s.EncryptionKeySHA256 != "" && s.EncryptionKeySHA256 != hash {
+		return azblob.ClientProvidedKeyOptions{}, fmt.Errorf("encryption_key_sha256 does not match encryption_key")
+	}
+
+	encoded := s.EncryptionKey
+	return azblob.NewClientProvidedKeyOptions(&encoded, &hash, nil), nil
+}
+
+func parseAccessTier(tier string) (azblob.AccessTierType, error) {
+	switch strings.ToLower(tier) {
+	case "":
+		return azblob.DefaultAccessTier, nil
+	case "hot":
+		return azblob.AccessTierHot, nil
+	case "cool":
+		return azblob.AccessTierCool, nil
+	case "cold":
+		return azblob.AccessTierType("Cold"), nil
+	}
+	return azblob.AccessTierNone, fmt.Errorf("unsupported access_tier %q, expected Hot, Cool or Cold", tier)
+}
+
+// endpointSuffix returns the blob service DNS suffix, accepting both the
+// "blob.core.windows.net" and the connection string style "core.windows.net".
+func (s *Storage) endpointSuffix() string {
+	suffix := strings.Trim(s.EndpointSuffix, ".")
+	if suffix == "" {
+		return defaultEndpointSuffix
+	}
+	if !strings.HasPrefix(suffix, "blob.") {
+		suffix = "blob." + suffix
+	}
+	return suffix
+}
+
+func (s *Storage) Store(ctx context.Context, key string, value []byte) (err error) {
+	if t := s.tenantFor(key); t != nil {
+		return t.Store(ctx, key, value)
+	}
+	defer s.observe("store", time.Now(), &err)
+	ctx, span, err := s.startSpan(ctx, "store", key)
+	defer endSpan(span, &err)
+	if err != nil {
+		return err
+	}
+
+	if len(s.Hooks) > 0 {
+		if err := s.beforeStore(ctx, key, value); err != nil {
+			return err
+		}
+		defer func() { s.afterStore(ctx, key, value, err) }()
+	}
+	if s.AuditLog != "" {
+		defer func() { s.audit("store", key, err) }()
+	}
+
+	if s.Replica != nil {
+		defer func() {
+			if err == nil {
+				s.replicateStore(key, value)
+			}
+		}()
+	}
+	if s.NotifyURL != "" {
+		defer func() {
+			if err == nil {
+				s.notifyStore(key, value)
+			}
+		}()
+	}
+
+	if isAccountKey(key) && s.etag(key) == azblob.ETagNone {
+		// Two instances registering an ACME account at the same time
+		// must not end up with a mix of both.
+		err = s.storeIfNotExists(ctx, key, value)
+	} else {
+		err = s.store(ctx, key, value, false)
+	}
+	if s.useFailover(ctx, err) {
+		return s.storeFailover(ctx, key, value, err)
+	}
+	if err == nil && s.failover != nil {
+		s.dropFailover(ctx, key)
+	}
+	return err
+}
+
+// storeIfNotExists writes key unless it exists already, in which case it
+// returns fs.ErrExist.
+func (s *Storage) storeIfNotExists(ctx context.Context, key string, value []byte) error {
+	return s.store(ctx, key, value, true)
+}
+
+// store writes key to the primary container. With createOnly the write
+// fails with fs.ErrExist if the key exists already.
+func (s *Storage) store(ctx context.Context, key string, value []byte, createOnly bool) (err error) {
+	ctx, cancel := s.withTimeout(ctx, s.StoreTimeout)
+	defer cancel()
+
+	if s.cache != nil {
+		defer s.cache.invalidate(key)
+	}
+	if s.listCache != nil {
+		defer s.listCache.invalidate(key)
+	}
+
+	plain := value
+	var encoding string
+	if s.Compress {
+		value, err = compress(value)
+		if err != nil {
+			s.logger.Error("Store Error", zap.String("key", key), s.errField(err))
+			return err
+		}
+		encoding = contentEncodingGzip
+	}
+
+	metadata := s.blobMetadata()
+	if s.cipher != nil {
+		var encryption azblob.Metadata
+		value, encryption, err = s.cipher.seal(key, value)
+		if err != nil {
+			s.logger.Error("Store Error", zap.String("key", key), s.errField(err))
+			return err
+		}
+		for name, v := range encryption {
+			metadata[name] = v
+		}
+	}
+
+	var tags azblob.BlobTagsMap
+	if s.LifecycleTags {
+		tags = lifecycleTags(key, plain)
+	} else if s.IndexTags {
+		tags = blobTags(key)
+	}
+
+	blobURL := s.container(key).NewBlockBlobURL(s.blobName(key))
+	if s.SnapshotOnWrite {
+		_, err = blobURL.CreateSnapshot(ctx, azblob.Metadata{}, azblob.BlobAccessConditions{}, s.cpk)
+		if err != nil && !isNotFound(err) {
+			s.logger.Error("Store Error", zap.String("key", key), s.errField(err))
+			return err
+		}
+	}
+
+	ac := s.writeConditions(key)
+	if createOnly {
+		ac = azblob.BlobAccessConditions{
+			ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny},
+		}
+	}
+	headers := s.blobHeaders(key, encoding)
+	tier := s.tierFor(key, 0)
+	modified, etag, err := s.upload(ctx, blobURL, value, headers, ac, metadata, tags, tier)
+	if createOnly && isAlreadyExists(err) {
+		s.logger.Warn("Store skipped, key was created concurrently", zap.String("key", key))
+		return fmt.Errorf("%w: %s", fs.ErrExist, key)
+	}
+	if ac.ModifiedAccessConditions.IfMatch != azblob.ETagNone && isConditionNotMet(err) {
+		s.setETag(key, azblob.ETagNone)
+		if s.StrictWrites {
+			s.logger.Error("Store Error", zap.String("key", key), zap.String("err", ErrConflict.Error()))
+			return fmt.Errorf("%w: %s", ErrConflict, key)
+		}
+		s.logger.Warn("Store overwriting a concurrent change", zap.String("key", key))
+		modified, etag, err = s.upload(ctx, blobURL, value, headers, azblob.BlobAccessConditions{}, metadata, tags, tier)
+	}
+	if err != nil {
+		s.logger.Error("Store Error", zap.String("key", key), s.errField(err))
+		return err
+	}
+	s.setETag(key, etag)
+	s.removeLegacyBlob(ctx, key)
+
+	if s.diskCache != nil {
+		if err := s.diskCache.write(key, plain, modified); err != nil {
+			s.logger.Error("Disk Cache Error", zap.String("key", key), s.errField(err))
+		}
+	}
+	return nil
+}
+
+func (s *Storage) Load(ctx context.Context, key string) (value []byte, err error) {
+	if t := s.tenantFor(key); t != nil {
+		return t.Load(ctx, key)
+	}
+	defer s.observe("load", time.Now(), &err)
+	ctx, span, err := s.startSpan(ctx, "load", key)
+	defer endSpan(span, &err)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.failover != nil && s.inFailover(key) {
+		return s.failover.Load(ctx, key)
+	}
+
+	// An expired cache entry is only downloaded again if its blob changed.
+	var stale []byte
+	var staleETag azblob.ETag
+	var gen uint64
+	if s.cache != nil {
+		if value, ok := s.cache.get(key); ok {
+			return value, nil
+		}
+		gen = s.cache.generation()
+		stale, staleETag, _ = s.cache.stale(key)
+	}
+
+	if s.diskCache != nil {
+		if value, modified, ok := s.diskCache.read(key); ok {
+			go s.reconcile(key, modified)
+			return value, nil
+		}
+	}
+
+	value, _, err = s.load(ctx, key, staleETag, gen)
+	if errors.Is(err, errNotModified) {
+		s.cache.put(key, stale, staleETag, gen)
+		return stale, nil
+	}
+	return value, err
+}
+
+// LoadIfChanged loads key unless its blob still has the given ETag, in
+// which case it reports changed as false without transferring the value.
+// It returns the ETag to pass next time, which is empty if the value was
+// served by something other than the primary endpoint, like the failover
+// container or MigrateFrom. Unlike Load, it always asks the container
+// instead of answering from the caches, but it updates them.
+func (s *Storage) LoadIfChanged(ctx context.Context, key, etag string) (value []byte, newETag string, changed bool, err error) {
+	if t := s.tenantFor(key); t != nil {
+		return t.LoadIfChanged(ctx, key, etag)
+	}
+	defer s.observe("load", time.Now(), &err)
+	ctx, span, err := s.startSpan(ctx, "load", key)
+	defer endSpan(span, &err)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	if s.failover != nil && s.inFailover(key) {
+		value, err := s.failover.Load(ctx, key)
+		return value, "", err == nil, err
+	}
+
+	var gen uint64
+	if s.cache != nil {
+		gen = s.cache.generation()
+	}
+	value, tag, err := s.load(ctx, key, azblob.ETag(etag), gen)
+	if errors.Is(err, errNotModified) {
+		return nil, etag, false, nil
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	return value, string(tag), true, nil
+}
+
+// load downloads key unless its blob still has the given ETag, falling
+// back to the failover container and MigrateFrom, and caches what it got
+// unless the cache was invalidated since its generation gen. The returned
+// ETag is azblob.ETagNone for values from elsewhere than the primary blob.
+func (s *Storage) load(ctx context.Context, key string, etag azblob.ETag, gen uint64) ([]byte, azblob.ETag, error) {
+	value, modified, tag, err := s.downloadIfChanged(ctx, key, etag)
+	if errors.Is(err, errNotModified) {
+		return nil, etag, err
+	}
+	if errors.Is(err, fs.ErrNotExist) || s.useFailover(ctx, err) {
+		if s.failover != nil {
+			if value, err := s.failover.Load(ctx, key); err == nil {
+				return value, azblob.ETagNone, nil
+			}
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) && s.MigrateFrom != nil {
+		value, err := s.migrateLoad(ctx, key)
+		return value, azblob.ETagNone, err
+	}
+	if err != nil {
+		return nil, azblob.ETagNone, err
+	}
+
+	if s.cache != nil {
+		s.cache.put(key, value, tag, gen)
+	}
+	if s.diskCache != nil {
+		s.diskCache.write(key, value, modified)
+	}
+	return value, tag, nil
+}
+
+// download loads key from the container, returning its value and the time
+// it was last modified.
+func (s *Storage) download(ctx context.Context, key string) ([]byte, time.Time, error) {
+	value, modified, _, err := s.downloadIfChanged(ctx, key, azblob.ETagNone)
+	return value, modified, err
+}
+
+// downloadIfChanged is download that returns errNotModified without the
+// body if the primary blob still has the given ETag. It also returns the
+// ETag of the primary blob, or azblob.ETagNone if the value came from
+// elsewhere.
+func (s *Storage) downloadIfChanged(ctx context.Context, key string, etag azblob.ETag) ([]byte, time.Time, azblob.ETag, error) {
+	ctx, cancel := s.withTimeout(ctx, s.LoadTimeout)
+	defer cancel()
+
+	blobURL := s.container(key).NewBlockBlobURL(s.blobName(key))
+	source := blobURL.BlobURL
+	get, err := blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: etag},
+	}, false, s.cpk)
+	if etag != azblob.ETagNone && isNotModified(err) {
+		s.setETag(key, etag)
+		return nil, time.Time{}, etag, errNotModified
+	}
+	// Only the primary blob can be written to with its ETag.
+	primary := err == nil
+	if s.useSecondary(ctx, err) {
+		s.logger.Warn("Load falling back to secondary endpoint", zap.String("key", key), s.errField(err))
+		source = s.shardFor(key).secondaryURL.NewBlobURL(s.blobName(key))
+		get, err = source.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, s.cpk)
+	}
+	if legacyURL, ok := s.legacyBlobURL(key); ok && isNotFound(err) {
+		source = legacyURL.BlobURL
+		get, err = source.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, s.cpk)
+	}
+	if isNotFound(err) && s.UndeleteOnLoad {
+		if _, undeleteErr := blobURL.Undelete(ctx); undeleteErr == nil {
+			s.logger.Warn("Restored soft-deleted blob", zap.String("key", key))
+			get, err = blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, s.cpk)
+		}
+	}
+	if isNotFound(err) {
+		return nil, time.Time{}, azblob.ETagNone, fs.ErrNotExist
+	}
+	if isArchived(err) {
+		return nil, time.Time{}, azblob.ETagNone, s.archivedError(ctx, source, key, err)
+	}
+
+	if err != nil {
+		s.logger.Error("Load Error", zap.String("key", key), s.errField(err))
+		return nil, time.Time{}, azblob.ETagNone, err
+	}
+	if s.HNS && isFolder(get.NewMetadata()) {
+		get.Body(azblob.RetryReaderOptions{}).Close()
+		return nil, time.Time{}, azblob.ETagNone, fmt.Errorf("%s is a directory", key)
+	}
+	data, err := s.readBody(ctx, source, get)
+	if err != nil {
+		s.logger.Error("Load Error", zap.String("key", key), s.errField(err))
+		return nil, time.Time{}, azblob.ETagNone, err
+	}
+
+	data, err = s.decrypt(key, data, get.NewMetadata())
+	if err != nil {
+		s.logger.Error("Load Error", zap.String("key", key), s.errField(err))
+		return nil, time.Time{}, azblob.ETagNone, err
+	}
+
+	value, err := decompress(data, get.ContentEncoding(), s.maxValueSize())
+	if err != nil {
+		s.logger.Error("Load Error", zap.String("key", key), s.errField(err))
+		return nil, time.Time{}, azblob.ETagNone, err
+	}
+
+	if !primary {
+		return value, get.LastModified(), azblob.ETagNone, nil
+	}
+	s.setETag(key, get.ETag())
+	return value, get.LastModified(), get.ETag(), nil
+}
+
+func (s *Storage) Delete(ctx context.Context, key string) (err error) {
+	if t := s.tenantFor(key); t != nil {
+		return t.Delete(ctx, key)
+	}
+	defer s.observe("delete", time.Now(), &err)
+	ctx, span, err := s.startSpan(ctx, "delete", key)
+	defer endSpan(span, &err)
+	if err != nil {
+		return err
+	}
+
+	if len(s.Hooks) > 0 {
+		if err := s.beforeDelete(ctx, key); err != nil {
+			return err
+		}
+		defer func() { s.afterDelete(ctx, key, err) }()
+	}
+	if s.AuditLog != "" {
+		defer func() { s.audit("delete", key, err) }()
+	}
+
+	if s.cache != nil {
+		defer s.cache.invalidate(key)
+	}
+	if s.listCache != nil {
+		defer s.listCache.invalidate(key)
+	}
+	if s.diskCache != nil {
+		defer func() {
+			if err == nil || errors.Is(err, fs.ErrNotExist) {
+				s.diskCache.remove(key)
+			}
+		}()
+	}
+	// A key another instance rewrote since it was last seen is kept,
+	// along with its copies elsewhere.
+	var rewritten bool
+	if s.Replica != nil {
+		defer func() {
+			if !rewritten && (err == nil || errors.Is(err, fs.ErrNotExist)) {
+				s.replicateDelete(key)
+			}
+		}()
+	}
+	if s.NotifyURL != "" {
+		defer func() {
+			if !rewritten && err == nil {
+				s.notifyDelete(key)
+			}
+		}()
+	}
+
+	ctx, cancel := s.withTimeout(ctx, s.StoreTimeout)
+	defer cancel()
+
+	if s.failover != nil {
+		defer func() {
+			if rewritten {
+				return
+			}
+			s.failoverMu.Lock()
+			delete(s.failoverKeys, key)
+			s.failoverMu.Unlock()
+
+			// A key only present in the failover storage is deleted too.
+			failoverErr := s.failover.Delete(ctx, key)
+			if errors.Is(err, fs.ErrNotExist) && failoverErr == nil {
+				err = nil
+			}
+		}()
+	}
+	if s.MigrateFrom != nil {
+		defer func() {
+			if rewritten {
+				return
+			}
+			// Otherwise the next load would bring the key back.
+			oldErr := s.MigrateFrom.Delete(ctx, key)
+			if errors.Is(err, fs.ErrNotExist) && oldErr == nil {
+				err = nil
+			}
+		}()
+	}
+
+	ac := s.writeConditions(key)
+	s.setETag(key, azblob.ETagNone)
+	blobURL := s.container(key).NewBlockBlobURL(s.blobName(key))
+	_, err = blobURL.Delete(ctx, s.deleteSnapshots(), ac)
+	if isConditionNotMet(err) {
+		rewritten = true
+		s.logger.Warn("Delete skipped, key was rewritten concurrently", zap.String("key", key))
+		return nil
+	}
+	if legacyURL, ok := s.legacyBlobURL(key); ok && isNotFound(err) {
+		_, err = legacyURL.Delete(ctx, s.deleteSnapshots(), azblob.BlobAccessConditions{})
+	}
+	if isNotFound(err) && s.NoList {
+		return fs.ErrNotExist
+	}
+	if isNotFound(err) {
+		// Like the file system storage, deleting a "directory" removes
+		// everything below it.
+		return s.deleteDirectory(ctx, key)
+	}
+
+	if s.HNS && isDirectoryNotEmpty(err) {
+		// Directories are real objects that have to be emptied first.
+		if err := s.deleteDirectory(ctx, key); err != nil {
+			return err
+		}
+		err = s.deleteFolders(ctx, key)
+	}
+
+	if isImmutable(err) {
+		// Retained blobs can't be removed before their policy ends, don't
+		// fail certmagic's cleanup over them.
+		s.logger.Warn("Delete skipped, blob is immutable", zap.String("key", key))
+		return nil
+	}
+
+	if err != nil {
+		s.logger.Error("Delete Error", zap.String("key", key), s.errField(err))
+	}
+
+	return err
+}
+
+// deleteSnapshots returns how deletes treat snapshots. Blobs with snapshots
+// can only be deleted together with them.
+func (s *Storage) deleteSnapshots() azblob.DeleteSnapshotsOptionType {
+	if s.SnapshotOnWrite {
+		return azblob.DeleteSnapshotsOptionInclude
+	}
+	return azblob.DeleteSnapshotsOptionNone
+}
+
+// Undelete restores a soft-deleted key along with its soft-deleted
+// snapshots, returning fs.ErrNotExist if there is nothing to restore. It
+// requires blob soft delete on the account and has no effect on accounts
+// with blob versioning, where previous versions must be restored instead.
+func (s *Storage) Undelete(ctx context.Context, key string) (err error) {
+	if s.AuditLog != "" {
+		defer func() { s.audit("undelete", key, err) }()
+	}
+
+	ctx, cancel := s.withTimeout(ctx, s.StoreTimeout)
+	defer cancel()
+
+	if s.cache != nil {
+		defer s.cache.invalidate(key)
+	}
+	if s.listCache != nil {
+		defer s.listCache.invalidate(key)
+	}
+
+	blobURL := s.container(key).NewBlobURL(s.blobName(key))
+	_, err = blobURL.Undelete(ctx)
+	if isNotFound(err) {
+		return fs.ErrNotExist
+	}
+
+	if err != nil {
+		s.logger.Error("Undelete Error", zap.String("key", key), s.errField(err))
+	}
+	return err
+}
+
+// deleteDirectory deletes all blobs below key + "/", returning
+// fs.ErrNotExist when there are none.
+func (s *Storage) deleteDirectory(ctx context.Context, key string) error {
+	keys, err := s.listShards(ctx, strings.TrimSuffix(key, "/")+"/", true, false)
+	if isNotFound(err) {
+		return fs.ErrNotExist
+	}
+	if err != nil {
+		s.logger.Error("Delete Error", zap.String("key", key), s.errField(err))
+		return err
+	}
+
+	if len(keys) == 0 {
+		return fs.ErrNotExist
+	}
+
+	_, err = s.deleteKeys(ctx, keys)
+	return err
+}
+
+func (s *Storage) Exists(ctx context.Context, key string) bool {
+	if t := s.tenantFor(key); t != nil {
+		return t.Exists(ctx, key)
+	}
+	ctx, span, err := s.startSpan(ctx, "exists", key)
+	defer span.End()
+	if err != nil {
+		return false
+	}
+
+	ctx, cancel := s.withTimeout(ctx, s.LoadTimeout)
+	defer cancel()
+
+	blobURL := s.container(key).NewBlockBlobURL(s.blobName(key))
+	_, err = blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, s.cpk)
+	if legacyURL, ok := s.legacyBlobURL(key); ok && isNotFound(err) {
+		_, err = legacyURL.GetProperties(ctx, azblob.BlobAccessConditions{}, s.cpk)
+	}
+	if s.failover != nil && (isNotFound(err) || s.useFailover(ctx, err)) {
+		return s.failover.Exists(ctx, key)
+	}
+	if s.MigrateFrom != nil && isNotFound(err) {
+		return s.MigrateFrom.Exists(ctx, key)
+	}
+	if err != nil {
+		if !isNotFound(err) {
+			s.logger.Error("Exists Error", zap.String("key", key), s.errField(err))
+		}
+		return false
+	}
+
+	return true
+}
+
+func (s *Storage) List(ctx context.Context, prefix string, recursive bool) (keys []string, err error) {
+	defer s.observe("list", time.Now(), &err)
+	ctx, span, err := s.startSpan(ctx, "list", prefix)
+	defer endSpan(span, &err)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s.tenants) > 0 {
+		// Tenants are listed with ctx before the list timeout below.
+		defer func(ctx context.Context) {
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return
+			}
+			merged, mergeErr := s.mergeTenantKeys(ctx, keys, prefix, recursive)
+			if mergeErr != nil {
+				keys, err = nil, mergeErr
+			} else if len(merged) > 0 {
+				keys, err = merged, nil
+			}
+		}(ctx)
+	}
+	if s.NoList {
+		return nil, ErrListUnsupported
+	}
+	var gen uint64
+	if s.listCache != nil {
+		if keys, ok := s.listCache.get(prefix, recursive); ok {
+			return keys, nil
+		}
+		gen = s.listCache.generation()
+	}
+
+	s.logger.Debug("List", zap.String("prefix", prefix), zap.Bool("recursive", recursive))
+	ctx, cancel := s.withTimeout(ctx, s.ListTimeout)
+	defer cancel()
+
+	keys, err = s.listShards(ctx, prefix, recursive, false)
+	if s.useSecondary(ctx, err) {
+		s.logger.Warn("List falling back to secondary endpoint", zap.String("prefix", prefix), s.errField(err))
+		keys, err = s.listShards(ctx, prefix, recursive, true)
+	}
+	if isNotFound(err) {
+		return nil, fs.ErrNotExist
+	}
+
+	if s.failover != nil && (err == nil || s.useFailover(ctx, err)) {
+		if failoverKeys, failoverErr := s.failover.List(ctx, prefix, recursive); failoverErr == nil {
+			keys, err = mergeKeys(keys, failoverKeys), nil
+		}
+	}
+	if s.MigrateFrom != nil && err == nil {
+		if oldKeys, oldErr := s.MigrateFrom.List(ctx, prefix, recursive); oldErr == nil {
+			keys = mergeKeys(keys, oldKeys)
+		}
+	}
+	if err != nil {
+		s.logger.Error("List Error", zap.String("prefix", prefix), s.errField(err))
+		return nil, err
+	}
+	// Like the file system storage, a prefix nothing is stored below
+	// doesn't exist.
+	if len(keys) == 0 {
+		return nil, fs.ErrNotExist
+	}
+
+	if s.listCache != nil {
+		s.listCache.put(prefix, recursive, keys, gen)
+	}
+	s.logger.Debug("List Keys", zap.String("prefix", prefix), zap.Int("count", len(keys)))
+	return keys, nil
+}
+
+// listHierarchy returns only the immediate children of prefix, treating "/"
+// as the directory separator like certmagic's file storage does.
+func (s *Storage) listHierarchy(ctx context.Context, c azblob.ContainerURL, prefix string) ([]string, error) {
+	dir := s.blobName(prefix)
+	if dir != "" && !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+
+	keys := make([]string, 0)
+	dirs := make(map[string]bool)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		ls, err := c.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{
+			Details: azblob.BlobListingDetails{Metadata: s.HNS},
+			Prefix:  dir,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range ls.Segment.BlobPrefixes {
+			if s.isLockBlob(v.Name) {
+				continue
+			}
+			key := s.keyName(strings.TrimSuffix(v.Name, "/"))
+			dirs[key] = true
+			keys = append(keys, key)
+		}
+		for _, v := range ls.Segment.BlobItems {
+			if s.isLockBlob(v.Name) {
+				continue
+			}
+			// Directories are listed as prefixes already, and empty ones
+			// only as a blob. A blob with blobs below it is listed once.
+			key := s.keyName(v.Name)
+			if dirs[key] {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		marker = ls.NextMarker
+	}
+
+	return keys, nil
+}
+
+func (s *Storage) Stat(ctx context.Context, key string) (info certmagic.KeyInfo, err error) {
+	if t := s.tenantFor(key); t != nil {
+		return t.Stat(ctx, key)
+	}
+	defer s.observe("stat", time.Now(), &err)
+	ctx, span, err := s.startSpan(ctx, "stat", key)
+	defer endSpan(span, &err)
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx, s.LoadTimeout)
+	defer cancel()
+
+	s.logger.Debug("Stat", zap.String("key", key))
+	blobURL := s.container(key).NewBlockBlobURL(s.blobName(key))
+	resp, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, s.cpk)
+	if err == nil {
+		s.setETag(key, resp.ETag())
+	}
+	if legacyURL, ok := s.legacyBlobURL(key); ok && isNotFound(err) {
+		resp, err = legacyURL.GetProperties(ctx, azblob.BlobAccessConditions{}, s.cpk)
+	}
+	if s.failover != nil && (isNotFound(err) || s.useFailover(ctx, err)) {
+		if info, err := s.failover.Stat(ctx, key); err == nil {
+			return info, nil
+		}
+	}
+	if err == nil && s.HNS && isFolder(resp.NewMetadata()) {
+		return certmagic.KeyInfo{
+			Key:        key,
+			Modified:   resp.LastModified(),
+			IsTerminal: false,
+		}, nil
+	}
+	if err == nil {
+		info := certmagic.KeyInfo{
+			Key:        key,
+			Modified:   resp.LastModified(),
+			Size:       resp.ContentLength(),
+			IsTerminal: true,
+		}
+		// A blob other blobs live under is a directory to certmagic,
+		// like an HNS folder.
+		if !s.NoList && !isLeafKey(key) {
+			isDir, dirErr := s.isDirectory(ctx, key)
+			if dirErr != nil {
+				s.logger.Error("Stat Error", zap.String("key", key), s.errField(dirErr))
+				return certmagic.KeyInfo{}, dirErr
+			}
+			if isDir {
+				info.Size, info.IsTerminal = 0, false
+			}
+		}
+		return info, nil
+	}
+
+	if !isNotFound(err) {
+		s.logger.Error("Stat Error", zap.String("key", key), s.errField(err))
+		return certmagic.KeyInfo{}, err
+	}
+
+	if s.NoList && s.MigrateFrom != nil {
+		return s.MigrateFrom.Stat(ctx, key)
+	}
+	if s.NoList {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+
+	// There is no blob with that exact name, but the key may still be a
+	// "directory" that other blobs live under.
+	isDir, dirErr := s.isDirectory(ctx, key)
+	if isNotFound(dirErr) {
+		isDir, dirErr = false, nil
+	}
+	if dirErr != nil {
+		s.logger.Error("Stat Error", zap.String("key", key), s.errField(dirErr))
+		return certmagic.KeyInfo{}, dirErr
+	}
+	if !isDir && s.MigrateFrom != nil {
+		return s.MigrateFrom.Stat(ctx, key)
+	}
+	if !isDir {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+
+	return certmagic.KeyInfo{
+		Key:        key,
+		IsTerminal: false,
+	}, nil
+}
+
+// leafExtensions are the extensions of the certificates, private keys and
+// metadata certmagic stores, which it never stores other keys below.
+var leafExtensions = []string{".crt", ".key", ".json"}
+
+// isLeafKey reports whether key is one of certmagic's files, which Stat
+// doesn't need to list the container for. Directory names such as
+// example.com contain dots too, so only the known extensions count.
+func isLeafKey(key string) bool {
+	return contains(leafExtensions, path.Ext(key))
+}
+
+// isDirectory reports whether any blob exists below key + "/", in any
+// container for the root.
+func (s *Storage) isDirectory(ctx context.Context, key string) (bool, error) {
+	dir := strings.Trim(key, "/")
+	shards := []shard{s.shardFor(dir)}
+	prefix := s.blobName(dir) + "/"
+	if dir == "" {
+		shards = s.allShards()
+		prefix = s.blobName("")
+	}
+
+	for _, sh := range shards {
+		ls, err := sh.containerURL.ListBlobsFlatSegment(ctx, azblob.Marker{}, azblob.ListBlobsSegmentOptions{
+			Prefix:     prefix,
+			MaxResults: 1,
+		})
+		if err != nil {
+			return false, err
+		}
+		if len(ls.Segment.BlobItems) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// withTimeout bounds an operation on behalf of ctx by d, and aborts it when
+// the storage is closed so shutdown doesn't wait on in-flight requests.
+func (s *Storage) withTimeout(ctx context.Context, d caddy.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := withTimeout(ctx, d)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func withTimeout(ctx context.Context, d caddy.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(d))
+}
+
+// blobName maps a certmagic key to its escaped blob name under the
+// configured prefix.
+func (s *Storage) blobName(key string) string {
+	if s.Prefix == "" {
+		return escapeKey(key)
+	}
+	return s.Prefix + "/" + escapeKey(key)
+}
+
+// keyName is the inverse of blobName.
+func (s *Storage) keyName(name string) string {
+	if s.Prefix == "" {
+		return unescapeKey(name)
+	}
+	return unescapeKey(strings.TrimPrefix(name, s.Prefix+"/"))
+}
+
+// DoesBlobExists reports whether err is not a "blob not found" error.
+//
+// Deprecated: storage methods return fs.ErrNotExist for missing keys, use
+// errors.Is(err, fs.ErrNotExist) instead.
+func DoesBlobExists(err error) bool {
+	return !isNotFound(err)
+}
+
+func (s *Storage) String() string {
+	return fmt.Sprintf("AZBlob Account Name: %s, Container Name: %s", s.AccountName, s.ContainerName)
+}
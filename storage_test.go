@@ -0,0 +1,189 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// newMemoryStorage returns a storage of a fresh in-memory container,
+// configured by the optional configure functions.
+func newMemoryStorage(t *testing.T, configure ...func(*Options)) *Storage {
+	t.Helper()
+	return newMemoryContainerStorage(t, "test-"+uuid.NewString(), configure...)
+}
+
+// newMemoryContainerStorage returns a storage of the named in-memory
+// container, which other storages of the same name share.
+func newMemoryContainerStorage(t *testing.T, container string, configure ...func(*Options)) *Storage {
+	t.Helper()
+	o := Options{
+		ContainerName:    memoryScheme + container,
+		LockPollInterval: caddy.Duration(50 * time.Millisecond),
+	}
+	for _, f := range configure {
+		f(&o)
+	}
+	s, err := New(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestMemoryStorage(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	for _, tt := range []struct {
+		name      string
+		configure func(*Options)
+	}{
+		{"default", func(*Options) {}},
+		{"prefix", func(o *Options) { o.Prefix = "caddy" }},
+		{"compress", func(o *Options) { o.Compress = true }},
+		{"client encryption", func(o *Options) { o.ClientEncryptionKey = key }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			container := "test-" + uuid.NewString()
+			s := newMemoryContainerStorage(t, container, tt.configure)
+			other := newMemoryContainerStorage(t, container, tt.configure)
+			testContract(t, s, other)
+		})
+	}
+}
+
+func TestLoadIfChanged(t *testing.T) {
+	ctx := context.Background()
+	old := newMemoryStorage(t)
+	s := newMemoryStorage(t, func(o *Options) { o.MigrateFrom = old })
+
+	if err := s.Store(ctx, "key", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	value, etag, changed, err := s.LoadIfChanged(ctx, "key", "")
+	if err != nil || !changed || string(value) != "one" || etag == "" {
+		t.Fatalf("first load: %q, %q, %v, %v", value, etag, changed, err)
+	}
+	value, newETag, changed, err := s.LoadIfChanged(ctx, "key", etag)
+	if err != nil || changed || value != nil || newETag != etag {
+		t.Fatalf("unchanged load: %q, %q, %v, %v", value, newETag, changed, err)
+	}
+	if err := s.Store(ctx, "key", []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	value, newETag, changed, err = s.LoadIfChanged(ctx, "key", etag)
+	if err != nil || !changed || string(value) != "two" || newETag == etag {
+		t.Fatalf("changed load: %q, %q, %v, %v", value, newETag, changed, err)
+	}
+
+	// Keys of the previous storage are migrated, without an ETag as they
+	// didn't come from the container.
+	if err := old.Store(ctx, "old", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	value, etag, changed, err = s.LoadIfChanged(ctx, "old", "")
+	if err != nil || !changed || string(value) != "old" || etag != "" {
+		t.Fatalf("migrating load: %q, %q, %v, %v", value, etag, changed, err)
+	}
+	if _, _, err := s.download(ctx, "old"); err != nil {
+		t.Fatalf("key was not migrated: %v", err)
+	}
+}
+
+func TestStatDirectory(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStorage(t)
+	for _, key := range []string{"example.com", "example.com/example.com.crt", "example.com.crt", "example.com.crt/below"} {
+		if err := s.Store(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		key      string
+		terminal bool
+	}{
+		{"example.com", false},
+		{"example.com/example.com.crt", true},
+		// Certificates aren't checked for keys below them.
+		{"example.com.crt", true},
+	} {
+		info, err := s.Stat(ctx, tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.IsTerminal != tt.terminal {
+			t.Errorf("Stat(%s).IsTerminal = %v, want %v", tt.key, info.IsTerminal, tt.terminal)
+		}
+	}
+}
+
+func TestEndpointSuffix(t *testing.T) {
+	for _, tt := range []struct {
+		suffix string
+		want   string
+	}{
+		{"", "blob.core.windows.net"},
+		{"core.chinacloudapi.cn", "blob.core.chinacloudapi.cn"},
+		{"blob.core.usgovcloudapi.net", "blob.core.usgovcloudapi.net"},
+		{".core.usgovcloudapi.net.", "blob.core.usgovcloudapi.net"},
+		{".blob.core.chinacloudapi.cn.", "blob.core.chinacloudapi.cn"},
+		{"local.azurestack.external", "blob.local.azurestack.external"},
+	} {
+		s := &Storage{Options: Options{EndpointSuffix: tt.suffix}}
+		if got := s.endpointSuffix(); got != tt.want {
+			t.Errorf("endpointSuffix(%q) = %q, want %q", tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestNewContainerURL(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		o    Options
+		want string
+	}{
+		{
+			name: "default",
+			o:    Options{AccountName: "acct", ContainerName: "certs"},
+			want: "https://acct.blob.core.windows.net/certs",
+		},
+		{
+			name: "bare suffix",
+			o:    Options{AccountName: "acct", ContainerName: "certs", EndpointSuffix: "core.chinacloudapi.cn"},
+			want: "https://acct.blob.core.chinacloudapi.cn/certs",
+		},
+		{
+			name: "blob suffix",
+			o:    Options{AccountName: "acct", ContainerName: "certs", EndpointSuffix: "blob.core.usgovcloudapi.net"},
+			want: "https://acct.blob.core.usgovcloudapi.net/certs",
+		},
+		{
+			name: "dotted suffix",
+			o:    Options{AccountName: "acct", ContainerName: "certs", EndpointSuffix: ".core.usgovcloudapi.net."},
+			want: "https://acct.blob.core.usgovcloudapi.net/certs",
+		},
+		{
+			name: "endpoint",
+			o:    Options{AccountName: "acct", ContainerName: "certs", Endpoint: "https://certs.example.com/", EndpointSuffix: "core.chinacloudapi.cn"},
+			want: "https://certs.example.com/certs",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.o.AccountKey = devStoreAccountKey
+			s := &Storage{Options: tt.o, logger: zap.NewNop()}
+			u, err := s.newContainerURL()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.String(); got != tt.want {
+				t.Errorf("container URL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+)
+
+// LoadStream returns a reader over the value of key without buffering it,
+// for values too large for Load. The value is verified against its stored
+// MD5 hash when the reader reaches its end and decompressed on the fly.
+// Client side encrypted values, keys in failover and anything but a plain
+// blob in the container are read through Load instead.
+func (s *Storage) LoadStream(ctx context.Context, key string) (rc io.ReadCloser, err error) {
+	defer s.observe("load_stream", time.Now(), &err)
+	ctx, span, err := s.startSpan(ctx, "load_stream", key)
+	defer endSpan(span, &err)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cipher != nil || (s.failover != nil && s.inFailover(key)) {
+		// AES-GCM can only authenticate the value as a whole.
+		return s.loadBuffered(ctx, key)
+	}
+
+	blobURL := s.container(key).NewBlockBlobURL(s.blobName(key))
+	get, err := blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, s.cpk)
+	if err != nil {
+		// Missing, archived and unreachable blobs take Load's fallbacks.
+		return s.loadBuffered(ctx, key)
+	}
+	if s.HNS && isFolder(get.NewMetadata()) {
+		get.Body(azblob.RetryReaderOptions{}).Close()
+		return nil, fmt.Errorf("%s is a directory", key)
+	}
+
+	body := get.Body(s.retryReaderOptions())
+	stream := &valueStream{Reader: body, closers: []io.Closer{body}}
+	if want := get.ContentMD5(); len(want) > 0 {
+		stream.Reader = &checkedReader{r: body, hash: md5.New(), want: want}
+	}
+
+	switch encoding := get.ContentEncoding(); encoding {
+	case "", "identity":
+	case contentEncodingGzip:
+		gz, err := gzip.NewReader(stream.Reader)
+		if err != nil {
+			body.Close()
+			s.logger.Error("Load Error", zap.String("key", key), s.errField(err))
+			return nil, err
+		}
+		stream.Reader = gz
+		stream.closers = append(stream.closers, gz)
+	default:
+		body.Close()
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	return stream, nil
+}
+
+func (s *Storage) loadBuffered(ctx context.Context, key string) (io.ReadCloser, error) {
+	value, err := s.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(value)), nil
+}
+
+// valueStream reads a value and closes everything it is read through.
+type valueStream struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (v *valueStream) Close() error {
+	var err error
+	for i := len(v.closers) - 1; i >= 0; i-- {
+		if cerr := v.closers[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// checkedReader fails with ErrChecksumMismatch at the end of r if what was
+// read doesn't match the hash want.
+type checkedReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want []byte
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := c.hash.Sum(nil); !bytes.Equal(got, c.want) {
+			return n, fmt.Errorf("%w: got %x, stored %x", ErrChecksumMismatch, got, c.want)
+		}
+	}
+	return n, err
+}
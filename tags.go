@@ -0,0 +1,82 @@
+package certmagic_azblob
+
+import (
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// Index tags written with index_tags, see blobTags.
+const (
+	tagType   = "type"
+	tagIssuer = "issuer"
+	tagDomain = "domain"
+)
+
+// maxTagValue is the longest value Azure accepts for an index tag.
+const maxTagValue = 256
+
+// blobTags derives index tags from the certmagic key layout:
+//
+//	certificates/<issuer>/<domain>/<domain>.crt|.key|.json
+//	ocsp/<domain>-<hash>
+//	acme/<issuer>/...
+//
+// Keys outside of that layout are stored without tags.
+func blobTags(key string) azblob.BlobTagsMap {
+	parts := strings.Split(key, "/")
+	switch {
+	case parts[0] == "certificates" && len(parts) == 4:
+		tags := azblob.BlobTagsMap{
+			tagIssuer: tagValue(parts[1]),
+			tagDomain: tagValue(parts[2]),
+		}
+		switch path.Ext(parts[3]) {
+		case ".crt":
+			tags[tagType] = "certificate"
+		case ".key":
+			tags[tagType] = "key"
+		case ".json":
+			tags[tagType] = "metadata"
+		}
+		return tags
+	case parts[0] == "ocsp" && len(parts) == 2:
+		tags := azblob.BlobTagsMap{tagType: "ocsp"}
+		if i := strings.LastIndex(parts[1], "-"); i > 0 {
+			tags[tagDomain] = tagValue(parts[1][:i])
+		}
+		return tags
+	case parts[0] == "acme" && len(parts) > 2:
+		return azblob.BlobTagsMap{
+			tagType:   "account",
+			tagIssuer: tagValue(parts[1]),
+		}
+	}
+	return nil
+}
+
+// tagValue replaces the characters index tags don't allow. Keys made safe
+// by certmagic rarely contain any.
+func tagValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" +-./:=_", r):
+			return r
+		}
+		return '_'
+	}, s)
+	if len(s) > maxTagValue {
+		s = s[:maxTagValue]
+	}
+	return s
+}
+
+// isAccountKey reports whether key is the registration or private key of
+// an ACME account, acme/<ca>/users/<email>/<name>.json|.key.
+func isAccountKey(key string) bool {
+	parts := strings.Split(key, "/")
+	return len(parts) == 5 && parts[0] == "acme" && parts[2] == "users"
+}
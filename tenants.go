@@ -0,0 +1,131 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// Tenant routes the keys of some domains or key prefixes to a storage of
+// their own, e.g. a container in the customer's account.
+type Tenant struct {
+	// Domains are names like example.com or *.example.com whose
+	// certificates, OCSP staples and locks belong to the tenant.
+	Domains []string `json:"domains,omitempty"`
+
+	// Prefixes are key prefixes, e.g. certificates/acme-v02.api.letsencrypt.org-directory/shop.example.com/,
+	// that belong to the tenant regardless of the domain.
+	Prefixes []string `json:"prefixes,omitempty"`
+
+	Options
+}
+
+type tenant struct {
+	domains  []string
+	prefixes []string
+	storage  *Storage
+}
+
+// newTenants returns the storages of the configured tenants.
+func (s *Storage) newTenants() ([]tenant, error) {
+	tenants := make([]tenant, 0, len(s.Tenants))
+	for i, t := range s.Tenants {
+		if len(t.Domains) == 0 && len(t.Prefixes) == 0 {
+			return nil, fmt.Errorf("tenant %d has neither domains nor prefixes", i)
+		}
+		o := t.Options
+		if len(o.Tenants) > 0 {
+			return nil, fmt.Errorf("tenant %d can not have tenants itself", i)
+		}
+		if o.Logger == nil {
+			o.Logger = s.logger.Named("tenant")
+		}
+		if o.Hooks == nil {
+			o.Hooks = s.Hooks
+		}
+
+		storage, err := New(o)
+		if err != nil {
+			closeTenants(tenants)
+			return nil, fmt.Errorf("tenant %d: %v", i, err)
+		}
+		tenants = append(tenants, tenant{domains: t.Domains, prefixes: t.Prefixes, storage: storage})
+	}
+	return tenants, nil
+}
+
+func closeTenants(tenants []tenant) {
+	for _, t := range tenants {
+		t.storage.Close()
+	}
+}
+
+// tenantFor returns the storage of the tenant key belongs to, or nil if
+// it is stored by s itself. Prefixes are matched before domains.
+func (s *Storage) tenantFor(key string) *Storage {
+	if len(s.tenants) == 0 {
+		return nil
+	}
+	key = strings.TrimPrefix(key, "/")
+	for _, t := range s.tenants {
+		for _, prefix := range t.prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return t.storage
+			}
+		}
+	}
+
+	domain := keyDomain(key)
+	if domain == "" {
+		return nil
+	}
+	for _, t := range s.tenants {
+		for _, pattern := range t.domains {
+			if certmagic.MatchWildcard(domain, pattern) {
+				return t.storage
+			}
+		}
+	}
+	return nil
+}
+
+// keyDomain returns the domain a certmagic key is about: the site of
+// certificates/<issuer>/<site>/..., the first name of an OCSP staple
+// ocsp/<name>-<hash> or the name of a lock like issue_cert_<name>. Keys of
+// ACME accounts and other keys have none.
+func keyDomain(key string) string {
+	var domain string
+	parts := strings.Split(key, "/")
+	switch {
+	case parts[0] == "certificates" && len(parts) >= 3:
+		domain = parts[2]
+	case parts[0] == "ocsp" && len(parts) == 2:
+		if i := strings.LastIndex(parts[1], "-"); i > 0 {
+			domain = parts[1][:i]
+		}
+	case len(parts) == 1 && strings.HasPrefix(key, "issue_cert_"):
+		domain = strings.TrimPrefix(key, "issue_cert_")
+	}
+	// Undo certmagic's KeyBuilder.Safe for wildcard names.
+	return strings.Replace(domain, "wildcard_", "*", 1)
+}
+
+// mergeTenantKeys adds the keys below prefix of every tenant to keys.
+func (s *Storage) mergeTenantKeys(ctx context.Context, keys []string, prefix string, recursive bool) ([]string, error) {
+	keys = append([]string(nil), keys...)
+	for _, t := range s.tenants {
+		tenantKeys, err := t.storage.List(ctx, prefix, recursive)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = mergeKeys(keys, tenantKeys)
+	}
+	return keys, nil
+}
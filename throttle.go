@@ -0,0 +1,105 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"go.uber.org/zap"
+)
+
+// Backoff of requests the account throttled, doubled per attempt.
+const (
+	defaultThrottleRetries = 3
+	throttleRetryDelay     = 2 * time.Second
+	throttleMaxRetryDelay  = time.Minute
+)
+
+// throttled returns the response of err if the account rejected the request
+// because it is over its limits.
+func throttled(err error) *http.Response {
+	resp := errorResponse(err)
+	if resp == nil {
+		return nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return resp
+	}
+	return nil
+}
+
+// retryAfter returns the delay the service asked for, or 0.
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// throttleDelay is the wait before the given retry of a throttled request:
+// exponential with up to half of it as jitter, but no less than the
+// service's Retry-After.
+func throttleDelay(attempt int, resp *http.Response) time.Duration {
+	delay := throttleRetryDelay << attempt
+	if delay > throttleMaxRetryDelay || delay <= 0 {
+		delay = throttleMaxRetryDelay
+	}
+	delay += time.Duration(rand.Int63n(int64(delay/2) + 1))
+
+	if after := retryAfter(resp); after > delay {
+		delay = after
+	}
+	return delay
+}
+
+// throttlePolicy retries requests that are still throttled after the SDK's
+// retries, which neither honor Retry-After nor cover 429 responses.
+func (s *Storage) throttlePolicy() pipeline.Factory {
+	retries := s.ThrottleRetries
+	if retries == 0 {
+		retries = defaultThrottleRetries
+	}
+
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			for attempt := 0; ; attempt++ {
+				resp, err := next.Do(ctx, request)
+				throttledResp := throttled(err)
+				if throttledResp == nil {
+					return resp, err
+				}
+				observeThrottled(throttledResp.StatusCode)
+
+				if attempt >= retries {
+					s.logger.Error("Throttled by Azure Storage",
+						zap.String("url", request.URL.Path),
+						zap.Int("status", throttledResp.StatusCode),
+						zap.Int("attempts", attempt+1))
+					return resp, &throttledError{err}
+				}
+
+				delay := throttleDelay(attempt, throttledResp)
+				s.logger.Warn("Throttled by Azure Storage, backing off",
+					zap.String("url", request.URL.Path),
+					zap.Int("status", throttledResp.StatusCode),
+					zap.Duration("delay", delay))
+
+				timer := time.NewTimer(delay)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return resp, err
+				case <-timer.C:
+				}
+			}
+		}
+	})
+}
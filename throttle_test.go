@@ -0,0 +1,32 @@
+package certmagic_azblob
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestThrottleDelay(t *testing.T) {
+	for _, tt := range []struct {
+		attempt    int
+		retryAfter string
+		min, max   time.Duration
+	}{
+		{0, "", throttleRetryDelay, throttleRetryDelay * 3 / 2},
+		{2, "", 4 * throttleRetryDelay, 6 * throttleRetryDelay},
+		{2, "1", 4 * throttleRetryDelay, 6 * throttleRetryDelay},
+		{10, "", throttleMaxRetryDelay, throttleMaxRetryDelay * 3 / 2},
+		{100, "", throttleMaxRetryDelay, throttleMaxRetryDelay * 3 / 2},
+		{0, "120", 120 * time.Second, 120 * time.Second},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.retryAfter != "" {
+			resp.Header.Set("Retry-After", tt.retryAfter)
+		}
+		for i := 0; i < 100; i++ {
+			if d := throttleDelay(tt.attempt, resp); d < tt.min || d > tt.max {
+				t.Fatalf("throttleDelay(%d) with Retry-After %q = %v, want %v to %v", tt.attempt, tt.retryAfter, d, tt.min, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// TierRule writes keys below Prefix to Tier, e.g. ocsp/ to Cool. With
+// After, the rule only applies to keys that weren't modified for that long
+// and is applied by the tier sweep rather than on Store.
+type TierRule struct {
+	Prefix string         `json:"prefix"`
+	Tier   string         `json:"tier"`
+	After  caddy.Duration `json:"after,omitempty"`
+}
+
+type tierRule struct {
+	prefix string
+	tier   azblob.AccessTierType
+	after  time.Duration
+}
+
+// parseTierRules validates rules and their tiers.
+func parseTierRules(rules []TierRule) ([]tierRule, error) {
+	parsed := make([]tierRule, 0, len(rules))
+	for _, r := range rules {
+		tier, err := parseAccessTier(r.Tier)
+		if err != nil {
+			return nil, fmt.Errorf("tier rule %s: %v", r.Prefix, err)
+		}
+		if tier == azblob.DefaultAccessTier {
+			return nil, fmt.Errorf("tier rule %s has no tier", r.Prefix)
+		}
+		parsed = append(parsed, tierRule{prefix: strings.TrimPrefix(r.Prefix, "/"), tier: tier, after: time.Duration(r.After)})
+	}
+	return parsed, nil
+}
+
+// tierFor returns the tier of a key last modified age ago: that of the
+// rule with the longest matching prefix and, among those, the longest After
+// the key is older than. Without a matching rule it is access_tier.
+func (s *Storage) tierFor(key string, age time.Duration) azblob.AccessTierType {
+	tier := s.accessTier
+	var best *tierRule
+	for i, r := range s.tierRules {
+		if !strings.HasPrefix(key, r.prefix) || r.after > age {
+			continue
+		}
+		if best == nil || len(r.prefix) > len(best.prefix) || len(r.prefix) == len(best.prefix) && r.after > best.after {
+			best = &s.tierRules[i]
+		}
+	}
+	if best != nil {
+		tier = best.tier
+	}
+	return tier
+}
+
+// sweepTiers re-tiers the container every TierSweepInterval until the
+// storage is closed.
+func (s *Storage) sweepTiers() {
+	ticker := time.NewTicker(time.Duration(s.TierSweepInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := s.Retier(s.ctx)
+		if err != nil && s.ctx.Err() == nil {
+			s.logger.Error("Tier Sweep Error", s.errField(err))
+			continue
+		}
+		s.logger.Info("Tier sweep finished", zap.Int("changed", changed))
+	}
+}
+
+// Retier moves every blob whose tier differs from its tier rules to the
+// rule's tier and returns how many it moved. Archived blobs, locks, health
+// check probes and append blobs are left alone.
+func (s *Storage) Retier(ctx context.Context) (int, error) {
+	if s.NoList {
+		return 0, ErrListUnsupported
+	}
+
+	var changed int
+	for _, sh := range s.allShards() {
+		n, err := s.retierShard(ctx, sh)
+		changed += n
+		if err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+func (s *Storage) retierShard(ctx context.Context, sh shard) (int, error) {
+	var prefix string
+	if s.Prefix != "" {
+		prefix = s.Prefix + "/"
+	}
+
+	var changed int
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listCtx, cancel := s.withTimeout(ctx, s.ListTimeout)
+		ls, err := sh.containerURL.ListBlobsFlatSegment(listCtx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		cancel()
+		if err != nil {
+			return changed, err
+		}
+
+		for _, v := range ls.Segment.BlobItems {
+			if v.Properties.BlobType != azblob.BlobBlockBlob || v.Properties.AccessTier == azblob.AccessTierArchive || s.isLockBlob(v.Name) {
+				continue
+			}
+			key := s.keyName(v.Name)
+			if s.shardFor(key).name != sh.name || strings.HasPrefix(key, "locks/") || strings.HasPrefix(key, "healthcheck/") || s.isAuditKey(key) {
+				continue
+			}
+
+			tier := s.tierFor(key, time.Since(v.Properties.LastModified))
+			if tier == azblob.DefaultAccessTier || tier == v.Properties.AccessTier {
+				continue
+			}
+
+			tierCtx, cancel := s.withTimeout(ctx, s.StoreTimeout)
+			_, err := sh.containerURL.NewBlobURL(v.Name).SetTier(tierCtx, tier, azblob.LeaseAccessConditions{}, azblob.RehydratePriorityNone)
+			cancel()
+			if err != nil {
+				s.logger.Warn("Tier Sweep Skipped", zap.String("key", key), s.errField(err))
+				continue
+			}
+			s.logger.Debug("Retiered key", zap.String("key", key), zap.String("from", string(v.Properties.AccessTier)), zap.String("to", string(tier)))
+			changed++
+		}
+		marker = ls.NextMarker
+	}
+	return changed, nil
+}
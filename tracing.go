@@ -0,0 +1,69 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTracer returns the tracer for storage spans. Spans are only recorded
+// when tracing is enabled, using the configured provider or the global one.
+func (s *Storage) newTracer() trace.Tracer {
+	if !s.Tracing {
+		return trace.NewNoopTracerProvider().Tracer(modulePath)
+	}
+	if s.TracerProvider != nil {
+		return s.TracerProvider.Tracer(modulePath)
+	}
+	return otel.GetTracerProvider().Tracer(modulePath)
+}
+
+// startSpan starts a span for a storage operation on key as a child of any
+// span in ctx. The operation counts as in flight until the span ends. Once
+// Close started, it fails with ErrClosed, and the span it returns must
+// still be ended.
+func (s *Storage) startSpan(ctx context.Context, op string, key string) (context.Context, trace.Span, error) {
+	ctx, span := s.tracer.Start(ctx, "azblob."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("azblob.operation", op),
+		attribute.String("azblob.key", key),
+		attribute.String("azblob.container", s.ContainerName),
+	))
+
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+	if s.closed {
+		return ctx, span, ErrClosed
+	}
+	s.inflight.Add(1)
+	return ctx, trackedSpan{Span: span, done: s.inflight.Done}, nil
+}
+
+// endSpan ends span, marking it failed if *err is set. Missing keys are not
+// treated as failures.
+func endSpan(span trace.Span, err *error) {
+	if *err != nil && !errors.Is(*err, fs.ErrNotExist) {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// spanStatusPolicy records the status code of every Azure response on the
+// span of the operation that sent it.
+func spanStatusPolicy() pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			resp, err := next.Do(ctx, request)
+			if resp != nil && resp.Response() != nil {
+				trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.status_code", resp.Response().StatusCode))
+			}
+			return resp, err
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package certmagic_azblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/google/uuid"
+)
+
+// defaultBlockSize is the size up to which values are transferred in a
+// single request, and the size of the blocks larger values are split into.
+const defaultBlockSize = azblob.BlobDefaultDownloadBlockSize
+
+// defaultParallelism is how many blocks are transferred at once.
+const defaultParallelism = 5
+
+// defaultMaxValueSize is far above anything certmagic stores, but keeps a
+// corrupted or replaced blob from exhausting memory.
+const defaultMaxValueSize = 64 << 20
+
+func (s *Storage) blockSize() int64 {
+	if s.BlockSize > 0 {
+		return s.BlockSize
+	}
+	return defaultBlockSize
+}
+
+func (s *Storage) parallelism() uint16 {
+	if s.Parallelism > 0 {
+		return uint16(s.Parallelism)
+	}
+	return defaultParallelism
+}
+
+// maxValueSize returns the largest value Load reads, or 0 for no limit.
+func (s *Storage) maxValueSize() int64 {
+	switch {
+	case s.MaxValueSize < 0:
+		return 0
+	case s.MaxValueSize > 0:
+		return s.MaxValueSize
+	}
+	return defaultMaxValueSize
+}
+
+// upload writes value to blobURL with the given headers and tier if ac
+// holds, in one request if it fits into a block and as parallel staged
+// blocks otherwise. It returns the last modified time and ETag of the new
+// blob. The MD5 hash of value is stored with the blob and checked by the
+// service for every request.
+func (s *Storage) upload(ctx context.Context, blobURL azblob.BlockBlobURL, value []byte, headers azblob.BlobHTTPHeaders, ac azblob.BlobAccessConditions, metadata azblob.Metadata, tags azblob.BlobTagsMap, tier azblob.AccessTierType) (time.Time, azblob.ETag, error) {
+	sum := md5.Sum(value)
+	headers.ContentMD5 = sum[:]
+
+	size := int64(len(value))
+	if size <= s.blockSize() {
+		resp, err := blobURL.Upload(ctx, bytes.NewReader(value), headers, metadata, ac, tier, tags, s.cpk, s.immutabilityPolicy())
+		if err != nil {
+			return time.Time{}, azblob.ETagNone, err
+		}
+		return resp.LastModified(), resp.ETag(), nil
+	}
+
+	blockIDs := make([]string, (size-1)/s.blockSize()+1)
+	err := azblob.DoBatchTransfer(ctx, azblob.BatchTransferOptions{
+		OperationName: "upload",
+		TransferSize:  size,
+		ChunkSize:     s.blockSize(),
+		Parallelism:   s.parallelism(),
+		Operation: func(offset int64, count int64, ctx context.Context) error {
+			// Random IDs keep blocks staged by concurrent writers apart.
+			id := uuid.New()
+			blockID := base64.StdEncoding.EncodeToString(id[:])
+			blockIDs[offset/s.blockSize()] = blockID
+
+			block := value[offset : offset+count]
+			sum := md5.Sum(block)
+			_, err := blobURL.StageBlock(ctx, blockID, bytes.NewReader(block), azblob.LeaseAccessConditions{}, sum[:], s.cpk)
+			return err
+		},
+	})
+	if err != nil {
+		return time.Time{}, azblob.ETagNone, err
+	}
+
+	resp, err := blobURL.CommitBlockList(ctx, blockIDs, headers, metadata, ac, tier, tags, s.cpk, s.immutabilityPolicy())
+	if err != nil {
+		return time.Time{}, azblob.ETagNone, err
+	}
+	return resp.LastModified(), resp.ETag(), nil
+}
+
+// readBody reads the blob of a download response and verifies it against
+// the MD5 hash stored with the blob, if any. Blobs larger than a block are
+// read as the first block from the response and the rest in parallel ranges,
+// all pinned to the ETag of the response.
+func (s *Storage) readBody(ctx context.Context, blobURL azblob.BlobURL, get *azblob.DownloadResponse) ([]byte, error) {
+	data, err := s.readAll(ctx, blobURL, get)
+	if err != nil {
+		return nil, err
+	}
+
+	if want := get.ContentMD5(); len(want) > 0 {
+		if got := md5.Sum(data); !bytes.Equal(got[:], want) {
+			return nil, fmt.Errorf("%w: got %x, stored %x", ErrChecksumMismatch, got, want)
+		}
+	}
+	return data, nil
+}
+
+func (s *Storage) readAll(ctx context.Context, blobURL azblob.BlobURL, get *azblob.DownloadResponse) ([]byte, error) {
+	body := get.Body(s.retryReaderOptions())
+	defer body.Close()
+
+	size := get.ContentLength()
+	if max := s.maxValueSize(); max > 0 && size > max {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, size)
+	}
+	if size <= s.blockSize() {
+		data := &bytes.Buffer{}
+		if _, err := data.ReadFrom(body); err != nil {
+			return nil, err
+		}
+		return data.Bytes(), nil
+	}
+
+	data := make([]byte, size)
+	first := s.blockSize()
+	if _, err := io.ReadFull(body, data[:first]); err != nil {
+		return nil, err
+	}
+	body.Close()
+
+	err := azblob.DownloadBlobToBuffer(ctx, blobURL, first, size-first, data[first:], azblob.DownloadFromBlobOptions{
+		BlockSize:   s.blockSize(),
+		Parallelism: s.parallelism(),
+		AccessConditions: azblob.BlobAccessConditions{
+			ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: get.ETag()},
+		},
+		ClientProvidedKeyOptions:   s.cpk,
+		RetryReaderOptionsPerBlock: s.retryReaderOptions(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
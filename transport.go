@@ -0,0 +1,129 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// defaultMaxIdleConnsPerHost keeps connections to the account's endpoint
+// around for concurrent renewals, Go's default is 2.
+const defaultMaxIdleConnsPerHost = 16
+
+// newHTTPClient returns the HTTP client used for all Azure requests. The
+// proxy defaults to the HTTPS_PROXY / NO_PROXY environment variables.
+func (s *Storage) newHTTPClient() (*http.Client, error) {
+	if s.memory {
+		return &http.Client{Transport: memoryBlobs}, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	// Compressed blobs are decoded after decryption, not by the transport.
+	transport.DisableCompression = true
+
+	transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if s.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = s.MaxIdleConnsPerHost
+	}
+	if s.MaxIdleConns > 0 {
+		transport.MaxIdleConns = s.MaxIdleConns
+	}
+	transport.MaxConnsPerHost = s.MaxConnsPerHost
+	if s.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(s.IdleConnTimeout)
+	}
+	if s.KeepAlive != 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: time.Duration(s.KeepAlive)}
+		transport.DialContext = dialer.DialContext
+	}
+	if s.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	if s.Proxy != "" {
+		proxy, err := url.Parse(s.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing proxy: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: s.TLSInsecureSkipVerify,
+	}
+
+	if s.CACertFile != "" {
+		pem, err := os.ReadFile(s.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_cert_file: %v", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_cert_file %s contains no certificates", s.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// withServerName returns a copy of client that addresses every host as
+// serverName, in the Host header and SNI, and expects its certificate. It is
+// only used for blob requests, Azure AD and Key Vault keep verifying their
+// own names.
+func withServerName(client *http.Client, serverName string) *http.Client {
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.ServerName = serverName
+	return &http.Client{Transport: hostRoundTripper{transport, serverName}}
+}
+
+type hostRoundTripper struct {
+	next http.RoundTripper
+	host string
+}
+
+func (h hostRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Host = h.host
+	return h.next.RoundTrip(req)
+}
+
+// clientOptions makes the azcore based clients (Azure AD, Key Vault) use the
+// same HTTP client as the blob pipeline.
+func (s *Storage) clientOptions() azcore.ClientOptions {
+	if s.httpClient == nil {
+		return azcore.ClientOptions{}
+	}
+	return azcore.ClientOptions{Transport: s.httpClient}
+}
+
+// newHTTPSender adapts an http.Client to the azblob pipeline.
+func newHTTPSender(client *http.Client) pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			start := time.Now()
+			r, err := client.Do(request.WithContext(ctx))
+			if err != nil {
+				err = pipeline.NewError(err, fmt.Sprintf("HTTP request failed after %s", time.Since(start)))
+			}
+			return pipeline.NewHTTPResponse(r), err
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+)
+
+// errVersioningUnsupported is returned for versions on an api_version that
+// predates blob versioning.
+var errVersioningUnsupported = fmt.Errorf("blob versioning requires api_version %s or later", apiVersionVersioning)
+
+// KeyVersion is a version of a key kept by blob versioning.
+type KeyVersion struct {
+	VersionID string    `json:"version_id"`
+	Modified  time.Time `json:"modified"`
+	Size      int64     `json:"size"`
+	Current   bool      `json:"current"`
+}
+
+// ListVersions returns the versions of key, oldest first. It requires blob
+// versioning on the account and returns fs.ErrNotExist if key has none.
+func (s *Storage) ListVersions(ctx context.Context, key string) ([]KeyVersion, error) {
+	if !s.supports(apiVersionVersioning) {
+		return nil, errVersioningUnsupported
+	}
+	if s.NoList {
+		return nil, ErrListUnsupported
+	}
+
+	ctx, cancel := s.withTimeout(ctx, s.ListTimeout)
+	defer cancel()
+
+	name := s.blobName(key)
+	versions := make([]KeyVersion, 0)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		ls, err := s.container(key).ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Details: azblob.BlobListingDetails{Versions: true},
+			Prefix:  name,
+		})
+		if err != nil {
+			s.logger.Error("List Versions Error", zap.String("key", key), s.errField(err))
+			return nil, err
+		}
+
+		for _, v := range ls.Segment.BlobItems {
+			if v.Name != name || v.VersionID == nil {
+				continue
+			}
+			version := KeyVersion{
+				VersionID: *v.VersionID,
+				Modified:  v.Properties.LastModified,
+				Current:   v.IsCurrentVersion != nil && *v.IsCurrentVersion,
+			}
+			if v.Properties.ContentLength != nil {
+				version.Size = *v.Properties.ContentLength
+			}
+			versions = append(versions, version)
+		}
+		marker = ls.NextMarker
+	}
+
+	if len(versions) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return versions, nil
+}
+
+// RestoreVersion makes a previous version of key its current value. The
+// stored bytes, headers and metadata are copied as they are, so values
+// encrypted with client_encryption_key stay encrypted with the key they were
+// written with.
+func (s *Storage) RestoreVersion(ctx context.Context, key, versionID string) (err error) {
+	if !s.supports(apiVersionVersioning) {
+		return errVersioningUnsupported
+	}
+	if s.AuditLog != "" {
+		defer func() { s.audit("restore_version", key, err) }()
+	}
+
+	ctx, cancel := s.withTimeout(ctx, s.StoreTimeout)
+	defer cancel()
+
+	if s.cache != nil {
+		defer s.cache.invalidate(key)
+	}
+	if s.listCache != nil {
+		defer s.listCache.invalidate(key)
+	}
+	if s.diskCache != nil {
+		// The next Load fetches the restored value.
+		defer s.diskCache.remove(key)
+	}
+
+	blobURL := s.container(key).NewBlockBlobURL(s.blobName(key))
+	versionURL := blobURL.WithVersionID(versionID).BlobURL
+	get, err := versionURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, s.cpk)
+	if isNotFound(err) {
+		return fmt.Errorf("version %s of %s: %w", versionID, key, fs.ErrNotExist)
+	}
+	if err != nil {
+		s.logger.Error("Restore Version Error", zap.String("key", key), s.errField(err))
+		return err
+	}
+
+	data, err := s.readBody(ctx, versionURL, get)
+	if err != nil {
+		s.logger.Error("Restore Version Error", zap.String("key", key), s.errField(err))
+		return err
+	}
+
+	_, _, err = s.upload(ctx, blobURL, data, get.NewHTTPHeaders(), azblob.BlobAccessConditions{}, get.NewMetadata(), nil, s.tierFor(key, 0))
+	s.setETag(key, azblob.ETagNone)
+	if err != nil {
+		s.logger.Error("Restore Version Error", zap.String("key", key), s.errField(err))
+		return err
+	}
+
+	s.logger.Info("Restored version", zap.String("key", key), zap.String("version", versionID))
+	return nil
+}
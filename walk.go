@@ -0,0 +1,220 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// listConcurrency is how many directories walkKeys lists in parallel.
+const listConcurrency = 8
+
+// walkKeys calls fn with the keys below prefix a page at a time as they are
+// listed, recursively, instead of collecting them all like List does. The
+// directories below prefix are listed in parallel, so pages come in no
+// particular order, but fn is never called concurrently. An error
+// returned by fn stops the walk and is returned. Unlike List, it only
+// covers the containers of s and its tenants, not a failover or migration
+// source storage.
+func (s *Storage) walkKeys(ctx context.Context, prefix string, fn func(keys []string) error) error {
+	if s.NoList {
+		return ErrListUnsupported
+	}
+
+	err := s.walkShards(ctx, prefix, false, fn)
+	if isNotFound(err) {
+		err = fs.ErrNotExist
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, t := range s.tenants {
+		tenantErr := t.storage.walkKeys(ctx, prefix, fn)
+		if tenantErr == nil {
+			err = nil
+		} else if !errors.Is(tenantErr, fs.ErrNotExist) {
+			return tenantErr
+		}
+	}
+	return err
+}
+
+// walkDir is a directory below the prefix of a walk, as a blob name prefix
+// ending in "/".
+type walkDir struct {
+	sh     shard
+	c      azblob.ContainerURL
+	prefix string
+}
+
+// walkShards lists the keys below prefix recursively in every container
+// they may be stored in, on the secondary endpoint if secondary is set, and
+// passes them to fn a page at a time. Like listShards, only keys that
+// belong into a container are taken from it.
+func (s *Storage) walkShards(ctx context.Context, prefix string, secondary bool, fn func(keys []string) error) error {
+	shards := []shard{s.shardFor(prefix)}
+	if strings.Trim(prefix, "/") == "" {
+		shards = s.allShards()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+	)
+	// emit serializes the calls of fn, and the first error of either a
+	// listing or fn cancels the rest of the walk.
+	emit := func(sh shard, keys []string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr != nil {
+			return
+		}
+		if err == nil && len(keys) > 0 {
+			err = fn(s.shardKeys(shards, sh, keys))
+		}
+		if err != nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	// The prefix is a directory, so that "certificates" neither matches
+	// "certificates-old/" nor lists as the single directory "certificates/".
+	name := s.blobName("")
+	if p := strings.Trim(prefix, "/"); p != "" {
+		name = s.blobName(p) + "/"
+	}
+
+	// The first level is listed as a hierarchy to find the directories to
+	// walk in parallel. Every blob below prefix is either at that level or
+	// below one of them. A level with a single directory, like the one
+	// issuer below certificates/, is descended into.
+	var dirs []walkDir
+	for _, sh := range shards {
+		c := sh.containerURL
+		if secondary {
+			c = *sh.secondaryURL
+		}
+
+		for level := name; ; {
+			keys, prefixes, err := s.listLevel(ctx, c, level)
+			emit(sh, keys, err)
+			if err != nil {
+				return firstErr
+			}
+			if len(prefixes) != 1 {
+				for _, p := range prefixes {
+					dirs = append(dirs, walkDir{sh: sh, c: c, prefix: p})
+				}
+				break
+			}
+			level = prefixes[0]
+		}
+	}
+
+	work := make(chan walkDir)
+	var wg sync.WaitGroup
+	for i := 0; i < listConcurrency && i < len(dirs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range work {
+				sh := d.sh
+				err := s.listFlatPages(ctx, d.c, d.prefix, func(keys []string) error {
+					emit(sh, keys, nil)
+					return ctx.Err()
+				})
+				emit(sh, nil, err)
+			}
+		}()
+	}
+	for _, d := range dirs {
+		work <- d
+	}
+	close(work)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return firstErr
+}
+
+// shardKeys returns the keys listed from sh that belong into it.
+func (s *Storage) shardKeys(shards []shard, sh shard, keys []string) []string {
+	if len(shards) == 1 {
+		return keys
+	}
+	own := keys[:0]
+	for _, key := range keys {
+		if s.shardFor(key).name == sh.name {
+			own = append(own, key)
+		}
+	}
+	return own
+}
+
+// listLevel lists the blobs starting with name up to the next "/", and the
+// prefixes up to and including it that other blobs start with.
+func (s *Storage) listLevel(ctx context.Context, c azblob.ContainerURL, name string) (keys, prefixes []string, err error) {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listCtx, cancel := s.withTimeout(ctx, s.ListTimeout)
+		ls, err := c.ListBlobsHierarchySegment(listCtx, marker, "/", azblob.ListBlobsSegmentOptions{
+			Details: azblob.BlobListingDetails{Metadata: s.HNS},
+			Prefix:  name,
+		})
+		cancel()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, v := range ls.Segment.BlobPrefixes {
+			if !s.isLockBlob(v.Name) {
+				prefixes = append(prefixes, v.Name)
+			}
+		}
+		for _, v := range ls.Segment.BlobItems {
+			if s.HNS && isFolder(v.Metadata) || s.isLockBlob(v.Name) {
+				continue
+			}
+			keys = append(keys, s.keyName(v.Name))
+		}
+		marker = ls.NextMarker
+	}
+	return keys, prefixes, nil
+}
+
+// listFlatPages calls fn with the keys of each page of blobs starting with
+// name.
+func (s *Storage) listFlatPages(ctx context.Context, c azblob.ContainerURL, name string, fn func(keys []string) error) error {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listCtx, cancel := s.withTimeout(ctx, s.ListTimeout)
+		ls, err := c.ListBlobsFlatSegment(listCtx, marker, azblob.ListBlobsSegmentOptions{
+			Details: azblob.BlobListingDetails{Metadata: s.HNS},
+			Prefix:  name,
+		})
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(ls.Segment.BlobItems))
+		for _, v := range ls.Segment.BlobItems {
+			if s.HNS && isFolder(v.Metadata) || s.isLockBlob(v.Name) {
+				continue
+			}
+			keys = append(keys, s.keyName(v.Name))
+		}
+		if err := fn(keys); err != nil {
+			return err
+		}
+		marker = ls.NextMarker
+	}
+	return nil
+}
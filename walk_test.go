@@ -0,0 +1,47 @@
+package certmagic_azblob
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWalkKeysPrefixIsDirectory(t *testing.T) {
+	s := newMemoryStorage(t)
+	ctx := context.Background()
+	for _, key := range []string{
+		"certificates/issuer/a.com/a.com.crt",
+		"certificates/issuer/b.com/b.com.crt",
+		"certificates/issuer/c.com/c.com.crt",
+		"certificates-old/issuer/a.com/a.com.crt",
+	} {
+		if err := s.Store(ctx, key, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, prefix := range []string{"certificates", "certificates/", "/certificates/"} {
+		var walked []string
+		err := s.walkKeys(ctx, prefix, func(keys []string) error {
+			walked = append(walked, keys...)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(walked)
+		want := "certificates/issuer/a.com/a.com.crt,certificates/issuer/b.com/b.com.crt,certificates/issuer/c.com/c.com.crt"
+		if got := strings.Join(walked, ","); got != want {
+			t.Errorf("walkKeys(%q) = %s, want %s", prefix, got, want)
+		}
+	}
+
+	keys, err := s.List(ctx, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sort.StringsAreSorted(keys) || len(keys) != 4 {
+		t.Errorf("recursive List = %v, want the 4 keys sorted", keys)
+	}
+}